@@ -208,6 +208,8 @@ class IrcNetwork {
     };
     if (serverPassword != null && serverPassword!.isNotEmpty) {
       data['server_password'] = serverPassword;
+      // On update the stored password is kept unless it is listed here
+      data['replace'] = ['server_password'];
     }
     if (includeId) {
       data['id'] = id;
@@ -70,9 +70,10 @@ class WebSocketService {
     _statusController.add(WebSocketStatus.connecting);
     print("[WebSocketService] Attempting to connect to $websocketUrl...");
 
-    final uri = Uri.parse("$websocketUrl/$token");
+    // The token goes in a subprotocol so it stays out of URLs and server logs.
+    final uri = Uri.parse(websocketUrl);
     try {
-      _ws = WebSocketChannel.connect(uri);
+      _ws = WebSocketChannel.connect(uri, protocols: ['iris', 'iris.token.$token']);
 
       _ws!.ready.then((_) {
         _reconnectAttempts = 0;
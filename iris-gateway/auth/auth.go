@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"fmt"
+
+	"iris-gateway/config"
+	"iris-gateway/users"
+)
+
+var oidcProvider *OIDC
+
+// Setup installs the authenticator chosen by config.Cfg.AuthBackend.
+func Setup() error {
+	switch config.Cfg.AuthBackend {
+	case "", users.LocalAuthSource:
+		return nil
+	case "ldap":
+		if config.Cfg.LDAPURL == "" || config.Cfg.LDAPBaseDN == "" {
+			return fmt.Errorf("the ldap backend needs LDAPURL and LDAPBaseDN")
+		}
+		users.SetAuthenticator(&LDAP{})
+	case "oidc":
+		if config.Cfg.OIDCIssuerURL == "" || config.Cfg.OIDCClientID == "" || config.Cfg.OIDCRedirectURL == "" {
+			return fmt.Errorf("the oidc backend needs OIDCIssuerURL, OIDCClientID and OIDCRedirectURL")
+		}
+		oidcProvider = &OIDC{}
+		users.SetAuthenticator(oidcProvider)
+	default:
+		return fmt.Errorf("unknown auth backend %q", config.Cfg.AuthBackend)
+	}
+	return nil
+}
+
+// OIDCProvider returns the OIDC authenticator, if it is the configured one.
+func OIDCProvider() (*OIDC, bool) {
+	return oidcProvider, oidcProvider != nil
+}
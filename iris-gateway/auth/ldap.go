@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"iris-gateway/config"
+	"iris-gateway/users"
+)
+
+// Longest a directory server may take to connect or answer.
+const ldapTimeout = 10 * time.Second
+
+// LDAP authenticates users by binding to a directory server as them, after
+// looking up their entry with the service account.
+type LDAP struct{}
+
+func (*LDAP) Name() string { return "ldap" }
+
+func (l *LDAP) Authenticate(username, password string) (*users.Identity, error) {
+	// An empty password would be an unauthenticated bind, which succeeds
+	if password == "" {
+		return nil, users.ErrInvalidCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := l.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, users.ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+
+	// The directory's spelling of the name, so "Alice" and "alice" are one user
+	canonical := entry.GetAttributeValue(config.Cfg.LDAPUsernameAttr)
+	if canonical == "" {
+		canonical = username
+	}
+	return &users.Identity{Username: canonical}, nil
+}
+
+func (l *LDAP) AccountActive(user *users.User) (bool, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := l.findUser(conn, user.Username); err != nil {
+		if err == users.ErrUnknownAccount {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// dial connects to the directory server and binds as the service account.
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	serverURL, err := url.Parse(config.Cfg.LDAPURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	tlsConfig := &tls.Config{ServerName: serverURL.Hostname()}
+
+	conn, err := ldap.DialURL(config.Cfg.LDAPURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(ldapTimeout)
+
+	if config.Cfg.LDAPStartTLS && serverURL.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	if config.Cfg.LDAPBindDN != "" {
+		if err := conn.Bind(config.Cfg.LDAPBindDN, config.Cfg.LDAPBindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP service account bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// findUser returns the one entry matching LDAPUserFilter for a username.
+func (l *LDAP) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(
+		config.Cfg.LDAPBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(config.Cfg.LDAPUserFilter, ldap.EscapeFilter(username)),
+		[]string{config.Cfg.LDAPUsernameAttr},
+		nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("LDAP search failed: %w", err)
+	}
+	switch {
+	case result == nil || len(result.Entries) == 0:
+		return nil, users.ErrUnknownAccount
+	case len(result.Entries) > 1:
+		return nil, fmt.Errorf("LDAP filter matches more than one entry for %s", username)
+	}
+	return result.Entries[0], nil
+}
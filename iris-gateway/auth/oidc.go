@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"iris-gateway/config"
+	"iris-gateway/users"
+)
+
+// Longest the provider may take to answer one request.
+const oidcTimeout = 15 * time.Second
+
+// OIDC logs users in with the authorization code flow of an OpenID Connect
+// provider. Passwords never reach the gateway, so there is no password login.
+type OIDC struct {
+	mu       sync.Mutex
+	provider *oidc.Provider // Discovered on first use, so startup doesn't depend on the provider
+}
+
+func (*OIDC) Name() string { return "oidc" }
+
+func (*OIDC) Authenticate(username, password string) (*users.Identity, error) {
+	return nil, users.ErrPasswordLoginUnsupported
+}
+
+// AccountActive uses the refresh token from the user's last login: a
+// provider refuses to refresh for a disabled account. Without a refresh
+// token the account can't be checked and counts as active.
+func (o *OIDC) AccountActive(user *users.User) (bool, error) {
+	refreshToken, err := users.GetExternalToken(user.ID)
+	if err != nil || refreshToken == "" {
+		return true, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	oauthConfig, _, err := o.config(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	token, err := oauthConfig.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	// Providers that rotate refresh tokens invalidate the old one
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		if err := users.SetExternalToken(user.ID, token.RefreshToken); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// config returns the OAuth2 settings and ID token verifier, discovering the
+// provider's endpoints if that hasn't worked yet.
+func (o *OIDC) config(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider == nil {
+		provider, err := oidc.NewProvider(ctx, config.Cfg.OIDCIssuerURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		o.provider = provider
+	}
+
+	oauthConfig := &oauth2.Config{
+		ClientID:     config.Cfg.OIDCClientID,
+		ClientSecret: config.Cfg.OIDCClientSecret,
+		RedirectURL:  config.Cfg.OIDCRedirectURL,
+		Endpoint:     o.provider.Endpoint(),
+		Scopes:       config.Cfg.OIDCScopes,
+	}
+	verifier := o.provider.Verifier(&oidc.Config{ClientID: config.Cfg.OIDCClientID})
+	return oauthConfig, verifier, nil
+}
+
+// AuthCodeURL returns the provider's login page for a new login. The state,
+// nonce and PKCE verifier must be kept for Exchange.
+func (o *OIDC) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	oauthConfig, _, err := o.config(ctx)
+	if err != nil {
+		return "", err
+	}
+	return oauthConfig.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Subject is the Identity subject of the provider's account with the given
+// "sub" claim. Discovery makes sure the ID token issuer is OIDCIssuerURL.
+func (*OIDC) Subject(sub string) string {
+	return config.Cfg.OIDCIssuerURL + " " + sub
+}
+
+// Exchange redeems the code the provider sent back after a login and
+// returns the account from its verified ID token.
+func (o *OIDC) Exchange(code, nonce, verifier string) (*users.Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+	oauthConfig, idTokenVerifier, err := o.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("provider returned no ID token")
+	}
+	idToken, err := idTokenVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %w", err)
+	}
+	username, _ := claims[config.Cfg.OIDCUsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("ID token has no %s claim", config.Cfg.OIDCUsernameClaim)
+	}
+
+	return &users.Identity{
+		Username: username,
+		Subject:  o.Subject(idToken.Subject),
+		Token:    token.RefreshToken,
+	}, nil
+}
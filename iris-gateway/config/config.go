@@ -13,6 +13,41 @@ type Config struct {
 	SQLiteDBPath         string // Path to the SQLite database file
 	HTTPRedirect         bool   // Whether to redirect HTTP to HTTPS
 	HTTPPort             string // Port for HTTP redirects (empty to disable)
+	MasterKeyFile        string // Key used to encrypt secrets at rest; IRIS_MASTER_KEY overrides it
+	SessionLifetime      string // How long a login token stays valid without being used (e.g. "720h")
+	LoginMaxFailures     int    // Failed logins for one username before it is locked out; an IP gets four times as many
+	LoginLockout         string // How long a lockout lasts (e.g. "15m")
+	PasswordMinLength    int    // Shortest password accepted when one is set
+	BannedPasswordsFile  string // Passwords to refuse, one per line, on top of a built-in list of common ones
+	RegistrationEnabled  bool   // Whether /api/register accepts invite codes
+	// Default per-user quotas, which admins can override per user. Zero means unlimited.
+	QuotaMaxNetworks     int   // Networks a user may configure
+	QuotaMaxConnections  int   // Networks a user may have connected at once
+	QuotaMaxChannels     int   // Channels a user may join across all networks
+	QuotaAttachmentBytes int64 // Storage for attachments that haven't expired yet
+	// Where accounts come from: "local" (users.db), "ldap" or "oidc". Directory
+	// accounts are created on first login and suspended when the directory
+	// disables them.
+	AuthBackend          string
+	AuthLocalUsers       bool   // With ldap or oidc, whether accounts created in IRIS can still log in with their own password
+	AuthSyncInterval     string // How often directory accounts are checked for being disabled (e.g. "15m")
+	LDAPURL              string // e.g. "ldaps://ldap.example.com"
+	LDAPStartTLS         bool   // Upgrade an ldap:// connection with StartTLS
+	LDAPBindDN           string // Service account used to look up users; empty for an anonymous search
+	LDAPBindPassword     string
+	LDAPBaseDN           string // Where users are searched for
+	LDAPUserFilter       string // %s is the username; should only match enabled accounts
+	LDAPUsernameAttr     string // Attribute holding the username, e.g. "uid" or "sAMAccountName"
+	OIDCIssuerURL        string // Provider whose /.well-known/openid-configuration is used
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCRedirectURL      string // This gateway's /api/login/oidc/callback URL, as registered with the provider
+	OIDCScopes           []string // "offline_access" gets a refresh token, used to notice disabled accounts
+	OIDCUsernameClaim    string // ID token claim used as the username
+	OIDCAppRedirectURL   string // Where the browser is sent after login, with the result in the URL fragment; empty to answer with JSON
+	WebhookRateLimit     int    // Posts per minute a new incoming webhook accepts, unless its owner picks another limit
+	WebhookMaxLines      int    // Lines one webhook post may send; longer payloads are cut short
+	AllowedOrigins       []string // Browser origins allowed to call the API and open WebSockets; "https://"+TLSDomain is always allowed. A ":*" port matches any port
 }
 
 var Cfg = Config{
@@ -28,4 +63,28 @@ var Cfg = Config{
 	HTTPRedirect:         true,           // Enable HTTP->HTTPS redirect
 	HTTPPort:             "",            // HTTP redirect port
 	SQLiteDBPath:         "./users.db",  // Default SQLite DB file
+	MasterKeyFile:        "./master.key", // Generated on first start if missing
+	SessionLifetime:      "720h",         // 30 days, extended on every use
+	LoginMaxFailures:     5,
+	LoginLockout:         "15m",
+	PasswordMinLength:    10,
+	BannedPasswordsFile:  "./banned_passwords.txt", // Optional
+	RegistrationEnabled:  false,
+	QuotaMaxNetworks:     0, // Unlimited, as before quotas existed; e.g. 10
+	QuotaMaxConnections:  0, // e.g. 5
+	QuotaMaxChannels:     0, // e.g. 100
+	QuotaAttachmentBytes: 0, // e.g. 100 << 20 for 100 MiB
+	AuthBackend:          "local",
+	AuthLocalUsers:       true,
+	AuthSyncInterval:     "15m",
+	LDAPUserFilter:       "(uid=%s)",
+	LDAPUsernameAttr:     "uid",
+	OIDCScopes:           []string{"openid", "profile", "email", "offline_access"},
+	OIDCUsernameClaim:    "preferred_username",
+	WebhookRateLimit:     10,
+	WebhookMaxLines:      5,
+	AllowedOrigins: []string{
+		"http://localhost:*", // Web app during development
+		"http://127.0.0.1:*",
+	},
 }
\ No newline at end of file
@@ -22,6 +22,9 @@ const (
 	EventTypeAuthError       = "auth_error"
 	EventTypeNetworkConnect    = "network_connect"    // User connected to an IRC network
 	EventTypeNetworkDisconnect = "network_disconnect" // User disconnected from an IRC network
+	EventTypeNetworkStatus     = "network_status"     // Connection state of an IRC network changed
 	EventTypeNetworkUpdate   = "network_update"   // IRC network configuration updated
 	EventTypeNetworkList     = "network_list"     // List of IRC networks
+	EventTypeIRCError        = "irc_error"        // Error numeric or FAIL/WARN reply from an IRC server
+	EventTypeTLSCertificateChanged = "tls_certificate_changed" // Server certificate no longer matches the pinned fingerprint
 )
\ No newline at end of file
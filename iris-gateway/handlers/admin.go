@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/auth"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// Most login attempts the admin API returns at once.
+const maxLoginAttemptsListed = 500
+
+// requireAdmin authenticates the request and checks that the user is an
+// admin, responding with an error if not.
+func requireAdmin(c *gin.Context) (*users.User, bool) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return nil, false
+	}
+
+	_, login, found := lookupLogin(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return nil, false
+	}
+
+	admin, err := users.GetUserByID(login.UserID)
+	if err != nil || !admin.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Admin access required"})
+		return nil, false
+	}
+	return admin, true
+}
+
+// adminTargetUser returns the user named by the :id parameter.
+func adminTargetUser(c *gin.Context) (*users.User, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid user ID"})
+		return nil, false
+	}
+	user, err := users.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "User not found"})
+		return nil, false
+	}
+	return user, true
+}
+
+// adminUserResponse describes a user along with their live connection state.
+func adminUserResponse(user *users.User, networkCount int) gin.H {
+	response := gin.H{
+		"id":                 user.ID,
+		"username":           user.Username,
+		"is_admin":           user.IsAdmin,
+		"is_suspended":       user.IsSuspended,
+		"auth_source":        user.AuthSource,
+		"created_at":         user.CreatedAt.UTC().Format(time.RFC3339),
+		"network_count":      networkCount,
+		"online":             false,
+		"devices":            0,
+		"connected_networks": 0,
+	}
+	if sess, found := session.GetSessionByUserID(user.ID); found {
+		sess.WsMutex.Lock()
+		devices := len(sess.WebSockets)
+		sess.WsMutex.Unlock()
+
+		connected := 0
+		sess.Mutex.RLock()
+		for _, netConfig := range sess.Networks {
+			if netConfig.IsConnected() {
+				connected++
+			}
+		}
+		sess.Mutex.RUnlock()
+
+		response["online"] = devices > 0
+		response["devices"] = devices
+		response["connected_networks"] = connected
+	}
+	return response
+}
+
+// AdminListUsersHandler lists every user with their network count and live
+// connection state.
+// GET /api/admin/users
+func AdminListUsersHandler(c *gin.Context) {
+	if _, ok := requireAdmin(c); !ok {
+		return
+	}
+
+	allUsers, err := users.ListUsers()
+	if err != nil {
+		log.Printf("[Admin] Failed to list users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list users"})
+		return
+	}
+	counts, err := users.CountNetworksByUser()
+	if err != nil {
+		log.Printf("[Admin] Failed to count networks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list users"})
+		return
+	}
+
+	list := make([]gin.H, 0, len(allUsers))
+	for _, user := range allUsers {
+		list = append(list, adminUserResponse(user, counts[user.ID]))
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "users": list})
+}
+
+// AdminCreateUserHandler creates a user.
+// POST /api/admin/users
+func AdminCreateUserHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		IsAdmin  bool   `json:"is_admin"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Username and password required"})
+		return
+	}
+	if _, err := users.GetUserByUsername(req.Username); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": "Username already exists"})
+		return
+	}
+
+	if err := users.CreateUser(req.Username, req.Password); err != nil {
+		if errors.Is(err, users.ErrPasswordPolicy) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": policyMessage(err)})
+			return
+		}
+		log.Printf("[Admin] Failed to create user %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create user"})
+		return
+	}
+	if req.IsAdmin {
+		if err := users.SetAdmin(req.Username, true); err != nil {
+			log.Printf("[Admin] Failed to make %s an admin: %v", req.Username, err)
+		}
+	}
+	user, err := users.GetUserByUsername(req.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create user"})
+		return
+	}
+
+	log.Printf("[Admin] %s created user %s", admin.Username, user.Username)
+	c.JSON(http.StatusCreated, gin.H{"success": true, "message": "User created", "user": adminUserResponse(user, 0)})
+}
+
+// AdminDeleteUserHandler deletes a user along with their networks and sessions.
+// DELETE /api/admin/users/:id
+func AdminDeleteUserHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+	if user.ID == admin.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "You cannot delete your own account"})
+		return
+	}
+
+	if err := users.DeleteUser(user.Username); err != nil {
+		log.Printf("[Admin] Failed to delete user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to delete user"})
+		return
+	}
+
+	log.Printf("[Admin] %s deleted user %s", admin.Username, user.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User deleted"})
+}
+
+// AdminSuspendUserHandler suspends a user, logging out their devices and
+// ending their IRC connections.
+// POST /api/admin/users/:id/suspend
+func AdminSuspendUserHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+	if user.ID == admin.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "You cannot suspend your own account"})
+		return
+	}
+
+	if err := users.SuspendUser(user.Username); err != nil {
+		log.Printf("[Admin] Failed to suspend user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to suspend user"})
+		return
+	}
+
+	log.Printf("[Admin] %s suspended user %s", admin.Username, user.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User suspended"})
+}
+
+// AdminUnsuspendUserHandler lifts a user's suspension. Their networks
+// reconnect when they next log in.
+// POST /api/admin/users/:id/unsuspend
+func AdminUnsuspendUserHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	if err := users.UnsuspendUser(user.Username); err != nil {
+		log.Printf("[Admin] Failed to unsuspend user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to unsuspend user"})
+		return
+	}
+
+	log.Printf("[Admin] %s unsuspended user %s", admin.Username, user.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User unsuspended"})
+}
+
+// AdminSetRoleHandler grants or removes a user's admin role.
+// POST /api/admin/users/:id/admin
+func AdminSetRoleHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		IsAdmin bool `json:"is_admin"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	if user.ID == admin.ID && !req.IsAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "You cannot remove your own admin role"})
+		return
+	}
+
+	if err := users.SetAdmin(user.Username, req.IsAdmin); err != nil {
+		log.Printf("[Admin] Failed to update admin role of %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to update admin role"})
+		return
+	}
+
+	log.Printf("[Admin] %s set admin role of %s to %t", admin.Username, user.Username, req.IsAdmin)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Admin role updated"})
+}
+
+// AdminResetPasswordHandler sets a user's password and logs out their devices.
+// POST /api/admin/users/:id/password
+func AdminResetPasswordHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Password required"})
+		return
+	}
+
+	if err := users.ResetPassword(user.Username, req.Password); err != nil {
+		if errors.Is(err, users.ErrPasswordPolicy) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": policyMessage(err)})
+			return
+		}
+		if errors.Is(err, users.ErrDirectoryAccount) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "The user's password is managed by the directory"})
+			return
+		}
+		log.Printf("[Admin] Failed to reset password of %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to reset password"})
+		return
+	}
+	closeLoginWebSockets(user.ID, func(int) bool { return true })
+	if sess, found := session.GetSessionByUserID(user.ID); found {
+		sess.Password = req.Password
+	}
+
+	log.Printf("[Admin] %s reset the password of %s", admin.Username, user.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Password reset and sessions revoked"})
+}
+
+// AdminLinkAccountHandler hands a local account to the configured directory,
+// so the directory account can log in as it. With OIDC the account is named
+// by its "sub" claim, since usernames there aren't unique; with LDAP it is
+// the directory account of the same username.
+// POST /api/admin/users/:id/link
+func AdminLinkAccountHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Subject string `json:"subject"` // The OIDC account's "sub" claim
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	if !users.ExternalAuth() {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "No directory is configured"})
+		return
+	}
+	subject := ""
+	if provider, isOIDC := auth.OIDCProvider(); isOIDC {
+		req.Subject = strings.TrimSpace(req.Subject)
+		if req.Subject == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Subject required"})
+			return
+		}
+		subject = provider.Subject(req.Subject)
+	}
+
+	if err := users.LinkDirectoryAccount(user.ID, subject); err != nil {
+		if errors.Is(err, users.ErrDirectoryAccount) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "The user is already managed by the directory"})
+			return
+		}
+		if errors.Is(err, users.ErrAccountConflict) {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "message": "That directory account is already linked to another user"})
+			return
+		}
+		log.Printf("[Admin] Failed to link %s to the directory: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to link account"})
+		return
+	}
+
+	log.Printf("[Admin] %s linked %s to the %s directory", admin.Username, user.Username, users.AuthBackend())
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Account linked"})
+}
+
+// AdminDisconnectUserHandler ends a user's live session: their WebSockets
+// close and their IRC connections quit. Their login tokens stay valid, so the
+// networks reconnect when a client next connects.
+// POST /api/admin/users/:id/disconnect
+func AdminDisconnectUserHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	if _, found := session.GetSessionByUserID(user.ID); !found {
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "User has no live session"})
+		return
+	}
+	session.RemoveSession(user.ID)
+
+	log.Printf("[Admin] %s force-disconnected user %s", admin.Username, user.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User disconnected"})
+}
+
+// AdminLoginAttemptsHandler returns the login audit log, newest first.
+// Optional query parameters: username, failed=true and limit.
+// GET /api/admin/login-attempts
+func AdminLoginAttemptsHandler(c *gin.Context) {
+	if _, ok := requireAdmin(c); !ok {
+		return
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+	if limit > maxLoginAttemptsListed {
+		limit = maxLoginAttemptsListed
+	}
+
+	attempts, err := users.ListLoginAttempts(c.Query("username"), c.Query("failed") == "true", limit)
+	if err != nil {
+		log.Printf("[Admin] Failed to list login attempts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list login attempts"})
+		return
+	}
+	if attempts == nil {
+		attempts = []*users.LoginAttempt{}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "attempts": attempts})
+}
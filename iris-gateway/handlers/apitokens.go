@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+const (
+	// API tokens a user may have at once.
+	maxAPITokens = 50
+	// Longest name of an API token.
+	maxAPITokenNameLength = 64
+)
+
+// authorizeRequest returns the user session for the request's login token or
+// for an API token with scope, which may be narrowed to some networks and
+// targets; use allowTarget to check those. An empty scope accepts any API
+// token. The API token is nil for login tokens, which may do anything. It
+// responds with an error and returns false if the request isn't allowed.
+func authorizeRequest(c *gin.Context, scope string) (*session.UserSession, *users.APIToken, bool) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return nil, nil, false
+	}
+	ip := c.ClientIP()
+	if !strings.HasPrefix(token, users.APITokenPrefix) {
+		sess, found := lookupSession(token, ip)
+		if !found {
+			c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+			return nil, nil, false
+		}
+		return sess, nil, true
+	}
+
+	apiToken, err := users.GetAPIToken(token)
+	if err != nil {
+		if !errors.Is(err, users.ErrAPITokenNotFound) {
+			log.Printf("Failed to look up API token: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid API token"})
+		return nil, nil, false
+	}
+	if scope != "" && !apiToken.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": fmt.Sprintf("API token lacks the %s scope", scope)})
+		return nil, nil, false
+	}
+
+	if apiToken.LastUsedAt == nil || time.Since(*apiToken.LastUsedAt) > sessionTouchInterval || apiToken.LastIP != ip {
+		if err := users.TouchAPIToken(apiToken.ID, ip); err != nil {
+			log.Printf("Failed to record use of API token %d: %v", apiToken.ID, err)
+		}
+	}
+	return liveSession(apiToken.UserID, apiToken.Username), apiToken, true
+}
+
+// allowTarget checks that an API token grants scope for a network and target,
+// and responds with an error if it doesn't. Login tokens are always allowed.
+func allowTarget(c *gin.Context, apiToken *users.APIToken, scope string, networkID int, target string) bool {
+	if apiToken == nil || apiToken.Allows(scope, networkID, target) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"success": false, "message": fmt.Sprintf("API token's %s scope doesn't cover this network or target", scope)})
+	return false
+}
+
+// ListAPITokensHandler lists the user's API tokens. The tokens themselves are
+// never shown again after creation.
+// GET /api/tokens
+func ListAPITokensHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	tokens, err := users.ListAPITokens(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to list API tokens for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list API tokens"})
+		return
+	}
+	if tokens == nil {
+		tokens = []*users.APIToken{}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "tokens": tokens})
+}
+
+// CreateAPITokenHandler creates an API token for scripts and bots. The token
+// is only shown in this response. API tokens can't create other tokens.
+// POST /api/tokens
+func CreateAPITokenHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn string   `json:"expires_in"` // Duration such as "720h"; empty for a token that doesn't expire
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Name required, at most %d characters", maxAPITokenNameLength)})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "At least one scope required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		_, networkID, _, err := users.ParseScope(scope)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+			return
+		}
+		if networkID != 0 {
+			if _, err := users.GetSingleUserNetwork(sess.UserID, networkID); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Scope %s refers to an unknown network", scope)})
+				return
+			}
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid expires_in duration"})
+			return
+		}
+		expires := time.Now().Add(d)
+		expiresAt = &expires
+	}
+
+	count, err := users.CountAPITokens(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to count API tokens for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create API token"})
+		return
+	}
+	if count >= maxAPITokens {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": fmt.Sprintf("You can have at most %d API tokens", maxAPITokens)})
+		return
+	}
+
+	secret, apiToken, err := users.CreateAPIToken(sess.UserID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		log.Printf("Failed to create API token for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create API token"})
+		return
+	}
+
+	log.Printf("User %s created API token %d (%s) with scopes %v", sess.Username, apiToken.ID, apiToken.Name, apiToken.Scopes)
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"message":   "API token created. Store it now; it won't be shown again.",
+		"token":     secret,
+		"api_token": apiToken,
+	})
+}
+
+// RevokeAPITokenHandler deletes one of the user's API tokens.
+// DELETE /api/tokens/:id
+func RevokeAPITokenHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	tokenID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid token ID"})
+		return
+	}
+
+	if err := users.RevokeAPIToken(sess.UserID, tokenID); err != nil {
+		if errors.Is(err, users.ErrAPITokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "API token not found"})
+			return
+		}
+		log.Printf("Failed to revoke API token %d for user %s: %v", tokenID, sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to revoke API token"})
+		return
+	}
+
+	log.Printf("User %s revoked API token %d", sess.Username, tokenID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "API token revoked"})
+}
@@ -11,7 +11,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"iris-gateway/config"
-	"iris-gateway/session"
+	"iris-gateway/users"
 )
 
 // UploadAttachmentHandler handles image uploads
@@ -22,7 +22,7 @@ func UploadAttachmentHandler(c *gin.Context) {
 		return
 	}
 
-	_, found := session.GetSession(token)
+	sess, found := lookupSession(token, c.ClientIP())
 	if !found {
 		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
 		return
@@ -59,19 +59,42 @@ func UploadAttachmentHandler(c *gin.Context) {
 	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
 	filePath := filepath.Join(config.Cfg.ImageBaseDir, filename)
 
+	// Only attachments that haven't expired count against the storage quota.
+	// The attachment is recorded under the user's quota lock, before the file
+	// is saved, so parallel uploads can't all fit in the same free space.
+	duration := attachmentStorageDuration()
+	unlockQuota := lockUserQuota(sess.UserID)
+	if limit := users.GetQuota(sess.UserID).AttachmentBytes; limit > 0 {
+		used, err := users.AttachmentUsage(sess.UserID, duration)
+		if err != nil {
+			unlockQuota()
+			log.Printf("Failed to read attachment usage for user %s: %v", sess.Username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to check attachment storage"})
+			return
+		}
+		if used+file.Size > limit {
+			unlockQuota()
+			respondQuotaExceeded(c, "attachment_bytes", limit, fmt.Sprintf("Attachment storage limit reached: %d of %d bytes used.", used, limit))
+			return
+		}
+	}
+	err = users.RecordAttachment(sess.UserID, filename, file.Size)
+	unlockQuota()
+	if err != nil {
+		log.Printf("Failed to record attachment for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to save file"})
+		return
+	}
+
 	// Save the uploaded file
 	if err := c.SaveUploadedFile(file, filePath); err != nil {
+		if err := users.DeleteAttachment(filename); err != nil {
+			log.Printf("Failed to forget attachment %s: %v", filename, err)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": fmt.Sprintf("Failed to save file: %v", err)})
 		return
 	}
 
-	// Parse the image storage duration from config
-	duration, err := time.ParseDuration(config.Cfg.ImageStorageDuration)
-	if err != nil {
-		log.Printf("Invalid image storage duration '%s', defaulting to 12h", config.Cfg.ImageStorageDuration)
-		duration = 12 * time.Hour
-	}
-
 	// Schedule cleanup after configured duration
 	time.AfterFunc(duration, func() {
 		if err := os.Remove(filePath); err != nil {
@@ -79,6 +102,9 @@ func UploadAttachmentHandler(c *gin.Context) {
 		} else {
 			log.Printf("Cleaned up attachment %s", filePath)
 		}
+		if err := users.DeleteAttachment(filename); err != nil {
+			log.Printf("Failed to forget attachment %s: %v", filename, err)
+		}
 	})
 
 	// Return the URL to access the image
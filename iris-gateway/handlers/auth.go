@@ -1,27 +1,32 @@
 package handlers
 
 import (
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"iris-gateway/session"
 	"iris-gateway/users"
 	"iris-gateway/irc" // Import irc for connection establishment
-	"iris-gateway/events" // Import events for broadcasting connection status
 )
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"` // Shown in the list of devices, optional
+	ClientVersion string `json:"client_version"` // Shown in the list of devices, optional
 }
 
 type LoginResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 	Token   string `json:"token,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"` // Extended whenever the token is used
 	// Consider adding initial network list here, or make it a separate API call
 }
 
@@ -38,85 +43,121 @@ func LoginHandler(c *gin.Context) {
 		return
 	}
 
-	// Step 1: Authenticate the user against the SQLite database
+	// Refuse before running bcrypt if the username or IP has failed too often
+	ip := c.ClientIP()
+	wait, release := beginLoginAttempt(req.Username, ip)
+	defer release()
+	if wait > 0 {
+		log.Printf("Login for user '%s' from %s refused: too many failed attempts", req.Username, ip)
+		recordLoginFailure(req.Username, ip, loginReasonLimited)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "message": "Too many failed login attempts. Try again later."})
+		return
+	}
+
+	// Step 1: Authenticate the user against the configured directory
 	user, err := users.AuthenticateUser(req.Username, req.Password)
+	if errors.Is(err, users.ErrPasswordLoginUnsupported) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Log in with single sign-on", "login_url": "/api/login/oidc"})
+		return
+	}
+	if err != nil && !errors.Is(err, users.ErrUnknownAccount) && !errors.Is(err, users.ErrInvalidCredentials) && !errors.Is(err, users.ErrAccountConflict) {
+		// The directory is unreachable; that is not the user's failure
+		log.Printf("Authentication for user '%s' could not be checked: %v", req.Username, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "Login is unavailable right now. Try again later."})
+		return
+	}
 	if err != nil {
-		log.Printf("Authentication failed for user '%s': %v", req.Username, err)
+		log.Printf("Authentication failed for user '%s' from %s", req.Username, ip)
+		recordLoginFailure(req.Username, ip, loginReasonInvalid)
 		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid username or password"})
 		return
 	}
 	if user.IsSuspended {
 		log.Printf("Login attempt for suspended user '%s'", req.Username)
+		recordLoginFailure(req.Username, ip, loginReasonSuspended)
 		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Account is suspended"})
 		return
 	}
 
-	// Check for existing session and re-attach device
-	if existingToken, found := session.FindSessionTokenByUsername(req.Username); found {
-		log.Printf("User %s successfully re-authenticated. Attaching new device to existing session.", req.Username)
-		existingSession, _ := session.GetSession(existingToken)
-		newToken := uuid.New().String()
-		session.AddSession(newToken, existingSession) // Add new token pointing to existing session
-
-		c.JSON(http.StatusOK, LoginResponse{
-			Success: true,
-			Message: "Login successful, new device attached to session",
-			Token:   newToken,
+	// Accounts with two-factor authentication get a challenge instead of a
+	// token, redeemed with a code at /api/login/2fa
+	twoFactor, err := users.GetTwoFactor(user.ID)
+	if err != nil {
+		log.Printf("Failed to read two-factor state for user %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log in"})
+		return
+	}
+	if twoFactor.Enabled {
+		challenge, err := createLoginChallenge(user, req)
+		if err != nil {
+			log.Printf("Failed to create login challenge for user %s: %v", req.Username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log in"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success":             true,
+			"message":             "Two-factor code required",
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int(loginChallengeLifetime.Seconds()),
 		})
 		return
 	}
 
-	// First-time login for this session
-	log.Printf("No existing session found for %s. Creating new session.", req.Username)
-
-	userSession := session.NewUserSession(req.Username)
-	userSession.Password = req.Password // Store password for potential SASL reconnect (or fetch from DB)
-	userSession.SetUserID(user.ID)      // Set the UserID in the session
+	completeLogin(c, user, req)
+}
 
-	// Load user's IRC networks from the database
-	userNetworks, err := users.GetUserNetworks(user.ID)
+// completeLogin attaches a new device to the user's session once every
+// factor has been checked, and responds with its token.
+func completeLogin(c *gin.Context, user *users.User, req LoginRequest) {
+	token, stored, message, err := issueLoginToken(c, user, req)
 	if err != nil {
-		log.Printf("Error loading IRC networks for user %s: %v", req.Username, err)
-		// Don't fail login, but user won't have networks automatically
-	}
-
-	// Attempt to connect to networks marked for auto-reconnect
-	for _, netConfig := range userNetworks {
-		userSession.Networks[netConfig.ID] = netConfig // Add to session map
-		if netConfig.AutoReconnect {
-			go func(nc *session.UserNetwork) {
-				log.Printf("Attempting auto-reconnect for user %s, network %s", req.Username, nc.NetworkName)
-				ircClient, connErr := irc.EstablishIRCConnection(userSession, nc, c.ClientIP()) // Pass actual client IP
-				if connErr != nil {
-					log.Printf("Auto-reconnect failed for user %s, network %s: %v", req.Username, nc.NetworkName, connErr)
-					// Broadcast connection failure to the client
-					userSession.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
-						"network_id":   nc.ID,
-						"network_name": nc.NetworkName,
-						"status":       "failed",
-						"reason":       connErr.Error(),
-					})
-					return
-				}
-				nc.Mutex.Lock()
-				nc.IRC = ircClient.Connection // Store the underlying ircevent connection
-				nc.IsConnected = true
-				nc.Mutex.Unlock()
-				log.Printf("Auto-reconnect successful for user %s, network %s", req.Username, nc.NetworkName)
-			}(netConfig)
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create session"})
+		return
 	}
 
-	token := uuid.New().String()
-	session.AddSession(token, userSession)
-
 	c.JSON(http.StatusOK, LoginResponse{
-		Success: true,
-		Message: "Login successful",
-		Token:   token,
+		Success:   true,
+		Message:   message,
+		Token:     token,
+		ExpiresAt: stored.ExpiresAt.UTC().Format(time.RFC3339),
 	})
 }
 
+// issueLoginToken records a successful login, starts the user's session if
+// it isn't running, and creates a token for the new device.
+func issueLoginToken(c *gin.Context, user *users.User, req LoginRequest) (string, *users.Session, string, error) {
+	ip := c.ClientIP()
+	recordLoginSuccess(user.Username, ip)
+
+	// Attach the device to the user's session. The bouncer normally started it
+	// at boot; otherwise this is the first login since the user was created or
+	// unsuspended, and their networks are loaded now.
+	userSession, created := session.GetOrCreateUserSession(user.ID, user.Username)
+	message := "Login successful, new device attached to session"
+	if created {
+		log.Printf("No existing session found for %s. Creating new session.", user.Username)
+		userSession.Password = req.Password // Store password for potential SASL reconnect (or fetch from DB)
+		irc.LoadNetworks(userSession)
+		message = "Login successful"
+	} else {
+		log.Printf("User %s successfully re-authenticated. Attaching new device to existing session.", user.Username)
+	}
+
+	token, stored, err := users.CreateSession(users.Session{
+		UserID:        user.ID,
+		DeviceName:    strings.TrimSpace(req.DeviceName),
+		ClientVersion: strings.TrimSpace(req.ClientVersion),
+		LastIP:        ip,
+	}, sessionLifetime())
+	if err != nil {
+		log.Printf("Failed to create session for user %s: %v", user.Username, err)
+		return "", nil, "", err
+	}
+	return token, stored, message, nil
+}
+
 // ValidateSessionHandler remains largely the same.
 func ValidateSessionHandler(c *gin.Context) {
 	token, ok := getToken(c)
@@ -125,7 +166,7 @@ func ValidateSessionHandler(c *gin.Context) {
 		return
 	}
 
-	_, found := session.GetSession(token)
+	_, found := lookupSession(token, c.ClientIP())
 	if !found {
 		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
 		return
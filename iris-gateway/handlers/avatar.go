@@ -9,7 +9,6 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"iris-gateway/config"
-	"iris-gateway/session"
 )
 
 // UploadAvatarHandler handles the upload of user avatars.
@@ -23,7 +22,7 @@ func UploadAvatarHandler(c *gin.Context) {
         return
     }
 
-    sess, found := session.GetSession(token)
+    sess, found := lookupSession(token, c.ClientIP())
     if !found {
         c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
         return
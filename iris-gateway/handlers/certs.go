@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/irc"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// How long a generated client certificate is valid for.
+const clientCertValidity = 10 * 365 * 24 * time.Hour
+
+// TrustServerCertRequest names the server certificate fingerprint to pin and
+// the server, by its position in the network's server list, to pin it for.
+type TrustServerCertRequest struct {
+	Fingerprint string `json:"fingerprint" binding:"required"`
+	ServerIndex int    `json:"server_index"` // As in the tls_certificate_changed event; 0 for the first server
+}
+
+// UploadClientCertRequest carries a PEM certificate and its private key.
+type UploadClientCertRequest struct {
+	Certificate string `json:"certificate" binding:"required"`
+	PrivateKey  string `json:"private_key" binding:"required"`
+}
+
+// certNetworkFromRequest resolves the session and the network named by the
+// :id parameter, writing an error response if either is missing.
+func certNetworkFromRequest(c *gin.Context) (*session.UserSession, *session.UserNetwork, bool) {
+	networkID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid network ID"})
+		return nil, nil, false
+	}
+
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return nil, nil, false
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return nil, nil, false
+	}
+
+	netConfig, err := users.GetSingleUserNetwork(sess.UserID, networkID)
+	if err != nil {
+		log.Printf("Failed to get network %d for user %s: %v", networkID, sess.Username, err)
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Network not found or you don't own it"})
+		return nil, nil, false
+	}
+	return sess, netConfig, true
+}
+
+// saveClientCert stores a certificate and key and applies them to the live
+// session, so the next connection uses them.
+func saveClientCert(c *gin.Context, sess *session.UserSession, netConfig *session.UserNetwork, certPEM, keyPEM string) bool {
+	if err := users.SetNetworkClientCert(sess.UserID, netConfig.ID, certPEM, keyPEM); err != nil {
+		log.Printf("Failed to save client certificate for network %d of user %s: %v", netConfig.ID, sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to save client certificate"})
+		return false
+	}
+	if liveNet, ok := sess.GetNetwork(netConfig.ID); ok {
+		liveNet.Mutex.Lock()
+		liveNet.ClientCert = certPEM
+		liveNet.ClientKey = keyPEM
+		liveNet.Mutex.Unlock()
+	}
+	return true
+}
+
+// clientCertInfo describes a PEM certificate for clients, including the
+// fingerprints used to register it with services (e.g. NickServ CERT ADD).
+func clientCertInfo(certPEM string) (gin.H, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	sha256Sum := sha256.Sum256(cert.Raw)
+	sha512Sum := sha512.Sum512(cert.Raw)
+	return gin.H{
+		"subject":            cert.Subject.String(),
+		"not_before":         cert.NotBefore.UTC().Format(time.RFC3339),
+		"not_after":          cert.NotAfter.UTC().Format(time.RFC3339),
+		"sha256_fingerprint": hex.EncodeToString(sha256Sum[:]),
+		"sha512_fingerprint": hex.EncodeToString(sha512Sum[:]),
+		"certificate":        certPEM,
+	}, nil
+}
+
+// generateClientCert creates a self-signed ECDSA P-256 client certificate.
+func generateClientCert(commonName string) (certPEM, keyPEM string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(clientCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	return certPEM, keyPEM, nil
+}
+
+// GetClientCertHandler returns the client certificate of a network.
+// GET /api/irc/networks/:id/cert
+func GetClientCertHandler(c *gin.Context) {
+	_, netConfig, ok := certNetworkFromRequest(c)
+	if !ok {
+		return
+	}
+	if netConfig.ClientCert == "" {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "No client certificate for this network"})
+		return
+	}
+
+	info, err := clientCertInfo(netConfig.ClientCert)
+	if err != nil {
+		log.Printf("Stored client certificate for network %d is invalid: %v", netConfig.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Stored client certificate is invalid"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "client_cert": info})
+}
+
+// GenerateClientCertHandler creates a new client certificate for a network,
+// replacing any existing one.
+// POST /api/irc/networks/:id/cert/generate
+func GenerateClientCertHandler(c *gin.Context) {
+	sess, netConfig, ok := certNetworkFromRequest(c)
+	if !ok {
+		return
+	}
+
+	certPEM, keyPEM, err := generateClientCert(netConfig.Nickname)
+	if err != nil {
+		log.Printf("Failed to generate client certificate for network %d: %v", netConfig.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to generate client certificate"})
+		return
+	}
+	if !saveClientCert(c, sess, netConfig, certPEM, keyPEM) {
+		return
+	}
+
+	info, _ := clientCertInfo(certPEM)
+	log.Printf("User %s generated a client certificate for network %s (ID: %d)", sess.Username, netConfig.NetworkName, netConfig.ID)
+	c.JSON(http.StatusCreated, gin.H{
+		"success":     true,
+		"message":     "Client certificate generated. Reconnect to use it.",
+		"client_cert": info,
+	})
+}
+
+// UploadClientCertHandler stores a user-supplied client certificate and key
+// for a network, replacing any existing one.
+// PUT /api/irc/networks/:id/cert
+func UploadClientCertHandler(c *gin.Context) {
+	sess, netConfig, ok := certNetworkFromRequest(c)
+	if !ok {
+		return
+	}
+
+	var req UploadClientCertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Invalid request: %v", err)})
+		return
+	}
+	if _, err := tls.X509KeyPair([]byte(req.Certificate), []byte(req.PrivateKey)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Invalid certificate or key: %v", err)})
+		return
+	}
+	info, err := clientCertInfo(req.Certificate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Invalid certificate: %v", err)})
+		return
+	}
+	if !saveClientCert(c, sess, netConfig, req.Certificate, req.PrivateKey) {
+		return
+	}
+
+	log.Printf("User %s uploaded a client certificate for network %s (ID: %d)", sess.Username, netConfig.NetworkName, netConfig.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"message":     "Client certificate saved. Reconnect to use it.",
+		"client_cert": info,
+	})
+}
+
+// DeleteClientCertHandler removes the client certificate of a network.
+// DELETE /api/irc/networks/:id/cert
+func DeleteClientCertHandler(c *gin.Context) {
+	sess, netConfig, ok := certNetworkFromRequest(c)
+	if !ok {
+		return
+	}
+	if !saveClientCert(c, sess, netConfig, "", "") {
+		return
+	}
+
+	log.Printf("User %s removed the client certificate for network %s (ID: %d)", sess.Username, netConfig.NetworkName, netConfig.ID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Client certificate removed"})
+}
+
+// TrustServerCertHandler pins a network to a new server certificate, for
+// example after a tls_certificate_changed event for a legitimately renewed one.
+// POST /api/irc/networks/:id/tls/trust
+func TrustServerCertHandler(c *gin.Context) {
+	sess, netConfig, ok := certNetworkFromRequest(c)
+	if !ok {
+		return
+	}
+
+	var req TrustServerCertRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Invalid request: %v", err)})
+		return
+	}
+	fingerprint := irc.NormalizeFingerprint(req.Fingerprint)
+	if !isSHA256Fingerprint(fingerprint) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Fingerprint must be a SHA-256 fingerprint in hex"})
+		return
+	}
+	if netConfig.TLSVerifyMode != irc.TLSPin {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Network does not use certificate pinning"})
+		return
+	}
+	servers := netConfig.ServerList()
+	if req.ServerIndex < 0 || req.ServerIndex >= len(servers) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Server index must be between 0 and %d", len(servers)-1)})
+		return
+	}
+
+	if err := users.SetNetworkServerPinnedFingerprint(netConfig.ID, req.ServerIndex, fingerprint); err != nil {
+		log.Printf("Failed to pin certificate for network %d of user %s: %v", netConfig.ID, sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to save pinned fingerprint"})
+		return
+	}
+	if liveNet, ok := sess.GetNetwork(netConfig.ID); ok {
+		liveNet.SetPinnedFingerprint(req.ServerIndex, fingerprint)
+	}
+
+	log.Printf("User %s pinned server %s of network %s (ID: %d) to certificate %s", sess.Username, servers[req.ServerIndex].Hostname, netConfig.NetworkName, netConfig.ID, fingerprint)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Server certificate trusted. Reconnect to use it."})
+}
@@ -6,14 +6,20 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"iris-gateway/irc"
 	"iris-gateway/session"
+	"iris-gateway/users"
 )
 
 type ChannelRequest struct {
 	NetworkID int    `json:"network_id"`
 	Channel   string `json:"channel"`
+	Key       string `json:"key,omitempty"` // Channel key for +k channels (join only)
 }
 
+// How long JoinChannelHandler waits for the server to confirm or reject a JOIN.
+const joinConfirmTimeout = 5 * time.Second
+
 // POST /api/channels/join
 func JoinChannelHandler(c *gin.Context) {
 	var req ChannelRequest
@@ -22,31 +28,36 @@ func JoinChannelHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, req.NetworkID, "") {
 		return
 	}
 
 	netConfig, found := sess.GetNetwork(req.NetworkID)
-	if !found || netConfig.IRC == nil || !netConfig.IsConnected {
+	if !found || netConfig.IRC == nil || !netConfig.IsConnected() {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "IRC network not connected or not found"})
 		return
 	}
 
-	// Add channel to the session's network configuration state immediately
-	netConfig.AddChannelToNetwork(req.Channel)
+	if limit := users.GetQuota(sess.UserID).MaxChannels; limit > 0 && joinedChannelCount(sess) >= limit {
+		respondQuotaExceeded(c, "max_channels", limit, fmt.Sprintf("Channel limit reached: you can be in at most %d channels.", limit))
+		return
+	}
 
-	// Send JOIN command to the specific IRC connection
-	netConfig.IRC.Join(req.Channel)
+	// Send JOIN command to the specific IRC connection. The channel is only added
+	// to the network state once the server confirms the JOIN.
+	result := irc.JoinChannel(netConfig.IRC, netConfig.ID, req.Channel, req.Key)
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Join command sent for %s on network %s", req.Channel, netConfig.NetworkName)})
+	select {
+	case err := <-result:
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "message": fmt.Sprintf("Could not join %s on network %s: %v", req.Channel, netConfig.NetworkName, err)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Joined %s on network %s", req.Channel, netConfig.NetworkName)})
+	case <-time.After(joinConfirmTimeout):
+		c.JSON(http.StatusAccepted, gin.H{"success": true, "pending": true, "message": fmt.Sprintf("Join command sent for %s on network %s, waiting for the server", req.Channel, netConfig.NetworkName)})
+	}
 }
 
 // POST /api/channels/part
@@ -57,24 +68,18 @@ func PartChannelHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, req.NetworkID, "") {
 		return
 	}
 
 	netConfig, found := sess.GetNetwork(req.NetworkID)
-	if !found || netConfig.IRC == nil || !netConfig.IsConnected {
+	if !found || netConfig.IRC == nil || !netConfig.IsConnected() {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "IRC network not connected or not found"})
 		return
 	}
 
+	irc.TrackCommand(netConfig.ID, "PART", req.Channel)
 	netConfig.IRC.Part(req.Channel)
 
 	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Part command sent for %s on network %s", req.Channel, netConfig.NetworkName)})
@@ -83,15 +88,8 @@ func PartChannelHandler(c *gin.Context) {
 // GET /api/channels
 // This will now return channels for ALL connected networks for the user.
 func ListChannelsHandler(c *gin.Context) {
-	token, ok := getToken(c)
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeHistoryRead)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
 		return
 	}
 
@@ -113,6 +111,11 @@ func ListChannelsHandler(c *gin.Context) {
 		netConfig.Mutex.RLock() // Lock the specific network config
 		for _, ch := range netConfig.Channels {
 			ch.Mutex.RLock() // Lock the specific channel state
+			if apiToken != nil && !apiToken.Allows(users.ScopeHistoryRead, netConfig.ID, ch.Name) {
+				// Only the channels an API token may read
+				ch.Mutex.RUnlock()
+				continue
+			}
 			allChannels = append(allChannels, channelInfo{
 				NetworkID:   netConfig.ID,
 				NetworkName: netConfig.NetworkName,
@@ -9,7 +9,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"iris-gateway/irc" // Use the new irc/history module
-	"iris-gateway/session"
+	"iris-gateway/users"
 )
 
 // ChannelHistoryHandler now expects network ID as part of the path
@@ -45,17 +45,8 @@ func ChannelHistoryHandler(c *gin.Context) {
 		}
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		log.Printf("[HISTORY] Missing token for channel %s, network %d", channel, networkID)
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		log.Printf("[HISTORY] Invalid session for token")
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeHistoryRead)
+	if !ok || !allowTarget(c, apiToken, users.ScopeHistoryRead, networkID, channel) {
 		return
 	}
 
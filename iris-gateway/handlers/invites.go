@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/config"
+	"iris-gateway/users"
+)
+
+const (
+	// How long an invite lasts when the admin doesn't say.
+	defaultInviteLifetime = 7 * 24 * time.Hour
+	// Most uses a single invite may have.
+	maxInviteUses = 100
+)
+
+// Audit log reason for a registration with a bad invite code.
+const loginReasonInvalidInvite = "invalid_invite"
+
+// Usernames double as IRC-friendly display names, so keep them simple.
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// AdminCreateInviteHandler creates an invite code. The code is only shown in
+// this response.
+// POST /api/admin/invites
+func AdminCreateInviteHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		MaxUses   int    `json:"max_uses"`   // Defaults to 1
+		ExpiresIn string `json:"expires_in"` // Duration such as "72h"; defaults to 7 days
+		Note      string `json:"note"`       // Who the invite is for, for the audit trail
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 1 || req.MaxUses > maxInviteUses {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "max_uses must be between 1 and " + strconv.Itoa(maxInviteUses)})
+		return
+	}
+	lifetime := defaultInviteLifetime
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid expires_in duration"})
+			return
+		}
+		lifetime = d
+	}
+
+	code, invite, err := users.CreateInvite(admin.ID, strings.TrimSpace(req.Note), req.MaxUses, time.Now().Add(lifetime))
+	if err != nil {
+		log.Printf("[Admin] Failed to create invite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create invite"})
+		return
+	}
+
+	log.Printf("[Admin] %s created invite %d (%d uses, expires %s)", admin.Username, invite.ID, invite.MaxUses, invite.ExpiresAt.Format(time.RFC3339))
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"message": "Invite created. The code is only shown once.",
+		"code":    code,
+		"invite":  invite,
+	})
+}
+
+// AdminListInvitesHandler lists every invite with the accounts registered
+// with it.
+// GET /api/admin/invites
+func AdminListInvitesHandler(c *gin.Context) {
+	if _, ok := requireAdmin(c); !ok {
+		return
+	}
+
+	invites, err := users.ListInvites()
+	if err != nil {
+		log.Printf("[Admin] Failed to list invites: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list invites"})
+		return
+	}
+	uses, err := users.ListInviteUses()
+	if err != nil {
+		log.Printf("[Admin] Failed to list invite uses: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list invites"})
+		return
+	}
+
+	usesByInvite := make(map[int][]*users.InviteUse)
+	for _, use := range uses {
+		usesByInvite[use.InviteID] = append(usesByInvite[use.InviteID], use)
+	}
+	list := make([]gin.H, 0, len(invites))
+	for _, invite := range invites {
+		registrations := usesByInvite[invite.ID]
+		if registrations == nil {
+			registrations = []*users.InviteUse{}
+		}
+		list = append(list, gin.H{"invite": invite, "registrations": registrations})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "invites": list})
+}
+
+// AdminRevokeInviteHandler stops an invite from being used again.
+// DELETE /api/admin/invites/:id
+func AdminRevokeInviteHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	inviteID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid invite ID"})
+		return
+	}
+
+	if err := users.RevokeInvite(inviteID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Invite not found or already revoked"})
+		return
+	}
+
+	log.Printf("[Admin] %s revoked invite %d", admin.Username, inviteID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Invite revoked"})
+}
+
+// RegisterHandler creates an account with an invite code. It is refused
+// unless registration is enabled in the config.
+// POST /api/register
+func RegisterHandler(c *gin.Context) {
+	if !config.Cfg.RegistrationEnabled || users.ExternalAuth() {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Registration is disabled"})
+		return
+	}
+
+	var req struct {
+		InviteCode string `json:"invite_code"`
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.InviteCode == "" || req.Username == "" || req.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invite code, username and password required"})
+		return
+	}
+	if !validUsername.MatchString(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Username must be 1-32 letters, digits, '_', '.' or '-'"})
+		return
+	}
+
+	// Guessing invite codes counts against the IP's limit for guessing
+	// passwords. The username is the guesser's choice, so it isn't limited.
+	ip := c.ClientIP()
+	wait, release := beginIPAttempt(ip)
+	defer release()
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "message": "Too many failed attempts. Try again later."})
+		return
+	}
+
+	user, err := users.RegisterWithInvite(req.InviteCode, req.Username, req.Password, ip)
+	switch {
+	case err == nil:
+	case errors.Is(err, users.ErrInviteInvalid):
+		log.Printf("Registration from %s refused: invalid invite code", ip)
+		recordIPFailure(req.Username, ip, loginReasonInvalidInvite)
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Invalid or expired invite code"})
+		return
+	case errors.Is(err, users.ErrUsernameTaken):
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": "Username already exists"})
+		return
+	case errors.Is(err, users.ErrPasswordPolicy):
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": policyMessage(err)})
+		return
+	default:
+		log.Printf("Failed to register user %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to register"})
+		return
+	}
+
+	log.Printf("User %s registered with an invite from %s", user.Username, ip)
+	c.JSON(http.StatusCreated, gin.H{"success": true, "message": "Account created. You can now log in."})
+}
@@ -1,25 +1,31 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"errors"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"iris-gateway/session"
 	"iris-gateway/users"
 	"iris-gateway/irc"
-	"iris-gateway/events"
 )
 
 // AddNetworkRequest defines the structure for adding a new IRC network
 type AddNetworkRequest struct {
 	NetworkName     string   `json:"network_name" binding:"required"`
-	Hostname        string   `json:"hostname" binding:"required"`
-	Port            int      `json:"port" binding:"required"`
+	Hostname        string   `json:"hostname"` // Single-server form, used when Servers is empty
+	Port            int      `json:"port"`
 	UseSSL          bool     `json:"use_ssl"`
 	ServerPassword  string   `json:"server_password"`
+	Servers         []session.NetworkServer `json:"servers"` // Servers to try in order
 	AutoReconnect   bool     `json:"auto_reconnect"`
 	Modules         []string `json:"modules"`
 	PerformCommands []string `json:"perform_commands"`
@@ -29,20 +35,275 @@ type AddNetworkRequest struct {
 	Ident           string   `json:"ident"`
 	Realname        string   `json:"realname"`
 	QuitMessage     string   `json:"quit_message"`
+	SASLMechanism   string   `json:"sasl_mechanism"` // "", "PLAIN", "EXTERNAL" or "SCRAM-SHA-256"
+	SASLUsername    string   `json:"sasl_username"`
+	SASLPassword    string   `json:"sasl_password"`
+	TLSVerifyMode   string   `json:"tls_verify_mode"`        // "verify" (default), "pin" or "insecure"
+	TLSPinnedFingerprint string `json:"tls_pinned_fingerprint"` // SHA-256 hex; empty pins the first certificate seen
+	ProxyURL        string   `json:"proxy_url"`      // e.g. "socks5://user@host:1080" or "http://host:3128"
+	ProxyPassword   string   `json:"proxy_password"` // For the proxy URL's user; a password in the URL is moved here
+	BindAddress     string   `json:"bind_address"`   // Local source IP
+	AddressFamily   string   `json:"address_family"` // "", "ipv4" or "ipv6"
+	NickServPassword string  `json:"nickserv_password"` // Sent with IDENTIFY on connect when SASL isn't used
+	// On update, the secrets to overwrite: "server_password" (including the
+	// servers' passwords), "sasl_password", "nickserv_password" and
+	// "proxy_password". Secrets not listed keep their stored value, since they
+	// are never sent to clients.
+	Replace         []string `json:"replace"`
+}
+
+// replaces reports whether an update asks to overwrite a secret.
+func (req *AddNetworkRequest) replaces(secret string) bool {
+	for _, name := range req.Replace {
+		if name == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInitialChannelsQuota writes a quota error and returns false if a network
+// lists more initial channels than the user may join.
+func checkInitialChannelsQuota(c *gin.Context, userID int, req *AddNetworkRequest) bool {
+	limit := users.GetQuota(userID).MaxChannels
+	if limit > 0 && len(req.InitialChannels) > limit {
+		respondQuotaExceeded(c, "max_channels", limit, fmt.Sprintf("Too many initial channels: you can be in at most %d channels.", limit))
+		return false
+	}
+	return true
+}
+
+// keepStoredSecrets fills in the secrets an update doesn't replace from the
+// stored network. Servers keep the password of the stored server with the
+// same hostname and port.
+func keepStoredSecrets(req *AddNetworkRequest, existing *session.UserNetwork) {
+	if !req.replaces("server_password") {
+		req.ServerPassword = existing.ServerPassword
+		for i := range req.Servers {
+			req.Servers[i].Password = ""
+			for _, old := range existing.ServerList() {
+				if strings.EqualFold(old.Hostname, strings.TrimSpace(req.Servers[i].Hostname)) && old.Port == req.Servers[i].Port {
+					req.Servers[i].Password = old.Password
+					break
+				}
+			}
+		}
+	}
+	if !req.replaces("sasl_password") {
+		req.SASLPassword = existing.SASLPassword
+	}
+	if !req.replaces("nickserv_password") {
+		req.NickServPassword = existing.NickServPassword
+	}
+	if !req.replaces("proxy_password") {
+		req.ProxyPassword = existing.ProxyPassword
+	}
+}
+
+// keepServerPins carries the pinned certificate of each stored server over to
+// the server with the same hostname and port, unless the update pins a new
+// one, and makes the first server's pin the network's.
+func keepServerPins(req *AddNetworkRequest, existing *session.UserNetwork) {
+	for i := range req.Servers {
+		if req.Servers[i].PinnedFingerprint != "" {
+			continue
+		}
+		for _, old := range existing.ServerList() {
+			if strings.EqualFold(old.Hostname, req.Servers[i].Hostname) && old.Port == req.Servers[i].Port {
+				req.Servers[i].PinnedFingerprint = old.PinnedFingerprint
+				break
+			}
+		}
+	}
+	req.TLSPinnedFingerprint = req.Servers[0].PinnedFingerprint
+}
+
+// serverListResponse describes a network's servers without their passwords.
+func serverListResponse(netConfig *session.UserNetwork) []gin.H {
+	servers := netConfig.ServerList()
+	response := make([]gin.H, len(servers))
+	for i, server := range servers {
+		response[i] = gin.H{
+			"hostname":           server.Hostname,
+			"port":               server.Port,
+			"use_ssl":            server.UseSSL,
+			"password_set":       server.Password != "",
+			"pinned_fingerprint": server.PinnedFingerprint,
+		}
+	}
+	return response
+}
+
+// validateConnectionSettings checks the proxy, bind address and address family.
+// A password in the proxy URL is moved to ProxyPassword, so the URL can be
+// shown to clients.
+func validateConnectionSettings(req *AddNetworkRequest) error {
+	req.AddressFamily = strings.ToLower(strings.TrimSpace(req.AddressFamily))
+	switch req.AddressFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("unsupported address family %q (supported: ipv4, ipv6)", req.AddressFamily)
+	}
+
+	req.BindAddress = strings.TrimSpace(req.BindAddress)
+	if req.BindAddress != "" {
+		ip := net.ParseIP(req.BindAddress)
+		if ip == nil {
+			return fmt.Errorf("bind address %q is not an IP address", req.BindAddress)
+		}
+		if (req.AddressFamily == "ipv4" && ip.To4() == nil) || (req.AddressFamily == "ipv6" && ip.To4() != nil) {
+			return fmt.Errorf("bind address %s does not match address family %s", req.BindAddress, req.AddressFamily)
+		}
+		if !isLocalAddress(ip) {
+			return fmt.Errorf("bind address %s is not assigned to this host", req.BindAddress)
+		}
+	}
+
+	req.ProxyURL = strings.TrimSpace(req.ProxyURL)
+	if req.ProxyURL != "" {
+		proxyURL, err := url.Parse(req.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h", "http", "https":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q (supported: socks5, socks5h, http, https)", proxyURL.Scheme)
+		}
+		if proxyURL.Hostname() == "" {
+			return fmt.Errorf("proxy URL must include a host")
+		}
+		if strings.HasPrefix(proxyURL.Scheme, "socks5") && proxyURL.Port() == "" {
+			return fmt.Errorf("SOCKS5 proxy URL must include a port")
+		}
+		if proxyURL.User != nil {
+			if password, ok := proxyURL.User.Password(); ok {
+				req.ProxyPassword = password
+				proxyURL.User = url.User(proxyURL.User.Username())
+				req.ProxyURL = proxyURL.String()
+			}
+		}
+	}
+	return nil
+}
+
+// isLocalAddress reports whether ip is assigned to one of the host's interfaces.
+func isLocalAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Failed to list interface addresses: %v", err)
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// insecureTLSWarning is shown in network details when verification is off.
+const insecureTLSWarning = "TLS certificate verification is disabled for this network. The connection can be intercepted."
+
+// validateTLSSettings normalizes the TLS verification mode and pinned fingerprint.
+func validateTLSSettings(req *AddNetworkRequest) error {
+	req.TLSVerifyMode = strings.ToLower(strings.TrimSpace(req.TLSVerifyMode))
+	if req.TLSVerifyMode == "" {
+		req.TLSVerifyMode = irc.TLSVerify
+	}
+	switch req.TLSVerifyMode {
+	case irc.TLSVerify, irc.TLSPin, irc.TLSInsecure:
+	default:
+		return fmt.Errorf("unsupported TLS verify mode %q (supported: verify, pin, insecure)", req.TLSVerifyMode)
+	}
+
+	req.TLSPinnedFingerprint = irc.NormalizeFingerprint(req.TLSPinnedFingerprint)
+	if req.TLSPinnedFingerprint != "" && !isSHA256Fingerprint(req.TLSPinnedFingerprint) {
+		return fmt.Errorf("TLS pinned fingerprint must be a SHA-256 fingerprint in hex")
+	}
+	for i := range req.Servers {
+		server := &req.Servers[i]
+		server.PinnedFingerprint = irc.NormalizeFingerprint(server.PinnedFingerprint)
+		if server.PinnedFingerprint != "" && !isSHA256Fingerprint(server.PinnedFingerprint) {
+			return fmt.Errorf("server %d: pinned fingerprint must be a SHA-256 fingerprint in hex", i+1)
+		}
+	}
+	return nil
+}
+
+func isSHA256Fingerprint(fingerprint string) bool {
+	decoded, err := hex.DecodeString(fingerprint)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// validateServers fills in the server list from the single-server fields when
+// it is empty, checks every server and mirrors the first one into the
+// single-server fields. The network's pinned fingerprint belongs to the first
+// server.
+func validateServers(req *AddNetworkRequest) error {
+	if len(req.Servers) == 0 {
+		if req.Hostname == "" {
+			return fmt.Errorf("at least one server is required")
+		}
+		req.Servers = []session.NetworkServer{{
+			Hostname:          req.Hostname,
+			Port:              req.Port,
+			UseSSL:            req.UseSSL,
+			Password:          req.ServerPassword,
+			PinnedFingerprint: req.TLSPinnedFingerprint,
+		}}
+	}
+	if req.Servers[0].PinnedFingerprint == "" {
+		req.Servers[0].PinnedFingerprint = req.TLSPinnedFingerprint
+	}
+	for i := range req.Servers {
+		server := &req.Servers[i]
+		server.Hostname = strings.TrimSpace(server.Hostname)
+		if server.Hostname == "" {
+			return fmt.Errorf("server %d: hostname is required", i+1)
+		}
+		if server.Port < 1 || server.Port > 65535 {
+			return fmt.Errorf("server %d: port must be between 1 and 65535", i+1)
+		}
+	}
+
+	first := req.Servers[0]
+	req.Hostname = first.Hostname
+	req.Port = first.Port
+	req.UseSSL = first.UseSSL
+	req.ServerPassword = first.Password
+	req.TLSPinnedFingerprint = first.PinnedFingerprint
+	return nil
+}
+
+// validateSASLSettings normalizes the SASL mechanism and checks that the
+// settings it needs are present.
+func validateSASLSettings(req *AddNetworkRequest) error {
+	req.SASLMechanism = strings.ToUpper(strings.TrimSpace(req.SASLMechanism))
+	switch req.SASLMechanism {
+	case "":
+		return nil
+	case "PLAIN", "SCRAM-SHA-256":
+		if req.SASLPassword == "" {
+			return fmt.Errorf("SASL mechanism %s requires a SASL password", req.SASLMechanism)
+		}
+		return nil
+	case "EXTERNAL":
+		// EXTERNAL authenticates with the network's client certificate.
+		if !req.UseSSL {
+			return fmt.Errorf("SASL mechanism EXTERNAL requires SSL")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported SASL mechanism %q (supported: PLAIN, EXTERNAL, SCRAM-SHA-256)", req.SASLMechanism)
 }
 
 // AddNetworkHandler handles adding a new IRC network configuration for a user.
 // POST /api/irc/networks
 func AddNetworkHandler(c *gin.Context) {
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	// Tokens narrowed to some networks can't add new ones
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, 0, "") {
 		return
 	}
 
@@ -56,13 +317,32 @@ func AddNetworkHandler(c *gin.Context) {
 	}
 
 	// Validate required fields
-	if req.NetworkName == "" || req.Hostname == "" || req.Nickname == "" {
+	if req.NetworkName == "" || req.Nickname == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
-			"message": "Network name, hostname and nickname are required",
+			"message": "Network name and nickname are required",
 		})
 		return
 	}
+	if err := validateServers(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if err := validateSASLSettings(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if err := validateTLSSettings(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if err := validateConnectionSettings(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if !checkInitialChannelsQuota(c, sess.UserID, &req) {
+		return
+	}
 
 	// Create a UserNetwork object from the request
 	netConfig := &session.UserNetwork{
@@ -72,6 +352,7 @@ func AddNetworkHandler(c *gin.Context) {
 		Port:            req.Port,
 		UseSSL:          req.UseSSL,
 		ServerPassword:  req.ServerPassword,
+		Servers:         req.Servers,
 		AutoReconnect:   req.AutoReconnect,
 		Modules:         req.Modules,
 		PerformCommands: req.PerformCommands,
@@ -81,11 +362,38 @@ func AddNetworkHandler(c *gin.Context) {
 		Ident:           req.Ident,
 		Realname:        req.Realname,
 		QuitMessage:     req.QuitMessage,
-		IsConnected:     false, // Initially not connected
+		SASLMechanism:   req.SASLMechanism,
+		SASLUsername:    req.SASLUsername,
+		SASLPassword:    req.SASLPassword,
+		NickServPassword: req.NickServPassword,
+		TLSVerifyMode:   req.TLSVerifyMode,
+		TLSPinnedFingerprint: req.TLSPinnedFingerprint,
+		ProxyURL:        req.ProxyURL,
+		ProxyPassword:   req.ProxyPassword,
+		BindAddress:     req.BindAddress,
+		AddressFamily:   req.AddressFamily,
 		Channels:        make(map[string]*session.ChannelState),
 	}
 
+	// The network is counted and added under the user's quota lock
+	unlockQuota := lockUserQuota(sess.UserID)
+	if limit := users.GetQuota(sess.UserID).MaxNetworks; limit > 0 {
+		count, err := users.CountUserNetworks(sess.UserID)
+		if err != nil {
+			log.Printf("Failed to count networks for user %s: %v", sess.Username, err)
+			unlockQuota()
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to add network configuration"})
+			return
+		}
+		if count >= limit {
+			unlockQuota()
+			respondQuotaExceeded(c, "max_networks", limit, fmt.Sprintf("Network limit reached: you can configure at most %d networks.", limit))
+			return
+		}
+	}
+
 	networkID, err := users.AddUserNetwork(sess.UserID, netConfig)
+	unlockQuota()
 	if err != nil {
 		log.Printf("Failed to add network for user %s: %v", sess.Username, err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -104,27 +412,10 @@ func AddNetworkHandler(c *gin.Context) {
 
 	// Optionally attempt to connect immediately if auto-reconnect is true or explicitly requested
 	if req.AutoReconnect {
-		go func() {
-			log.Printf("Attempting immediate connect for new network %s (ID: %d) for user %s", req.NetworkName, networkID, sess.Username)
-			ircClient, connErr := irc.EstablishIRCConnection(sess, netConfig, c.ClientIP())
-			if connErr != nil {
-				log.Printf("Initial connect failed for new network %s (ID: %d): %v", req.NetworkName, networkID, connErr)
-				sess.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
-					"network_id":   netConfig.ID,
-					"network_name": netConfig.NetworkName,
-					"status":       "failed",
-					"reason":       connErr.Error(),
-				})
-				// Don't remove from session.Networks even on failure, keep the config.
-				// The `IsConnected` flag will reflect the status.
-				return
-			}
-			netConfig.Mutex.Lock()
-			netConfig.IRC = ircClient.Connection
-			netConfig.IsConnected = true
-			netConfig.Mutex.Unlock()
-			log.Printf("Successfully connected new network %s (ID: %d) for user %s", req.NetworkName, networkID, sess.Username)
-		}()
+		log.Printf("Attempting immediate connect for new network %s (ID: %d) for user %s", req.NetworkName, networkID, sess.Username)
+		if connErr := irc.ConnectNetwork(sess, netConfig); connErr != nil {
+			log.Printf("Initial connect failed for new network %s (ID: %d): %v", req.NetworkName, networkID, connErr)
+		}
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
@@ -145,15 +436,9 @@ func AddNetworkHandler(c *gin.Context) {
 // ListNetworksHandler lists all IRC network configurations for a user.
 // GET /api/irc/networks
 func ListNetworksHandler(c *gin.Context) {
-	token, ok := getToken(c)
+	// Any API token may list networks, to find their IDs
+	sess, _, ok := authorizeRequest(c, "")
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
 		return
 	}
 
@@ -183,12 +468,17 @@ func ListNetworksHandler(c *gin.Context) {
 			"ident":            net.Ident,
 			"realname":         net.Realname,
 			"quit_message":     net.QuitMessage,
+			"sasl_mechanism":   net.SASLMechanism,
+			"tls_verify_mode":  net.TLSVerifyMode,
 			"is_connected":     false, // Default to false, will update from session
+			"state":            session.StateIdle,
 		}
 
-		// Check if network is connected in session
-		if sessNet, exists := sess.Networks[net.ID]; exists && sessNet.IsConnected {
-			networks[i]["is_connected"] = true
+		// Take the connection status from the live session
+		if sessNet, exists := sess.GetNetwork(net.ID); exists {
+			for key, value := range sessNet.Status() {
+				networks[i][key] = value
+			}
 		}
 	}
 
@@ -208,15 +498,8 @@ func UpdateNetworkHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, networkID, "") {
 		return
 	}
 
@@ -250,43 +533,80 @@ func UpdateNetworkHandler(c *gin.Context) {
 		}
 	}
 
-	// Update the existing network config with new values from request
-	existingNetConfig.NetworkName = req.NetworkName
-	existingNetConfig.Hostname = req.Hostname
-	existingNetConfig.Port = req.Port
-	existingNetConfig.UseSSL = req.UseSSL
-	existingNetConfig.ServerPassword = req.ServerPassword
-	existingNetConfig.AutoReconnect = req.AutoReconnect
-	existingNetConfig.Modules = req.Modules
-	existingNetConfig.PerformCommands = req.PerformCommands
-	existingNetConfig.InitialChannels = req.InitialChannels
-	existingNetConfig.Nickname = req.Nickname
-	existingNetConfig.AltNickname = req.AltNickname
-	existingNetConfig.Ident = req.Ident
-	existingNetConfig.Realname = req.Realname
-	existingNetConfig.QuitMessage = req.QuitMessage
-
-	err = users.UpdateUserNetwork(sess.UserID, existingNetConfig)
+	existingNetConfig.Mutex.RLock()
+	keepStoredSecrets(&req, existingNetConfig)
+	existingNetConfig.Mutex.RUnlock()
+	if err := validateServers(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if err := validateSASLSettings(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if err := validateTLSSettings(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	existingNetConfig.Mutex.RLock()
+	keepServerPins(&req, existingNetConfig)
+	existingNetConfig.Mutex.RUnlock()
+	if err := validateConnectionSettings(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if !checkInitialChannelsQuota(c, sess.UserID, &req) {
+		return
+	}
+
+	// Build the new settings apart from the live network, which connection
+	// goroutines read, and swap them in once they are saved.
+	existingNetConfig.Mutex.RLock()
+	serverIndex := existingNetConfig.ServerIndex
+	existingNetConfig.Mutex.RUnlock()
+	updated := &session.UserNetwork{
+		ID:                   networkID,
+		UserID:               sess.UserID,
+		NetworkName:          req.NetworkName,
+		Hostname:             req.Hostname,
+		Port:                 req.Port,
+		UseSSL:               req.UseSSL,
+		ServerPassword:       req.ServerPassword,
+		Servers:              req.Servers,
+		ServerIndex:          serverIndex,
+		AutoReconnect:        req.AutoReconnect,
+		Modules:              req.Modules,
+		PerformCommands:      req.PerformCommands,
+		InitialChannels:      req.InitialChannels,
+		Nickname:             req.Nickname,
+		AltNickname:          req.AltNickname,
+		Ident:                req.Ident,
+		Realname:             req.Realname,
+		QuitMessage:          req.QuitMessage,
+		SASLMechanism:        req.SASLMechanism,
+		SASLUsername:         req.SASLUsername,
+		SASLPassword:         req.SASLPassword,
+		NickServPassword:     req.NickServPassword,
+		ProxyURL:             req.ProxyURL,
+		ProxyPassword:        req.ProxyPassword,
+		BindAddress:          req.BindAddress,
+		AddressFamily:        req.AddressFamily,
+		TLSVerifyMode:        req.TLSVerifyMode,
+		TLSPinnedFingerprint: req.TLSPinnedFingerprint,
+	}
+
+	err = users.UpdateUserNetwork(sess.UserID, updated)
 	if err != nil {
 		log.Printf("Failed to update network %d for user %s: %v", networkID, sess.Username, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to update network"})
 		return
 	}
+	existingNetConfig.ApplySettings(updated)
 
 	log.Printf("User %s updated network: %s (ID: %d)", sess.Username, req.NetworkName, networkID)
 
-	// If the network was connected, disconnect and re-connect to apply new settings
-	if existingNetConfig.IsConnected {
-		log.Printf("Network %s (ID: %d) was connected, attempting to re-connect to apply changes.", req.NetworkName, networkID)
-		if existingNetConfig.IRC != nil {
-			existingNetConfig.IRC.Quit() // This will trigger the DISCONNECT handler and eventual reconnect logic
-		}
-		// Force immediate reconnect (instead of waiting for AutoReconnect logic)
-		go func() {
-			ReconnectNetwork(sess, networkID, c.ClientIP()) // Pass sess and clientIP
-		}()
-	}
-
+	// If the network is connected or trying to connect, restart it to apply new settings
+	irc.RestartNetwork(sess, existingNetConfig)
 
 	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Network updated successfully"})
 }
@@ -301,24 +621,15 @@ func DeleteNetworkHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, networkID, "") {
 		return
 	}
 
 	// Disconnect IRC if connected before deleting
 	netConfig, existsInSession := sess.GetNetwork(networkID)
-	if existsInSession && netConfig.IRC != nil && netConfig.IsConnected {
+	if existsInSession && irc.DisconnectNetwork(sess, netConfig) {
 		log.Printf("User %s: Disconnecting IRC for network %s (ID: %d) before deletion.", sess.Username, netConfig.NetworkName, networkID)
-		netConfig.IRC.Quit()
-		// The DISCONNECT handler will clean up `netConfig.IRC` and `IsConnected`
 	}
 
 	err = users.DeleteUserNetwork(sess.UserID, networkID)
@@ -346,15 +657,8 @@ func ConnectNetworkHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, networkID, "") {
 		return
 	}
 
@@ -382,32 +686,18 @@ func ConnectNetworkHandler(c *gin.Context) {
 		}
 	}
 
-	if netConfig.IsConnected {
-		c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Network %s is already connected.", netConfig.NetworkName)})
-		return
-	}
-
 	log.Printf("User %s: Attempting manual connect for network %s (ID: %d)", sess.Username, netConfig.NetworkName, networkID)
-	go func() {
-		ircClient, connErr := irc.EstablishIRCConnection(sess, netConfig, c.ClientIP())
-		if connErr != nil {
-			log.Printf("Manual connect failed for network %s (ID: %d): %v", netConfig.NetworkName, networkID, connErr)
-			sess.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
-				"network_id":   netConfig.ID,
-				"network_name": netConfig.NetworkName,
-				"status":       "failed",
-				"reason":       connErr.Error(),
-			})
+	if connErr := irc.ConnectNetwork(sess, netConfig); connErr != nil {
+		if errors.Is(connErr, irc.ErrConnectionQuota) {
+			limit := users.GetQuota(sess.UserID).MaxConnections
+			respondQuotaExceeded(c, "max_connections", limit, fmt.Sprintf("Connection limit reached: at most %d networks can be connected at once.", limit))
 			return
 		}
-		netConfig.Mutex.Lock()
-		netConfig.IRC = ircClient.Connection
-		netConfig.IsConnected = true
-		netConfig.Mutex.Unlock()
-		log.Printf("Successfully connected network %s (ID: %d) for user %s", netConfig.NetworkName, networkID, sess.Username)
-	}()
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Network %s is already connected or connecting.", netConfig.NetworkName), "status": netConfig.Status()})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Attempting to connect to network %s.", netConfig.NetworkName)})
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Attempting to connect to network %s.", netConfig.NetworkName), "status": netConfig.Status()})
 }
 
 // DisconnectNetworkHandler handles manually disconnecting from an IRC network.
@@ -420,15 +710,38 @@ func DisconnectNetworkHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, networkID, "") {
 		return
 	}
 
-	sess, found := session.GetSession(token)
+	netConfig, found := sess.GetNetwork(networkID)
 	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Network configuration not found in session"})
+		return
+	}
+
+	log.Printf("User %s: Disconnecting from network %s (ID: %d)", sess.Username, netConfig.NetworkName, networkID)
+	if !irc.DisconnectNetwork(sess, netConfig) {
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Network %s is already disconnected.", netConfig.NetworkName)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Disconnect command sent for network %s.", netConfig.NetworkName), "status": netConfig.Status()})
+}
+
+// CancelRetryHandler cancels a network's pending reconnect attempt.
+// POST /api/irc/networks/:id/cancel-retry
+func CancelRetryHandler(c *gin.Context) {
+	networkIDStr := c.Param("id")
+	networkID, err := strconv.Atoi(networkIDStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid network ID"})
+		return
+	}
+
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, networkID, "") {
 		return
 	}
 
@@ -438,48 +751,12 @@ func DisconnectNetworkHandler(c *gin.Context) {
 		return
 	}
 
-	if netConfig.IRC == nil || !netConfig.IsConnected {
-		c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Network %s is already disconnected.", netConfig.NetworkName)})
+	if !irc.CancelRetry(sess, netConfig) {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": fmt.Sprintf("Network %s has no pending retry.", netConfig.NetworkName), "status": netConfig.Status()})
 		return
 	}
 
-	log.Printf("User %s: Disconnecting from network %s (ID: %d)", sess.Username, netConfig.NetworkName, networkID)
-	netConfig.IRC.Quit() // This will trigger the DISCONNECT handler in irc_client.go
-
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Disconnect command sent for network %s.", netConfig.NetworkName)})
-}
-
-// ReconnectNetwork is a helper function to reconnect a specific network for a user session.
-// It's used by UpdateNetworkHandler and can be called by the irc.irc_client.go DISCONNECT handler.
-func ReconnectNetwork(s *session.UserSession, networkID int, clientIP string) {
-    s.Mutex.RLock()
-    netConfig, found := s.Networks[networkID]
-    s.Mutex.RUnlock()
-
-    if !found {
-        log.Printf("Attempted reconnect for unknown network ID %d for user %s", networkID, s.Username)
-        return
-    }
-
-    log.Printf("User %s: Initiating reconnect for network %s (ID: %d)", s.Username, netConfig.NetworkName, networkID)
-    ircClient, connErr := irc.EstablishIRCConnection(s, netConfig, clientIP)
-    if connErr != nil {
-        log.Printf("Reconnect failed for network %s (ID: %d): %v", netConfig.NetworkName, networkID, connErr)
-        s.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
-            "network_id":   netConfig.ID,
-            "network_name": netConfig.NetworkName,
-            "status":       "failed",
-            "reason":       connErr.Error(),
-        })
-        return
-    }
-    netConfig.Mutex.Lock()
-    netConfig.IRC = ircClient.Connection
-    netConfig.IsConnected = true
-    // Clear existing channels as we will get new JOINs/NAMES on reconnect
-    netConfig.Channels = make(map[string]*session.ChannelState)
-    netConfig.Mutex.Unlock()
-    log.Printf("Reconnect successful for network %s (ID: %d) for user %s", netConfig.NetworkName, networkID, s.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Retry cancelled for network %s.", netConfig.NetworkName), "status": netConfig.Status()})
 }
 
 // GetNetworkDetailsHandler fetches a single IRC network's details by ID.
@@ -492,15 +769,8 @@ func GetNetworkDetailsHandler(c *gin.Context) {
 		return
 	}
 
-	token, ok := getToken(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
-		return
-	}
-
-	sess, found := session.GetSession(token)
-	if !found {
-		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok || !allowTarget(c, apiToken, users.ScopeNetworksManage, networkID, "") {
 		return
 	}
 
@@ -512,14 +782,15 @@ func GetNetworkDetailsHandler(c *gin.Context) {
 		return
 	}
 
-	// Prepare response, including sensitive fields needed for editing
+	// Prepare response; secrets are reported only as set or not
 	responseNetwork := map[string]interface{}{
 		"id":              netConfig.ID,
 		"network_name":    netConfig.NetworkName,
 		"hostname":        netConfig.Hostname,
 		"port":            netConfig.Port,
 		"use_ssl":         netConfig.UseSSL,
-		"server_password": netConfig.ServerPassword, // Include this for editing screen
+		"server_password_set": netConfig.ServerPassword != "", // Secrets are never returned
+		"servers":         serverListResponse(netConfig),
 		"auto_reconnect":  netConfig.AutoReconnect,
 		"modules":         netConfig.Modules,
 		"perform_commands": netConfig.PerformCommands,
@@ -529,7 +800,30 @@ func GetNetworkDetailsHandler(c *gin.Context) {
 		"ident":           netConfig.Ident,
 		"realname":        netConfig.Realname,
 		"quit_message":    netConfig.QuitMessage,
-		"is_connected":    netConfig.IsConnected, // Current connection status from session object
+		"sasl_mechanism":  netConfig.SASLMechanism,
+		"sasl_username":   netConfig.SASLUsername,
+		"sasl_password_set": netConfig.SASLPassword != "",
+		"nickserv_password_set": netConfig.NickServPassword != "",
+		"has_client_cert": netConfig.ClientCert != "",
+		"tls_verify_mode": netConfig.TLSVerifyMode,
+		"tls_pinned_fingerprint": netConfig.TLSPinnedFingerprint,
+		"proxy_url":       netConfig.ProxyURL, // Stored without its password
+		"proxy_password_set": netConfig.ProxyPassword != "",
+		"bind_address":    netConfig.BindAddress,
+		"address_family":  netConfig.AddressFamily,
+		"is_connected":    false,
+		"state":           session.StateIdle,
+	}
+
+	// Take the connection status from the live session
+	if sessNet, exists := sess.GetNetwork(networkID); exists {
+		for key, value := range sessNet.Status() {
+			responseNetwork[key] = value
+		}
+	}
+
+	if netConfig.UseSSL && netConfig.TLSVerifyMode == irc.TLSInsecure {
+		responseNetwork["tls_warning"] = insecureTLSWarning
 	}
 
 	c.JSON(http.StatusOK, gin.H{
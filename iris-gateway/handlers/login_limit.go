@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"iris-gateway/config"
+	"iris-gateway/users"
+)
+
+const (
+	// Longest wait imposed between failed logins before a lockout.
+	maxLoginDelay = 5 * time.Minute
+	// Failures older than this are forgotten.
+	loginFailureWindow = time.Hour
+	// An IP address may fail this many times more often than a username,
+	// since several users can share one address.
+	ipFailureMultiplier = 4
+)
+
+// Audit log reasons for failed logins.
+const (
+	loginReasonInvalid   = "invalid_credentials"
+	loginReasonSuspended = "suspended"
+	loginReasonLimited   = "rate_limited"
+)
+
+func userThrottleKey(username string) string { return "user:" + strings.ToLower(username) }
+func ipThrottleKey(ip string) string         { return "ip:" + ip }
+
+func loginLockout() time.Duration {
+	lockout, err := time.ParseDuration(config.Cfg.LoginLockout)
+	if err != nil || lockout <= 0 {
+		log.Printf("Invalid login lockout '%s', defaulting to 15m", config.Cfg.LoginLockout)
+		return 15 * time.Minute
+	}
+	return lockout
+}
+
+// loginDelay is how long to wait after the given number of consecutive
+// failures: nothing after the first, then 1s, 2s, 4s and so on.
+func loginDelay(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-2))) * time.Second
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+	return delay
+}
+
+// Logins being checked, by throttle key. A login holds its username's and
+// IP's keys from the throttle check until its outcome is recorded, so
+// parallel guesses can't all get past the check before any of them counts.
+var loginKeyLocks = struct {
+	sync.Mutex
+	m map[string]*loginKeyLock
+}{m: make(map[string]*loginKeyLock)}
+
+type loginKeyLock struct {
+	sync.Mutex
+	holders int // Logins holding or waiting for the lock
+}
+
+// lockLoginKey waits for other logins holding a throttle key and returns the
+// function that releases it.
+func lockLoginKey(key string) func() {
+	loginKeyLocks.Lock()
+	lock, found := loginKeyLocks.m[key]
+	if !found {
+		lock = &loginKeyLock{}
+		loginKeyLocks.m[key] = lock
+	}
+	lock.holders++
+	loginKeyLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		loginKeyLocks.Lock()
+		defer loginKeyLocks.Unlock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(loginKeyLocks.m, key)
+		}
+	}
+}
+
+// beginLoginAttempt waits for other logins with the same username or from the
+// same IP to finish, then returns how long this one must wait, as
+// loginRetryAfter does. The returned function must be called once the
+// attempt's outcome has been recorded.
+func beginLoginAttempt(username, ip string) (time.Duration, func()) {
+	// Always the username first, so two logins can't wait on each other
+	unlockUser := lockLoginKey(userThrottleKey(username))
+	unlockIP := lockLoginKey(ipThrottleKey(ip))
+	return loginRetryAfter(username, ip), func() {
+		unlockIP()
+		unlockUser()
+	}
+}
+
+// beginIPAttempt is beginLoginAttempt for attempts that are limited by IP
+// only, such as guessing invite codes, where the username is whoever the
+// guesser claims to be.
+func beginIPAttempt(ip string) (time.Duration, func()) {
+	unlockIP := lockLoginKey(ipThrottleKey(ip))
+	return throttleRetryAfter(ipThrottleKey(ip)), unlockIP
+}
+
+// loginRetryAfter returns how long a login for this username from this IP
+// must wait, or zero if it may go ahead.
+func loginRetryAfter(username, ip string) time.Duration {
+	return throttleRetryAfter(userThrottleKey(username), ipThrottleKey(ip))
+}
+
+// throttleRetryAfter returns the longest wait imposed by any of the throttle keys.
+func throttleRetryAfter(keys ...string) time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		throttle, err := users.GetLoginThrottle(key)
+		if err != nil {
+			log.Printf("Failed to read login throttle for %s: %v", key, err)
+			continue
+		}
+		// A lockout outlasts the failure window if LoginLockout is longer
+		var until time.Time
+		if throttle.Failures > 0 && now.Sub(throttle.LastFailure) <= loginFailureWindow {
+			until = throttle.LastFailure.Add(loginDelay(throttle.Failures))
+		}
+		if throttle.LockedUntil.After(until) {
+			until = throttle.LockedUntil
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed login against the username and the IP,
+// locking either out once it reaches its limit.
+func recordLoginFailure(username, ip, reason string) {
+	if err := users.RecordLoginAttempt(username, ip, false, reason); err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+	}
+	if reason == loginReasonLimited {
+		return
+	}
+
+	maxFailures := config.Cfg.LoginMaxFailures
+	addThrottleFailure(userThrottleKey(username), maxFailures)
+	addThrottleFailure(ipThrottleKey(ip), maxFailures*ipFailureMultiplier)
+}
+
+// recordIPFailure counts a failed attempt against the IP only, so guesses
+// naming someone else's username can't lock them out. The username is kept
+// in the audit log.
+func recordIPFailure(username, ip, reason string) {
+	if err := users.RecordLoginAttempt(username, ip, false, reason); err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+	}
+	addThrottleFailure(ipThrottleKey(ip), config.Cfg.LoginMaxFailures*ipFailureMultiplier)
+}
+
+// addThrottleFailure counts a failure against a throttle key, locking it out
+// once it reaches limit.
+func addThrottleFailure(key string, limit int) {
+	failures, err := users.AddLoginFailure(key, limit, loginFailureWindow, loginLockout())
+	if err != nil {
+		log.Printf("Failed to save login throttle for %s: %v", key, err)
+		return
+	}
+	if limit > 0 && failures == limit {
+		log.Printf("Locking out %s for %s after %d failed logins", key, loginLockout(), failures)
+	}
+}
+
+// recordLoginSuccess logs a successful login and clears the username's
+// failures. The IP's failures are left to expire, so one valid account can't
+// be used to reset the limit for guessing others.
+func recordLoginSuccess(username, ip string) {
+	if err := users.RecordLoginAttempt(username, ip, true, ""); err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+	}
+	if err := users.ClearLoginThrottle(userThrottleKey(username)); err != nil {
+		log.Printf("Failed to clear login throttle: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/events"
+	"iris-gateway/irc"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// Lines one POST /api/messages request may send, to keep scripts from
+// flooding a channel.
+const maxMessageLines = 20
+
+// sendMessageLines sends text to a channel or nick, one PRIVMSG or NOTICE per
+// line, and records it in the history. It returns the lines sent.
+func sendMessageLines(sess *session.UserSession, netConfig *session.UserNetwork, target, text string, notice bool) []string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		ircLine := line
+		if len(ircLine) == 0 {
+			ircLine = " "
+		}
+		lines[i] = ircLine
+		log.Printf("[IRC] Sending line to %s on network %s from %s: '%s'", target, netConfig.NetworkName, sess.Username, ircLine)
+		if notice {
+			irc.TrackCommand(netConfig.ID, "NOTICE", target)
+			netConfig.IRC.Notice(target, ircLine)
+		} else {
+			irc.TrackCommand(netConfig.ID, "PRIVMSG", target)
+			netConfig.IRC.Privmsg(target, ircLine)
+		}
+
+		irc.AddMessageToHistory(netConfig.ID, target, irc.Message{
+			NetworkID: netConfig.ID,
+			Channel:   target,
+			Sender:    netConfig.Nickname, // Use the user's nickname for this network
+			Text:      ircLine,
+			Timestamp: time.Now(),
+		})
+
+		time.Sleep(100 * time.Millisecond)
+	}
+	return lines
+}
+
+// broadcastSentLines shows lines sent by sendMessageLines to the user's own
+// clients, which didn't send them.
+func broadcastSentLines(sess *session.UserSession, netConfig *session.UserNetwork, target string, lines []string, notice bool) {
+	eventType := events.EventTypeMessage
+	if notice {
+		eventType = events.EventTypeNotice
+	}
+	for _, line := range lines {
+		now := time.Now()
+		sess.Broadcast(eventType, map[string]interface{}{
+			"network_id":   netConfig.ID,
+			"channel_name": strings.ToLower(target),
+			"sender":       netConfig.Nickname,
+			"text":         line,
+			"time":         now.UTC().Format(time.RFC3339),
+			"id":           fmt.Sprintf("msg_%d_%s", now.UnixNano(), netConfig.Nickname),
+		})
+	}
+}
+
+// SendMessageHandler sends a message to a channel or nick, for scripts and
+// bots using an API token with the messages:send scope.
+// POST /api/messages
+func SendMessageHandler(c *gin.Context) {
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeMessagesSend)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		NetworkID int    `json:"network_id"`
+		Target    string `json:"target"` // Channel or nick
+		Text      string `json:"text"`
+		Notice    bool   `json:"notice"` // Send as NOTICE instead of PRIVMSG
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.NetworkID == 0 || req.Target == "" || req.Text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Network ID, target and text required"})
+		return
+	}
+	if strings.ContainsAny(req.Target, " ,\r\n") {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid target"})
+		return
+	}
+	req.Text = strings.ReplaceAll(strings.TrimRight(req.Text, "\r\n"), "\r", "")
+	if strings.Count(req.Text, "\n") >= maxMessageLines {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("At most %d lines can be sent at once", maxMessageLines)})
+		return
+	}
+	if !allowTarget(c, apiToken, users.ScopeMessagesSend, req.NetworkID, req.Target) {
+		return
+	}
+
+	netConfig, found := sess.GetNetwork(req.NetworkID)
+	if !found || netConfig.IRC == nil || !netConfig.IsConnected() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "IRC network not connected or not found"})
+		return
+	}
+
+	lines := sendMessageLines(sess, netConfig, req.Target, req.Text, req.Notice)
+	broadcastSentLines(sess, netConfig, req.Target, lines, req.Notice)
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Sent %d lines to %s on network %s", len(lines), req.Target, netConfig.NetworkName)})
+}
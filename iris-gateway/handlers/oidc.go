@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"iris-gateway/auth"
+	"iris-gateway/config"
+	"iris-gateway/users"
+)
+
+// How long a login may stay at the OIDC provider before it has to be started again.
+const oidcLoginLifetime = 10 * time.Minute
+
+// Cookie tying a login to the browser that started it, so a callback URL
+// carrying someone else's state can't log the browser into their account.
+const oidcStateCookie = "iris_oidc_state"
+
+// Logins sent to the OIDC provider and not back yet, by state. They are only
+// kept in memory.
+var oidcLogins = struct {
+	sync.Mutex
+	m map[string]*oidcLogin
+}{m: make(map[string]*oidcLogin)}
+
+type oidcLogin struct {
+	nonce    string
+	verifier string       // PKCE code verifier
+	req      LoginRequest // Device details for the new session
+	expires  time.Time
+}
+
+// AuthInfoHandler tells clients how to log in.
+// GET /api/auth
+func AuthInfoHandler(c *gin.Context) {
+	_, oidcEnabled := auth.OIDCProvider()
+	response := gin.H{
+		"success":        true,
+		"backend":        users.AuthBackend(),
+		"password_login": !oidcEnabled || config.Cfg.AuthLocalUsers,
+		"registration":   config.Cfg.RegistrationEnabled && !users.ExternalAuth(),
+	}
+	if oidcEnabled {
+		response["oidc_login_url"] = "/api/login/oidc"
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// OIDCLoginHandler sends the browser to the OIDC provider's login page. The
+// optional device_name and client_version query parameters name the device.
+// GET /api/login/oidc
+func OIDCLoginHandler(c *gin.Context) {
+	provider, ok := auth.OIDCProvider()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Single sign-on is not enabled"})
+		return
+	}
+
+	state, err := randomHex(16)
+	if err != nil {
+		log.Printf("Failed to start OIDC login: %v", err)
+		oidcRespond(c, http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log in"})
+		return
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		log.Printf("Failed to start OIDC login: %v", err)
+		oidcRespond(c, http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log in"})
+		return
+	}
+	login := &oidcLogin{
+		nonce:    nonce,
+		verifier: oauth2.GenerateVerifier(),
+		req: LoginRequest{
+			DeviceName:    c.Query("device_name"),
+			ClientVersion: c.Query("client_version"),
+		},
+		expires: time.Now().Add(oidcLoginLifetime),
+	}
+
+	target, err := provider.AuthCodeURL(state, login.nonce, login.verifier)
+	if err != nil {
+		log.Printf("Failed to start OIDC login: %v", err)
+		oidcRespond(c, http.StatusServiceUnavailable, gin.H{"success": false, "message": "Single sign-on is unavailable right now. Try again later."})
+		return
+	}
+	storeOIDCLogin(state, login)
+	setOIDCStateCookie(c, state, int(oidcLoginLifetime.Seconds()))
+	c.Redirect(http.StatusFound, target)
+}
+
+// setOIDCStateCookie sets the state cookie for the login and callback
+// paths; a negative maxAge deletes it.
+func setOIDCStateCookie(c *gin.Context, state string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, "/api/login/oidc", "", config.Cfg.UseTLS, true)
+}
+
+func storeOIDCLogin(state string, login *oidcLogin) {
+	oidcLogins.Lock()
+	defer oidcLogins.Unlock()
+	now := time.Now()
+	for key, pending := range oidcLogins.m {
+		if now.After(pending.expires) {
+			delete(oidcLogins.m, key)
+		}
+	}
+	oidcLogins.m[state] = login
+}
+
+// takeOIDCLogin returns and forgets the unexpired login of a state.
+func takeOIDCLogin(state string) (*oidcLogin, bool) {
+	oidcLogins.Lock()
+	defer oidcLogins.Unlock()
+	login, found := oidcLogins.m[state]
+	delete(oidcLogins.m, state)
+	if !found || time.Now().After(login.expires) {
+		return nil, false
+	}
+	return login, true
+}
+
+// OIDCCallbackHandler finishes a login when the provider sends the browser
+// back. Accounts with two-factor authentication get a challenge token for
+// /api/login/2fa instead of a session token.
+// GET /api/login/oidc/callback
+func OIDCCallbackHandler(c *gin.Context) {
+	provider, ok := auth.OIDCProvider()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Single sign-on is not enabled"})
+		return
+	}
+
+	state := c.Query("state")
+	cookieState, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookieState), []byte(state)) != 1 {
+		log.Printf("OIDC callback from %s refused: state doesn't match this browser's login", c.ClientIP())
+		oidcRespond(c, http.StatusBadRequest, gin.H{"success": false, "message": "Login wasn't started from this browser. Start again."})
+		return
+	}
+	setOIDCStateCookie(c, "", -1)
+
+	login, found := takeOIDCLogin(state)
+	if !found {
+		oidcRespond(c, http.StatusBadRequest, gin.H{"success": false, "message": "Login expired or unknown. Start again."})
+		return
+	}
+	if providerErr := c.Query("error"); providerErr != "" {
+		log.Printf("OIDC login refused by provider: %s %s", providerErr, c.Query("error_description"))
+		oidcRespond(c, http.StatusUnauthorized, gin.H{"success": false, "message": "Login was refused by the identity provider"})
+		return
+	}
+
+	ip := c.ClientIP()
+	identity, err := provider.Exchange(c.Query("code"), login.nonce, login.verifier)
+	if err != nil {
+		log.Printf("OIDC login from %s failed: %v", ip, err)
+		oidcRespond(c, http.StatusUnauthorized, gin.H{"success": false, "message": "Login with the identity provider failed"})
+		return
+	}
+	if !validUsername.MatchString(identity.Username) {
+		log.Printf("OIDC login from %s refused: %s %q is not a valid username", ip, config.Cfg.OIDCUsernameClaim, identity.Username)
+		oidcRespond(c, http.StatusForbidden, gin.H{"success": false, "message": "Your account's username can't be used here"})
+		return
+	}
+
+	user, err := users.ProvisionUser(identity)
+	if err != nil {
+		log.Printf("OIDC login for user '%s' from %s failed: %v", identity.Username, ip, err)
+		recordLoginFailure(identity.Username, ip, loginReasonInvalid)
+		if errors.Is(err, users.ErrAccountConflict) {
+			oidcRespond(c, http.StatusForbidden, gin.H{"success": false, "message": "Your username belongs to another account here. An admin can link it to yours."})
+			return
+		}
+		oidcRespond(c, http.StatusForbidden, gin.H{"success": false, "message": "Your account can't be used here"})
+		return
+	}
+	if user.IsSuspended {
+		log.Printf("Login attempt for suspended user '%s'", user.Username)
+		recordLoginFailure(user.Username, ip, loginReasonSuspended)
+		oidcRespond(c, http.StatusUnauthorized, gin.H{"success": false, "message": "Account is suspended"})
+		return
+	}
+
+	twoFactor, err := users.GetTwoFactor(user.ID)
+	if err != nil {
+		log.Printf("Failed to read two-factor state for user %s: %v", user.Username, err)
+		oidcRespond(c, http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log in"})
+		return
+	}
+	if twoFactor.Enabled {
+		challenge, err := createLoginChallenge(user, login.req)
+		if err != nil {
+			log.Printf("Failed to create login challenge for user %s: %v", user.Username, err)
+			oidcRespond(c, http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log in"})
+			return
+		}
+		oidcRespond(c, http.StatusOK, gin.H{
+			"success":             true,
+			"message":             "Two-factor code required",
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int(loginChallengeLifetime.Seconds()),
+		})
+		return
+	}
+
+	token, stored, message, err := issueLoginToken(c, user, login.req)
+	if err != nil {
+		oidcRespond(c, http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create session"})
+		return
+	}
+	oidcRespond(c, http.StatusOK, gin.H{
+		"success":    true,
+		"message":    message,
+		"token":      token,
+		"expires_at": stored.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// oidcRespond finishes an OIDC login. The browser is sent back to the app
+// with the result in the URL fragment, which never reaches a server, or gets
+// it as JSON if no app URL is configured.
+func oidcRespond(c *gin.Context, status int, body gin.H) {
+	if config.Cfg.OIDCAppRedirectURL == "" {
+		c.JSON(status, body)
+		return
+	}
+	fragment := url.Values{}
+	for key, value := range body {
+		fragment.Set(key, fmt.Sprint(value))
+	}
+	target := strings.SplitN(config.Cfg.OIDCAppRedirectURL, "#", 2)[0]
+	c.Redirect(http.StatusFound, target+"#"+fragment.Encode())
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"iris-gateway/config"
+)
+
+// allowedOrigins returns the configured origins plus the gateway's own domain,
+// with and without the port it listens on.
+func allowedOrigins() []string {
+	origins := append([]string{}, config.Cfg.AllowedOrigins...)
+	if config.Cfg.TLSDomain != "" {
+		origins = append(origins, "https://"+config.Cfg.TLSDomain)
+		if _, port, err := net.SplitHostPort(config.Cfg.ListenAddr); err == nil && port != "" {
+			origins = append(origins, "https://"+net.JoinHostPort(config.Cfg.TLSDomain, port))
+		}
+	}
+	return origins
+}
+
+// originMatches reports whether origin matches an allowed origin. An allowed
+// origin ending in ":*" matches its scheme and host on any port.
+func originMatches(origin, allowed string) bool {
+	allowed = strings.TrimSuffix(strings.ToLower(allowed), "/")
+	if !strings.HasSuffix(allowed, ":*") {
+		return origin == allowed
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Scheme+"://"+u.Hostname() == strings.TrimSuffix(allowed, ":*")
+}
+
+// originAllowed reports whether a browser origin may use the API and open WebSockets.
+func originAllowed(origin string) bool {
+	normalized := strings.TrimSuffix(strings.ToLower(origin), "/")
+	for _, allowed := range allowedOrigins() {
+		if originMatches(normalized, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginAllowed is the CORS middleware's origin check. It logs rejections.
+func OriginAllowed(origin string) bool {
+	if !originAllowed(origin) {
+		log.Printf("[CORS] Rejected request from origin %q", origin)
+		return false
+	}
+	return true
+}
+
+// checkWebSocketOrigin allows WebSocket upgrades from allowed origins and
+// from clients that send no Origin, such as the mobile app.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !originAllowed(origin) {
+		log.Printf("[WS] Rejected WebSocket upgrade from origin %q (%s)", origin, r.RemoteAddr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/users"
+)
+
+// ChangePasswordHandler changes the user's own password and logs out every
+// other device.
+// POST /api/password
+func ChangePasswordHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	ip := c.ClientIP()
+	sess, login, found := lookupLogin(token, ip)
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Current and new password required"})
+		return
+	}
+
+	if managed, err := users.ManagedByDirectory(sess.UserID); err != nil || managed {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Your password is managed by your directory account; change it there"})
+		return
+	}
+
+	// A stolen token mustn't become a way around the login limits
+	wait, release := beginLoginAttempt(sess.Username, ip)
+	defer release()
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "message": "Too many failed attempts. Try again later."})
+		return
+	}
+	if _, err := users.AuthenticateUser(sess.Username, req.CurrentPassword); err != nil {
+		log.Printf("Password change for user '%s' from %s refused: wrong current password", sess.Username, ip)
+		recordLoginFailure(sess.Username, ip, loginReasonInvalid)
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Current password is incorrect"})
+		return
+	}
+
+	if err := users.SetPassword(sess.UserID, req.NewPassword); err != nil {
+		if errors.Is(err, users.ErrPasswordPolicy) {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": policyMessage(err)})
+			return
+		}
+		log.Printf("Failed to change password for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to change password"})
+		return
+	}
+	sess.Password = req.NewPassword
+
+	revoked, err := users.RevokeAllSessions(sess.UserID, login.ID)
+	if err != nil {
+		log.Printf("Failed to revoke sessions for user %s: %v", sess.Username, err)
+	}
+	closeLoginWebSockets(sess.UserID, func(loginID int) bool { return loginID != login.ID })
+
+	log.Printf("User %s changed their password; %d other sessions revoked", sess.Username, revoked)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Password changed", "revoked": revoked})
+}
+
+// policyMessage turns a password policy error into a message for the user.
+func policyMessage(err error) string {
+	reason := strings.TrimPrefix(err.Error(), users.ErrPasswordPolicy.Error()+": ")
+	return "Password " + reason
+}
@@ -5,7 +5,6 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"iris-gateway/session"
 )
 
 type RegisterFCMTokenRequest struct {
@@ -20,7 +19,7 @@ func RegisterFCMTokenHandler(c *gin.Context) {
 		return
 	}
 
-	sess, found := session.GetSession(token)
+	sess, found := lookupSession(token, c.ClientIP())
 	if !found {
 		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
 		return
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/config"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// respondQuotaExceeded tells the client which limit it has reached.
+func respondQuotaExceeded(c *gin.Context, quota string, limit interface{}, message string) {
+	c.JSON(http.StatusForbidden, gin.H{
+		"success":        false,
+		"message":        message,
+		"quota_exceeded": quota,
+		"limit":          limit,
+	})
+}
+
+// userQuotaLocks serializes each user's quota checks with the inserts they
+// allow, so parallel requests can't all see the same room under a limit.
+var userQuotaLocks = struct {
+	sync.Mutex
+	m map[int]*sync.Mutex
+}{m: make(map[int]*sync.Mutex)}
+
+// lockUserQuota locks a user's quota and returns the function unlocking it.
+func lockUserQuota(userID int) func() {
+	userQuotaLocks.Lock()
+	lock, ok := userQuotaLocks.m[userID]
+	if !ok {
+		lock = &sync.Mutex{}
+		userQuotaLocks.m[userID] = lock
+	}
+	userQuotaLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// attachmentStorageDuration is how long uploaded attachments are kept.
+func attachmentStorageDuration() time.Duration {
+	duration, err := time.ParseDuration(config.Cfg.ImageStorageDuration)
+	if err != nil {
+		log.Printf("Invalid image storage duration '%s', defaulting to 12h", config.Cfg.ImageStorageDuration)
+		return 12 * time.Hour
+	}
+	return duration
+}
+
+// joinedChannelCount counts the channels a user is in across their networks.
+func joinedChannelCount(sess *session.UserSession) int {
+	sess.Mutex.RLock()
+	networks := make([]*session.UserNetwork, 0, len(sess.Networks))
+	for _, netConfig := range sess.Networks {
+		networks = append(networks, netConfig)
+	}
+	sess.Mutex.RUnlock()
+
+	count := 0
+	for _, netConfig := range networks {
+		netConfig.Mutex.RLock()
+		count += len(netConfig.Channels)
+		netConfig.Mutex.RUnlock()
+	}
+	return count
+}
+
+// quotaResponse describes a quota and the user's usage of it.
+func quotaResponse(userID int, quota users.Quota) gin.H {
+	response := gin.H{
+		"max_networks":      quota.MaxNetworks,
+		"max_connections":   quota.MaxConnections,
+		"max_channels":      quota.MaxChannels,
+		"attachment_bytes":  quota.AttachmentBytes,
+		"history_retention": quota.HistoryRetention.String(),
+	}
+
+	usage := gin.H{}
+	if networks, err := users.CountUserNetworks(userID); err == nil {
+		usage["networks"] = networks
+	}
+	if used, err := users.AttachmentUsage(userID, attachmentStorageDuration()); err == nil {
+		usage["attachment_bytes"] = used
+	}
+	usage["connections"] = 0
+	usage["channels"] = 0
+	if sess, found := session.GetSessionByUserID(userID); found {
+		connections := 0
+		sess.Mutex.RLock()
+		for _, netConfig := range sess.Networks {
+			if netConfig.IsConnected() {
+				connections++
+			}
+		}
+		sess.Mutex.RUnlock()
+		usage["connections"] = connections
+		usage["channels"] = joinedChannelCount(sess)
+	}
+	response["usage"] = usage
+	return response
+}
+
+// QuotaHandler returns the user's quota and how much of it they use. Zero
+// limits are unlimited.
+// GET /api/quota
+func QuotaHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "quota": quotaResponse(sess.UserID, users.GetQuota(sess.UserID))})
+}
+
+// AdminGetQuotaHandler returns a user's quota, the admin's overrides of the
+// defaults, and the user's usage.
+// GET /api/admin/users/:id/quota
+func AdminGetQuotaHandler(c *gin.Context) {
+	if _, ok := requireAdmin(c); !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	overrides, err := users.GetQuotaOverrides(user.ID)
+	if err != nil {
+		log.Printf("[Admin] Failed to read quota of %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to read quota"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"quota":     quotaResponse(user.ID, users.GetQuota(user.ID)),
+		"overrides": overrides,
+	})
+}
+
+// AdminSetQuotaHandler replaces the overrides of a user's quota. Fields left
+// out or null use the defaults from the config; zero is unlimited.
+// PUT /api/admin/users/:id/quota
+func AdminSetQuotaHandler(c *gin.Context) {
+	admin, ok := requireAdmin(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var overrides users.QuotaOverrides
+	if err := c.BindJSON(&overrides); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	for _, limit := range []*int{overrides.MaxNetworks, overrides.MaxConnections, overrides.MaxChannels} {
+		if limit != nil && *limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Limits cannot be negative"})
+			return
+		}
+	}
+	if overrides.AttachmentBytes != nil && *overrides.AttachmentBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Limits cannot be negative"})
+		return
+	}
+
+	if err := users.SetQuotaOverrides(user.ID, &overrides); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+
+	log.Printf("[Admin] %s changed the quota of %s", admin.Username, user.Username)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Quota updated", "quota": quotaResponse(user.ID, users.GetQuota(user.ID))})
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/config"
+	"iris-gateway/irc"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// A session's expiry is extended at most this often, to spare the database a
+// write on every request.
+const sessionTouchInterval = time.Minute
+
+// sessionLifetime returns how long a login token stays valid without being used.
+func sessionLifetime() time.Duration {
+	lifetime, err := time.ParseDuration(config.Cfg.SessionLifetime)
+	if err != nil || lifetime <= 0 {
+		log.Printf("Invalid session lifetime '%s', defaulting to 720h", config.Cfg.SessionLifetime)
+		return 720 * time.Hour
+	}
+	return lifetime
+}
+
+// lookupSession returns the user session for a login token used from ip.
+func lookupSession(token, ip string) (*session.UserSession, bool) {
+	sess, _, ok := lookupLogin(token, ip)
+	return sess, ok
+}
+
+// lookupLogin returns the user session for a login token used from ip, along
+// with the token's stored session, and extends the token's expiry. The user's
+// session is started if the bouncer hasn't.
+func lookupLogin(token, ip string) (*session.UserSession, *users.Session, bool) {
+	stored, err := users.GetSessionByToken(token)
+	if err != nil {
+		if !errors.Is(err, users.ErrSessionNotFound) {
+			log.Printf("Failed to look up session: %v", err)
+		}
+		return nil, nil, false
+	}
+
+	if time.Since(stored.LastUsedAt) > sessionTouchInterval || stored.LastIP != ip {
+		if err := users.TouchSession(stored.ID, ip, sessionLifetime()); err != nil {
+			log.Printf("Failed to extend session %d: %v", stored.ID, err)
+		}
+	}
+
+	return liveSession(stored.UserID, stored.Username), stored, true
+}
+
+// liveSession returns a user's session, starting it if the bouncer hasn't.
+func liveSession(userID int, username string) *session.UserSession {
+	sess, created := session.GetOrCreateUserSession(userID, username)
+	if created {
+		irc.LoadNetworks(sess)
+	}
+	return sess
+}
+
+// closeLoginWebSockets closes the WebSockets opened with the matching login
+// sessions, if the user's session is live.
+func closeLoginWebSockets(userID int, match func(loginID int) bool) {
+	if sess, found := session.GetSessionByUserID(userID); found {
+		if closed := sess.CloseWebSockets(match); closed > 0 {
+			log.Printf("[WS] Closed %d WebSockets of revoked sessions for user %s", closed, sess.Username)
+		}
+	}
+}
+
+// LogoutHandler revokes the token making the request.
+// POST /api/logout
+func LogoutHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	current, err := users.GetSessionByToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	if err := users.RevokeSession(current.UserID, current.ID); err != nil && !errors.Is(err, users.ErrSessionNotFound) {
+		log.Printf("Failed to log out session %d for user %s: %v", current.ID, current.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to log out"})
+		return
+	}
+	closeLoginWebSockets(current.UserID, func(loginID int) bool { return loginID == current.ID })
+
+	log.Printf("User %s logged out session %d", current.Username, current.ID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Logged out"})
+}
+
+// ListSessionsHandler lists the user's active login sessions, one per device.
+// GET /api/sessions
+// GET /api/devices
+func ListSessionsHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	current, err := users.GetSessionByToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	stored, err := users.ListSessions(current.UserID)
+	if err != nil {
+		log.Printf("Failed to list sessions for user %s: %v", current.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list sessions"})
+		return
+	}
+
+	sessions := make([]gin.H, 0, len(stored))
+	for _, s := range stored {
+		sessions = append(sessions, gin.H{
+			"id":             s.ID,
+			"device_name":    s.DeviceName,
+			"client_version": s.ClientVersion,
+			"last_ip":        s.LastIP,
+			"created_at":     s.CreatedAt.UTC().Format(time.RFC3339),
+			"last_used_at":   s.LastUsedAt.UTC().Format(time.RFC3339),
+			"expires_at":     s.ExpiresAt.UTC().Format(time.RFC3339),
+			"current":        s.ID == current.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "sessions": sessions})
+}
+
+// RevokeSessionHandler logs out one of the user's sessions and closes its
+// WebSockets.
+// DELETE /api/sessions/:id
+// DELETE /api/devices/:id
+func RevokeSessionHandler(c *gin.Context) {
+	sessionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid session ID"})
+		return
+	}
+
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	current, err := users.GetSessionByToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	if err := users.RevokeSession(current.UserID, sessionID); err != nil {
+		if errors.Is(err, users.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Session not found"})
+			return
+		}
+		log.Printf("Failed to revoke session %d for user %s: %v", sessionID, current.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to revoke session"})
+		return
+	}
+
+	closeLoginWebSockets(current.UserID, func(loginID int) bool { return loginID == sessionID })
+
+	log.Printf("User %s revoked session %d", current.Username, sessionID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Session revoked"})
+}
+
+// RevokeAllSessionsHandler logs out all of the user's sessions. With
+// ?keep_current=true the session making the request stays logged in.
+// DELETE /api/sessions
+func RevokeAllSessionsHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	current, err := users.GetSessionByToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	keepID := 0
+	if c.Query("keep_current") == "true" {
+		keepID = current.ID
+	}
+	revoked, err := users.RevokeAllSessions(current.UserID, keepID)
+	if err != nil {
+		log.Printf("Failed to revoke sessions for user %s: %v", current.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to revoke sessions"})
+		return
+	}
+
+	closeLoginWebSockets(current.UserID, func(loginID int) bool { return loginID != keepID })
+
+	log.Printf("User %s revoked %d sessions", current.Username, revoked)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Sessions revoked", "revoked": revoked})
+}
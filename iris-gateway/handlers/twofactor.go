@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/totp"
+	"iris-gateway/users"
+)
+
+const (
+	// Issuer shown next to the account in authenticator apps.
+	totpIssuer = "IRIS"
+	// Recovery codes issued at a time.
+	recoveryCodeCount = 10
+
+	// How long a login challenge can be answered with a code.
+	loginChallengeLifetime = 5 * time.Minute
+	// Wrong codes allowed per challenge before the password must be entered again.
+	maxChallengeAttempts = 5
+)
+
+// Audit log reason for a login that failed its second factor.
+const loginReasonTwoFactor = "invalid_two_factor"
+
+// Login challenges stand between a correct password and a session token for
+// accounts with two-factor authentication. They are only kept in memory.
+var loginChallenges = struct {
+	sync.Mutex
+	m map[string]*loginChallenge
+}{m: make(map[string]*loginChallenge)}
+
+type loginChallenge struct {
+	user     *users.User
+	req      LoginRequest // The original login, for the device details and SASL password
+	expires  time.Time
+	attempts int
+}
+
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// createLoginChallenge returns a challenge token for a user whose password
+// has been checked.
+func createLoginChallenge(user *users.User, req LoginRequest) (string, error) {
+	token, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+
+	loginChallenges.Lock()
+	defer loginChallenges.Unlock()
+	now := time.Now()
+	for key, ch := range loginChallenges.m {
+		if now.After(ch.expires) {
+			delete(loginChallenges.m, key)
+		}
+	}
+	loginChallenges.m[token] = &loginChallenge{
+		user:    user,
+		req:     req,
+		expires: now.Add(loginChallengeLifetime),
+	}
+	return token, nil
+}
+
+// getLoginChallenge returns an unexpired challenge.
+func getLoginChallenge(token string) (*loginChallenge, bool) {
+	loginChallenges.Lock()
+	defer loginChallenges.Unlock()
+	ch, ok := loginChallenges.m[token]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(ch.expires) {
+		delete(loginChallenges.m, token)
+		return nil, false
+	}
+	return ch, true
+}
+
+// failLoginChallenge counts a wrong code, dropping the challenge once it has
+// had too many.
+func failLoginChallenge(token string) {
+	loginChallenges.Lock()
+	defer loginChallenges.Unlock()
+	if ch, ok := loginChallenges.m[token]; ok {
+		ch.attempts++
+		if ch.attempts >= maxChallengeAttempts {
+			delete(loginChallenges.m, token)
+		}
+	}
+}
+
+func deleteLoginChallenge(token string) {
+	loginChallenges.Lock()
+	delete(loginChallenges.m, token)
+	loginChallenges.Unlock()
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes, formatted
+// "xxxxx-xxxxx".
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+	return codes, nil
+}
+
+// checkTOTPCode validates a code against a user's enabled or pending secret
+// and records its time step so it can't be replayed.
+func checkTOTPCode(userID int, code string) bool {
+	twoFactor, err := users.GetTwoFactor(userID)
+	if err != nil {
+		log.Printf("Failed to read two-factor state for user %d: %v", userID, err)
+		return false
+	}
+	if twoFactor.Secret == "" {
+		return false
+	}
+	step, ok := totp.Validate(twoFactor.Secret, code, time.Now(), twoFactor.LastStep)
+	if !ok {
+		return false
+	}
+	if err := users.SetTOTPLastStep(userID, step); err != nil {
+		if !errors.Is(err, users.ErrTOTPCodeUsed) {
+			log.Printf("Failed to record TOTP step for user %d: %v", userID, err)
+		}
+		return false
+	}
+	return true
+}
+
+// LoginTwoFactorHandler completes a login with a TOTP or recovery code.
+// POST /api/login/2fa
+func LoginTwoFactorHandler(c *gin.Context) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid JSON"})
+		return
+	}
+	if req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Challenge token and code required"})
+		return
+	}
+
+	challenge, ok := getLoginChallenge(req.ChallengeToken)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Login challenge expired. Log in again."})
+		return
+	}
+
+	ip := c.ClientIP()
+	username := challenge.user.Username
+	wait, release := beginLoginAttempt(username, ip)
+	defer release()
+	if wait > 0 {
+		log.Printf("Two-factor login for user '%s' from %s refused: too many failed attempts", username, ip)
+		recordLoginFailure(username, ip, loginReasonLimited)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "message": "Too many failed login attempts. Try again later."})
+		return
+	}
+
+	var valid bool
+	if req.Code != "" {
+		valid = checkTOTPCode(challenge.user.ID, req.Code)
+	} else {
+		var err error
+		valid, err = users.UseRecoveryCode(challenge.user.ID, req.RecoveryCode)
+		if err != nil {
+			log.Printf("Failed to check recovery code for user %s: %v", username, err)
+		}
+		if valid {
+			log.Printf("User %s logged in with a recovery code", username)
+		}
+	}
+	if !valid {
+		log.Printf("Two-factor authentication failed for user '%s' from %s", username, ip)
+		failLoginChallenge(req.ChallengeToken)
+		recordLoginFailure(username, ip, loginReasonTwoFactor)
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid two-factor code"})
+		return
+	}
+
+	deleteLoginChallenge(req.ChallengeToken)
+	completeLogin(c, challenge.user, challenge.req)
+}
+
+// TwoFactorStatusHandler reports whether two-factor authentication is on.
+// GET /api/2fa
+func TwoFactorStatusHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	twoFactor, err := users.GetTwoFactor(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to read two-factor state for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to read two-factor status"})
+		return
+	}
+	remaining := 0
+	if twoFactor.Enabled {
+		if remaining, err = users.CountRecoveryCodes(sess.UserID); err != nil {
+			log.Printf("Failed to count recovery codes for user %s: %v", sess.Username, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":                  true,
+		"enabled":                  twoFactor.Enabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// SetupTwoFactorHandler starts enrollment with a new secret, returned along
+// with the otpauth:// URI to show as a QR code. Two-factor authentication
+// stays off until the user confirms a code from it.
+// POST /api/2fa/setup
+func SetupTwoFactorHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	twoFactor, err := users.GetTwoFactor(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to read two-factor state for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to set up two-factor authentication"})
+		return
+	}
+	if twoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err == nil {
+		err = users.SetPendingTOTPSecret(sess.UserID, secret)
+	}
+	if err != nil {
+		log.Printf("Failed to set up two-factor authentication for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to set up two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":          true,
+		"message":          "Scan the QR code, then confirm with a code to enable two-factor authentication",
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(totpIssuer, sess.Username, secret),
+	})
+}
+
+// EnableTwoFactorHandler confirms enrollment with a code from the pending
+// secret and returns the recovery codes, which are only shown once.
+// POST /api/2fa/enable
+func EnableTwoFactorHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Code required"})
+		return
+	}
+
+	twoFactor, err := users.GetTwoFactor(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to read two-factor state for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to enable two-factor authentication"})
+		return
+	}
+	if twoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": "Two-factor authentication is already enabled"})
+		return
+	}
+	if twoFactor.Secret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Start setup first"})
+		return
+	}
+
+	step, valid := totp.Validate(twoFactor.Secret, req.Code, time.Now(), twoFactor.LastStep)
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid two-factor code"})
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err == nil {
+		err = users.ReplaceRecoveryCodes(sess.UserID, codes)
+	}
+	if err == nil {
+		err = users.EnableTOTP(sess.UserID, step)
+	}
+	if err != nil {
+		log.Printf("Failed to enable two-factor authentication for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to enable two-factor authentication"})
+		return
+	}
+	log.Printf("User %s enabled two-factor authentication", sess.Username)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "Two-factor authentication enabled. Store the recovery codes somewhere safe.",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactorHandler turns off two-factor authentication. It needs the
+// password and a current code, so a stolen token alone can't remove it.
+// POST /api/2fa/disable
+func DisableTwoFactorHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.Password == "" || (req.Code == "" && req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Password and code required"})
+		return
+	}
+
+	if !verifySecondFactor(sess.UserID, sess.Username, req.Password, req.Code, req.RecoveryCode) {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid password or two-factor code"})
+		return
+	}
+
+	if err := users.DisableTOTP(sess.UserID); err != nil {
+		log.Printf("Failed to disable two-factor authentication for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to disable two-factor authentication"})
+		return
+	}
+	log.Printf("User %s disabled two-factor authentication", sess.Username)
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodesHandler replaces the recovery codes with a new set.
+// POST /api/2fa/recovery-codes
+func RegenerateRecoveryCodesHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	sess, found := lookupSession(token, c.ClientIP())
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.BindJSON(&req); err != nil || req.Password == "" || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Password and code required"})
+		return
+	}
+
+	twoFactor, err := users.GetTwoFactor(sess.UserID)
+	if err != nil || !twoFactor.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !verifySecondFactor(sess.UserID, sess.Username, req.Password, req.Code, "") {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid password or two-factor code"})
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err == nil {
+		err = users.ReplaceRecoveryCodes(sess.UserID, codes)
+	}
+	if err != nil {
+		log.Printf("Failed to regenerate recovery codes for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to regenerate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":        true,
+		"message":        "Recovery codes regenerated. The old codes no longer work.",
+		"recovery_codes": codes,
+	})
+}
+
+// verifySecondFactor checks a user's password together with a TOTP code or,
+// if no code is given, a recovery code. Accounts of an OIDC provider have no
+// password, so only the code is checked for them.
+func verifySecondFactor(userID int, username, password, code, recoveryCode string) bool {
+	if _, err := users.AuthenticateUser(username, password); err != nil && !errors.Is(err, users.ErrPasswordLoginUnsupported) {
+		return false
+	}
+	if code != "" {
+		return checkTOTPCode(userID, strings.TrimSpace(code))
+	}
+	used, err := users.UseRecoveryCode(userID, recoveryCode)
+	if err != nil {
+		log.Printf("Failed to check recovery code for user %s: %v", username, err)
+	}
+	return used
+}
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"iris-gateway/config"
+	"iris-gateway/users"
+	"iris-gateway/webhooks"
+)
+
+const (
+	// Webhooks a user may have at once.
+	maxWebhooks = 50
+	// Longest name of a webhook.
+	maxWebhookNameLength = 64
+	// Highest rate limit a webhook can be given, in posts per minute.
+	maxWebhookRateLimit = 60
+	// Largest payload a webhook accepts.
+	maxWebhookPayload = 1 << 20
+)
+
+// Posts each webhook may still make, refilled at its rate limit. They are
+// only kept in memory.
+var webhookAllowance = struct {
+	sync.Mutex
+	m map[int]*webhookBucket
+}{m: make(map[int]*webhookBucket)}
+
+type webhookBucket struct {
+	posts   float64
+	updated time.Time
+}
+
+// takeWebhookPost uses up one post of a webhook's rate limit. If none is
+// left, it returns how long until one is.
+func takeWebhookPost(hook *users.Webhook) time.Duration {
+	webhookAllowance.Lock()
+	defer webhookAllowance.Unlock()
+	now := time.Now()
+	for id, bucket := range webhookAllowance.m {
+		// Idle for a minute means full again, which is the same as absent
+		if now.Sub(bucket.updated) > time.Minute {
+			delete(webhookAllowance.m, id)
+		}
+	}
+
+	limit := float64(hook.RateLimit)
+	bucket, found := webhookAllowance.m[hook.ID]
+	if !found {
+		bucket = &webhookBucket{posts: limit, updated: now}
+		webhookAllowance.m[hook.ID] = bucket
+	}
+	bucket.posts = math.Min(limit, bucket.posts+now.Sub(bucket.updated).Minutes()*limit)
+	bucket.updated = now
+	if bucket.posts < 1 {
+		return time.Duration((1 - bucket.posts) / limit * float64(time.Minute))
+	}
+	bucket.posts--
+	return 0
+}
+
+// webhookURL is where a webhook's payloads are posted.
+func webhookURL(c *gin.Context, hookID int) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/api/hooks/%d", scheme, c.Request.Host, hookID)
+}
+
+// verifyWebhookSecret checks the secret of a webhook post. GitHub signs the
+// payload with it; other senders pass it in GitLab's X-Gitlab-Token header,
+// as a bearer token or, for those that can't set headers, in ?token=.
+func verifyWebhookSecret(c *gin.Context, secret string, body []byte) bool {
+	if signature := c.GetHeader("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+
+	given := c.GetHeader("X-Gitlab-Token")
+	if given == "" {
+		given, _ = getToken(c)
+	}
+	if given == "" {
+		given = c.Query("token")
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// ListWebhooksHandler lists the user's webhooks, without their secrets.
+// GET /api/webhooks
+func ListWebhooksHandler(c *gin.Context) {
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok {
+		return
+	}
+
+	hooks, err := users.ListWebhooks(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to list webhooks for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to list webhooks"})
+		return
+	}
+	response := []gin.H{}
+	for _, hook := range hooks {
+		if apiToken != nil && !apiToken.Allows(users.ScopeNetworksManage, hook.NetworkID, "") {
+			continue
+		}
+		response = append(response, gin.H{"webhook": hook, "url": webhookURL(c, hook.ID)})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "webhooks": response, "formats": webhooks.Formats})
+}
+
+// CreateWebhookHandler creates a webhook that posts to a channel of one of
+// the user's networks. Its secret is only shown in this response.
+// POST /api/webhooks
+func CreateWebhookHandler(c *gin.Context) {
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name      string `json:"name"`
+		NetworkID int    `json:"network_id"`
+		Channel   string `json:"channel"`
+		Format    string `json:"format"`     // One of webhooks.Formats; "auto" if empty
+		Notice    bool   `json:"notice"`     // Post as NOTICE instead of PRIVMSG
+		RateLimit int    `json:"rate_limit"` // Posts per minute; the configured default if zero
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.NetworkID == 0 || req.Channel == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Network ID and channel required"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxWebhookNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Name required, at most %d characters", maxWebhookNameLength)})
+		return
+	}
+	if !strings.ContainsAny(req.Channel[:1], "#&+!") || strings.ContainsAny(req.Channel, " ,\x07\r\n") {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid channel"})
+		return
+	}
+	if req.Format == "" {
+		req.Format = webhooks.FormatAuto
+	}
+	if !webhooks.ValidFormat(req.Format) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Format must be one of %s", strings.Join(webhooks.Formats, ", "))})
+		return
+	}
+	if req.RateLimit == 0 {
+		req.RateLimit = config.Cfg.WebhookRateLimit
+	}
+	if req.RateLimit < 1 || req.RateLimit > maxWebhookRateLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Rate limit must be between 1 and %d posts per minute", maxWebhookRateLimit)})
+		return
+	}
+	if !allowTarget(c, apiToken, users.ScopeNetworksManage, req.NetworkID, "") {
+		return
+	}
+	if _, err := users.GetSingleUserNetwork(sess.UserID, req.NetworkID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Network not found"})
+		return
+	}
+
+	count, err := users.CountWebhooks(sess.UserID)
+	if err != nil {
+		log.Printf("Failed to count webhooks for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create webhook"})
+		return
+	}
+	if count >= maxWebhooks {
+		c.JSON(http.StatusForbidden, gin.H{"success": false, "message": fmt.Sprintf("You can have at most %d webhooks", maxWebhooks)})
+		return
+	}
+
+	hook, err := users.CreateWebhook(&users.Webhook{
+		UserID:    sess.UserID,
+		Name:      req.Name,
+		NetworkID: req.NetworkID,
+		Channel:   req.Channel,
+		Format:    req.Format,
+		Notice:    req.Notice,
+		RateLimit: req.RateLimit,
+	})
+	if err != nil {
+		log.Printf("Failed to create webhook for user %s: %v", sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create webhook"})
+		return
+	}
+
+	log.Printf("User %s created webhook %d (%s) posting to %s on network %d", sess.Username, hook.ID, hook.Name, hook.Channel, hook.NetworkID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Webhook created. Store the secret now; it won't be shown again.",
+		"webhook": hook,
+		"url":     webhookURL(c, hook.ID),
+		"secret":  hook.Secret,
+	})
+}
+
+// webhookParam returns the webhook ID in the URL, after checking that an API
+// token may manage the webhook's network. It responds with an error and
+// returns false otherwise.
+func webhookParam(c *gin.Context, userID int, apiToken *users.APIToken) (int, bool) {
+	hookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid webhook ID"})
+		return 0, false
+	}
+	if apiToken == nil {
+		return hookID, true
+	}
+	hook, err := users.GetWebhook(hookID)
+	if err != nil || hook.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Webhook not found"})
+		return 0, false
+	}
+	return hookID, allowTarget(c, apiToken, users.ScopeNetworksManage, hook.NetworkID, "")
+}
+
+// RotateWebhookSecretHandler gives a webhook a new secret, shown only in this
+// response. Senders using the old secret are refused from now on.
+// POST /api/webhooks/:id/secret
+func RotateWebhookSecretHandler(c *gin.Context) {
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok {
+		return
+	}
+	hookID, ok := webhookParam(c, sess.UserID, apiToken)
+	if !ok {
+		return
+	}
+
+	secret, err := users.RotateWebhookSecret(sess.UserID, hookID)
+	if err != nil {
+		if errors.Is(err, users.ErrWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Webhook not found"})
+			return
+		}
+		log.Printf("Failed to rotate secret of webhook %d for user %s: %v", hookID, sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to rotate webhook secret"})
+		return
+	}
+
+	log.Printf("User %s rotated the secret of webhook %d", sess.Username, hookID)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "Webhook secret rotated. Store it now; it won't be shown again.",
+		"secret":  secret,
+	})
+}
+
+// DeleteWebhookHandler deletes one of the user's webhooks.
+// DELETE /api/webhooks/:id
+func DeleteWebhookHandler(c *gin.Context) {
+	sess, apiToken, ok := authorizeRequest(c, users.ScopeNetworksManage)
+	if !ok {
+		return
+	}
+	hookID, ok := webhookParam(c, sess.UserID, apiToken)
+	if !ok {
+		return
+	}
+
+	if err := users.DeleteWebhook(sess.UserID, hookID); err != nil {
+		if errors.Is(err, users.ErrWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Webhook not found"})
+			return
+		}
+		log.Printf("Failed to delete webhook %d for user %s: %v", hookID, sess.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to delete webhook"})
+		return
+	}
+
+	log.Printf("User %s deleted webhook %d", sess.Username, hookID)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Webhook deleted"})
+}
+
+// IncomingWebhookHandler posts a payload from CI, monitoring or git hosting
+// to the webhook's channel, through the user's connection to the network.
+// POST /api/hooks/:id
+func IncomingWebhookHandler(c *gin.Context) {
+	hookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Webhook not found"})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookPayload))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "message": fmt.Sprintf("Payload larger than %d bytes", maxWebhookPayload)})
+		return
+	}
+
+	// Unknown webhooks and wrong secrets get the same answer, so webhook IDs
+	// can't be probed
+	hook, err := users.GetWebhook(hookID)
+	if err != nil && !errors.Is(err, users.ErrWebhookNotFound) {
+		log.Printf("Failed to look up webhook %d: %v", hookID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to post"})
+		return
+	}
+	if err != nil || !verifyWebhookSecret(c, hook.Secret, body) {
+		log.Printf("Refused post to webhook %d from %s: unknown webhook or wrong secret", hookID, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid webhook or secret"})
+		return
+	}
+
+	lines, err := webhooks.Format(hook.Format, c.Request.Header, body, config.Cfg.WebhookMaxLines)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": err.Error()})
+		return
+	}
+	if len(lines) == 0 {
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Nothing to post"})
+		return
+	}
+
+	sess := liveSession(hook.UserID, hook.Username)
+	netConfig, found := sess.GetNetwork(hook.NetworkID)
+	if !found || netConfig.IRC == nil || !netConfig.IsConnected() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"success": false, "message": "IRC network not connected or not found"})
+		return
+	}
+
+	if wait := takeWebhookPost(hook); wait > 0 {
+		log.Printf("Refused post to webhook %d of user %s: rate limited", hook.ID, hook.Username)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "message": fmt.Sprintf("This webhook accepts at most %d posts per minute", hook.RateLimit)})
+		return
+	}
+
+	sent := sendMessageLines(sess, netConfig, hook.Channel, strings.Join(lines, "\n"), hook.Notice)
+	broadcastSentLines(sess, netConfig, hook.Channel, sent, hook.Notice)
+	if err := users.TouchWebhook(hook.ID); err != nil {
+		log.Printf("Failed to record use of webhook %d: %v", hook.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": fmt.Sprintf("Posted %d lines to %s", len(sent), hook.Channel)})
+}
@@ -5,42 +5,59 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"iris-gateway/events"
-	"iris-gateway/session"
 	"iris-gateway/irc" // Used for adding messages to history
+	"iris-gateway/session"
+	"iris-gateway/users"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins
-	},
+	CheckOrigin:     checkWebSocketOrigin,
 }
 
+// WebSocketHandler opens a client's WebSocket. The client authenticates with
+// an Authorization header, an "iris.token.<token>" or "iris.ticket.<ticket>"
+// subprotocol, a ?ticket= from /api/ws-ticket, or an "auth" event as its first
+// message. The token in the path (/ws/:token) is deprecated.
 func WebSocketHandler(c *gin.Context) {
-	token := c.Param("token")
-	sess, ok := session.GetSession(token)
-	if !ok {
-		log.Printf("[WS] Unauthorized access attempt with token: %s", token)
-		c.Writer.WriteHeader(http.StatusUnauthorized)
-		c.Writer.Write([]byte("Unauthorized: Invalid session token"))
-		return
+	token, source := wsCredentials(c)
+	var sess *session.UserSession
+	var login *users.Session
+	if source != "" {
+		var ok bool
+		sess, login, ok = lookupLogin(token, c.ClientIP())
+		if !ok {
+			log.Printf("[WS] Unauthorized access attempt from %s (%s)", c.ClientIP(), source)
+			c.Writer.WriteHeader(http.StatusUnauthorized)
+			c.Writer.Write([]byte("Unauthorized: Invalid session token"))
+			return
+		}
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, wsResponseHeader(c.Request))
 	if err != nil {
-		log.Printf("[WS] WebSocket upgrade failed for user %s (token %s): %v", sess.Username, token, err)
+		log.Printf("[WS] WebSocket upgrade failed from %s: %v", c.ClientIP(), err)
 		return
 	}
 
-	sess.AddWebSocket(conn)
-	log.Printf("[WS] WebSocket connected for user %s (token: %s). Total devices: %d", sess.Username, token, len(sess.WebSockets))
+	if sess == nil {
+		var ok bool
+		sess, login, ok = readAuthFrame(conn, c.ClientIP())
+		if !ok {
+			log.Printf("[WS] Unauthorized access attempt from %s (auth message)", c.ClientIP())
+			rejectWebSocket(conn)
+			return
+		}
+	}
+
+	sess.AddWebSocket(conn, login.ID)
+	log.Printf("[WS] WebSocket connected for user %s (session %d). Total devices: %d", sess.Username, login.ID, len(sess.WebSockets))
 
 	// If the user has reconnected and was away, send BACK to all connected networks
 	if sess.IsAway {
@@ -55,12 +72,9 @@ func WebSocketHandler(c *gin.Context) {
 	sess.Mutex.RLock()
 	for _, netConfig := range sess.Networks {
 		netConfig.Mutex.RLock() // Lock the network config for reading
-		networkInfo := map[string]interface{}{
-			"id":             netConfig.ID,
-			"network_name":   netConfig.NetworkName,
-			"is_connected":   netConfig.IsConnected,
-			"channels":       make([]map[string]interface{}, 0),
-		}
+		networkInfo := netConfig.StatusLocked() // state, is_connected, last_error, next_retry, attempts
+		networkInfo["id"] = netConfig.ID
+		networkInfo["channels"] = make([]map[string]interface{}, 0)
 		for _, ch := range netConfig.Channels {
 			ch.Mutex.RLock() // Lock the channel state for reading
 			networkInfo["channels"] = append(networkInfo["channels"].([]map[string]interface{}), map[string]interface{}{
@@ -75,6 +89,8 @@ func WebSocketHandler(c *gin.Context) {
 		initialStatePayload["networks"] = append(initialStatePayload["networks"].([]map[string]interface{}), networkInfo)
 	}
 	sess.Mutex.RUnlock()
+	// DMs and mentions received while no client was connected
+	initialStatePayload["missed_messages"] = sess.TakeMissedMessages()
 
 	sess.WsMutex.Lock()
 	err = conn.WriteJSON(events.WsEvent{
@@ -95,7 +111,7 @@ func WebSocketHandler(c *gin.Context) {
 		defer func() {
 			sess.RemoveWebSocket(conn)
 			conn.Close()
-			log.Printf("[WS] WebSocket disconnected for user %s (token: %s). Remaining devices: %d\n", sess.Username, token, len(sess.WebSockets))
+			log.Printf("[WS] WebSocket disconnected for user %s (session %d). Remaining devices: %d\n", sess.Username, login.ID, len(sess.WebSockets))
 
 			time.Sleep(2 * time.Second) // Small delay to prevent rapid away/back toggling
 
@@ -135,34 +151,14 @@ func WebSocketHandler(c *gin.Context) {
 					if idOk && channelOk && textOk {
 						networkID := int(networkIDFloat)
 						netConfig, foundNet := sess.GetNetwork(networkID)
-						if !foundNet || netConfig.IRC == nil || !netConfig.IsConnected {
+						if !foundNet || netConfig.IRC == nil || !netConfig.IsConnected() {
 							log.Printf("[WS] Cannot send message: Network %d not connected or found for user %s.", networkID, sess.Username)
 							// Optionally, send an error back to the client
 							sess.Broadcast("error", map[string]string{"message": fmt.Sprintf("Network %s is not connected.", netConfig.NetworkName), "network_id": fmt.Sprintf("%d", networkID)})
 							continue
 						}
 
-						lines := strings.Split(text, "\n")
-						for _, line := range lines {
-							ircLine := line
-							if len(ircLine) == 0 {
-								ircLine = " "
-							}
-							log.Printf("[WS] Sending IRC line to channel %s on network %s from %s: '%s'", channelName, netConfig.NetworkName, sess.Username, ircLine)
-							netConfig.IRC.Privmsg(channelName, ircLine)
-
-							// Add message to history
-							msgToStore := irc.Message{
-								NetworkID: networkID,
-								Channel:   channelName,
-								Sender:    netConfig.Nickname, // Use the user's nickname for this network
-								Text:      ircLine,
-								Timestamp: time.Now(),
-							}
-							irc.AddMessageToHistory(networkID, channelName, msgToStore)
-
-							time.Sleep(100 * time.Millisecond)
-						}
+						sendMessageLines(sess, netConfig, channelName, text, false)
 					} else {
 						log.Printf("[WS] Received malformed 'message' payload from %s: %v", sess.Username, payload)
 					}
@@ -179,12 +175,13 @@ func WebSocketHandler(c *gin.Context) {
 					if idOk && chanOk && topicOk {
 						networkID := int(networkIDFloat)
 						netConfig, foundNet := sess.GetNetwork(networkID)
-						if !foundNet || netConfig.IRC == nil || !netConfig.IsConnected {
+						if !foundNet || netConfig.IRC == nil || !netConfig.IsConnected() {
 							log.Printf("[WS] Cannot change topic: Network %d not connected or found for user %s.", networkID, sess.Username)
 							sess.Broadcast("error", map[string]string{"message": fmt.Sprintf("Network %s is not connected.", netConfig.NetworkName), "network_id": fmt.Sprintf("%d", networkID)})
 							continue
 						}
 						log.Printf("[WS] User %s sending TOPIC command for channel %s on network %s", sess.Username, channel, netConfig.NetworkName)
+						irc.TrackCommand(networkID, "TOPIC", channel)
 						netConfig.IRC.SendRaw(fmt.Sprintf("TOPIC %s :%s", channel, newTopic))
 					} else {
 						log.Printf("[WS] Received malformed 'topic_change' payload from %s: %v", sess.Username, payload)
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"iris-gateway/events"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+const (
+	// Subprotocol a client offers alongside its token protocol; the server
+	// selects it so browsers accept the handshake.
+	wsProtocol = "iris"
+	// Prefixes of the subprotocols that carry a token or ticket.
+	wsTokenProtocolPrefix  = "iris.token."
+	wsTicketProtocolPrefix = "iris.ticket."
+
+	// How long a WebSocket ticket can be redeemed.
+	wsTicketLifetime = 30 * time.Second
+	// How long a connection that authenticates with its first message has to send it.
+	wsAuthFrameTimeout = 10 * time.Second
+)
+
+// WebSocket tickets are single-use stand-ins for a login token, for browsers
+// that can't set headers on a WebSocket. They are only kept in memory.
+var wsTickets = struct {
+	sync.Mutex
+	m map[string]wsTicket
+}{m: make(map[string]wsTicket)}
+
+type wsTicket struct {
+	token   string
+	expires time.Time
+}
+
+// redeemWSTicket returns the login token a ticket stands for and invalidates it.
+func redeemWSTicket(ticket string) (string, bool) {
+	wsTickets.Lock()
+	defer wsTickets.Unlock()
+	now := time.Now()
+	for key, t := range wsTickets.m {
+		if now.After(t.expires) {
+			delete(wsTickets.m, key)
+		}
+	}
+	t, ok := wsTickets.m[ticket]
+	if !ok {
+		return "", false
+	}
+	delete(wsTickets.m, ticket)
+	return t.token, true
+}
+
+// CreateWSTicketHandler issues a one-time ticket for opening a WebSocket.
+// POST /api/ws-ticket
+func CreateWSTicketHandler(c *gin.Context) {
+	token, ok := getToken(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Missing token"})
+		return
+	}
+
+	if _, found := lookupSession(token, c.ClientIP()); !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"success": false, "message": "Invalid session"})
+		return
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("[WS] Failed to generate ticket: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to create ticket"})
+		return
+	}
+	ticket := hex.EncodeToString(raw)
+	expires := time.Now().Add(wsTicketLifetime)
+
+	wsTickets.Lock()
+	wsTickets.m[ticket] = wsTicket{token: token, expires: expires}
+	wsTickets.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"ticket":     ticket,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// wsCredentials finds the token a WebSocket request authenticates with and
+// names where it came from, for logging. The token is empty if the request
+// carries none, in which case the client may authenticate with its first
+// message. A ticket that can't be redeemed yields an empty token with a source.
+func wsCredentials(c *gin.Context) (token, source string) {
+	if token, ok := getToken(c); ok {
+		return token, "header"
+	}
+	for _, protocol := range websocket.Subprotocols(c.Request) {
+		if strings.HasPrefix(protocol, wsTokenProtocolPrefix) {
+			return strings.TrimPrefix(protocol, wsTokenProtocolPrefix), "subprotocol"
+		}
+		if strings.HasPrefix(protocol, wsTicketProtocolPrefix) {
+			token, _ := redeemWSTicket(strings.TrimPrefix(protocol, wsTicketProtocolPrefix))
+			return token, "ticket"
+		}
+	}
+	if ticket := c.Query("ticket"); ticket != "" {
+		token, _ := redeemWSTicket(ticket)
+		return token, "ticket"
+	}
+	if token := c.Param("token"); token != "" {
+		log.Printf("[WS] Client from %s put its token in the URL; /ws/:token is deprecated, use /ws", c.ClientIP())
+		return token, "path"
+	}
+	return "", ""
+}
+
+// wsResponseHeader selects the iris subprotocol if the client offered it.
+func wsResponseHeader(r *http.Request) http.Header {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == wsProtocol {
+			return http.Header{"Sec-Websocket-Protocol": {wsProtocol}}
+		}
+	}
+	return nil
+}
+
+// readAuthFrame authenticates a connection from its first message, an "auth"
+// event with the token or a ticket in its payload.
+func readAuthFrame(conn *websocket.Conn, ip string) (*session.UserSession, *users.Session, bool) {
+	conn.SetReadDeadline(time.Now().Add(wsAuthFrameTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, false
+	}
+	var frame struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Token  string `json:"token"`
+			Ticket string `json:"ticket"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(p, &frame); err != nil || frame.Type != "auth" {
+		return nil, nil, false
+	}
+
+	token := frame.Payload.Token
+	if frame.Payload.Ticket != "" {
+		token, _ = redeemWSTicket(frame.Payload.Ticket)
+	}
+	if token == "" {
+		return nil, nil, false
+	}
+	return lookupLogin(token, ip)
+}
+
+// rejectWebSocket closes a connection that failed to authenticate.
+func rejectWebSocket(conn *websocket.Conn) {
+	conn.WriteJSON(events.WsEvent{
+		Type:    "auth_error",
+		Payload: map[string]string{"message": "Unauthorized: Invalid session token"},
+	})
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"),
+		time.Now().Add(time.Second))
+	conn.Close()
+}
@@ -0,0 +1,67 @@
+package irc
+
+import (
+	"log"
+
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// awayWithoutClients is the away message used while none of a user's clients
+// are connected.
+const awayWithoutClients = "Client disconnected."
+
+// StartBouncer connects the auto-connect networks of every user who isn't
+// suspended, so their networks stay connected and their messages are kept
+// while nobody is logged in. It is called once at startup.
+func StartBouncer() {
+	activeUsers, err := users.GetActiveUsers()
+	if err != nil {
+		log.Printf("[Bouncer] Failed to load users: %v", err)
+		return
+	}
+
+	for _, user := range activeUsers {
+		userSession, created := session.GetOrCreateUserSession(user.ID, user.Username)
+		if !created {
+			continue
+		}
+		// Nobody is connected yet; AWAY is sent as each network registers.
+		userSession.Mutex.Lock()
+		userSession.IsAway = true
+		userSession.AwayMessage = awayWithoutClients
+		userSession.Mutex.Unlock()
+
+		LoadNetworks(userSession)
+	}
+	log.Printf("[Bouncer] Started sessions for %d users", len(activeUsers))
+}
+
+// LoadNetworks adds the user's networks from the database to their session and
+// connects the ones set to auto-connect. Networks already in the session are
+// left as they are.
+func LoadNetworks(userSession *session.UserSession) {
+	userNetworks, err := users.GetUserNetworks(userSession.UserID)
+	if err != nil {
+		log.Printf("[Bouncer] Error loading IRC networks for user %s: %v", userSession.Username, err)
+		return
+	}
+
+	for _, netConfig := range userNetworks {
+		userSession.Mutex.Lock()
+		if _, exists := userSession.Networks[netConfig.ID]; exists {
+			userSession.Mutex.Unlock()
+			continue
+		}
+		userSession.Networks[netConfig.ID] = netConfig
+		userSession.Mutex.Unlock()
+
+		if !netConfig.AutoReconnect {
+			continue
+		}
+		log.Printf("[Bouncer] Connecting user %s, network %s", userSession.Username, netConfig.NetworkName)
+		if err := ConnectNetwork(userSession, netConfig); err != nil {
+			log.Printf("[Bouncer] Connect failed for user %s, network %s: %v", userSession.Username, netConfig.NetworkName, err)
+		}
+	}
+}
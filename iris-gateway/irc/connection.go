@@ -0,0 +1,301 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	ircevent "github.com/thoj/go-ircevent"
+	"iris-gateway/events"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+const (
+	// Longest wait between reconnect attempts.
+	maxRetryDelay = 120 * time.Second
+	// How long a QUIT may take before the connection is closed from our side.
+	quitGracePeriod = 10 * time.Second
+)
+
+// Every change of a network's connection state goes through this file:
+//
+//	idle -> connecting -> registering -> connected
+//	connecting/registering -> backoff (auto-reconnect) or idle, on failure
+//	connected -> backoff (auto-reconnect) or idle, when the connection drops
+//	connected -> disconnecting -> idle, when the user disconnects
+//	backoff -> connecting, when the retry is due
+//	backoff -> idle, when the user cancels the retry
+
+// errQuitTimeout is the disconnect reason for a server that kept the
+// connection open after QUIT.
+var errQuitTimeout = errors.New("server did not close the connection after QUIT")
+
+// broadcastStatus sends a network's connection state to the user's clients.
+func broadcastStatus(s *session.UserSession, netConfig *session.UserNetwork) {
+	s.Broadcast(events.EventTypeNetworkStatus, netConfig.Status())
+}
+
+// setState moves a network to a new state and tells the user's clients.
+func setState(s *session.UserSession, netConfig *session.UserNetwork, state session.ConnState) {
+	netConfig.Mutex.Lock()
+	netConfig.State = state
+	netConfig.Mutex.Unlock()
+	broadcastStatus(s, netConfig)
+}
+
+// stopRetryLocked cancels a pending retry. The caller holds netConfig.Mutex.
+func stopRetryLocked(netConfig *session.UserNetwork) {
+	if netConfig.RetryTimer != nil {
+		netConfig.RetryTimer.Stop()
+		netConfig.RetryTimer = nil
+	}
+	netConfig.NextRetry = time.Time{}
+}
+
+// ConnectNetwork starts connecting a network in the background. It fails if
+// the network is already connected or a connection attempt is in progress;
+// a pending retry is replaced by an immediate attempt.
+func ConnectNetwork(s *session.UserSession, netConfig *session.UserNetwork) error {
+	connectionQuotaMutex.Lock()
+	defer connectionQuotaMutex.Unlock()
+
+	if err := checkConnectionQuota(s, netConfig); err != nil {
+		// A retry that is refused leaves nothing pending.
+		netConfig.Mutex.Lock()
+		if netConfig.State == session.StateBackoff {
+			stopRetryLocked(netConfig)
+			netConfig.State = session.StateIdle
+			netConfig.LastError = err.Error()
+		}
+		netConfig.Mutex.Unlock()
+		broadcastStatus(s, netConfig)
+		return err
+	}
+
+	netConfig.Mutex.Lock()
+	switch netConfig.State {
+	case session.StateConnecting, session.StateRegistering, session.StateConnected, session.StateDisconnecting:
+		state := netConfig.State
+		netConfig.Mutex.Unlock()
+		return fmt.Errorf("network %s is %s", netConfig.NetworkName, state)
+	}
+	stopRetryLocked(netConfig)
+	netConfig.State = session.StateConnecting
+	SetHistoryRetention(netConfig.ID, users.GetQuota(s.UserID).HistoryRetention)
+	// Saved and initial channels are rejoined on connect.
+	netConfig.Channels = make(map[string]*session.ChannelState)
+	netConfig.Mutex.Unlock()
+	broadcastStatus(s, netConfig)
+
+	go func() {
+		log.Printf("[IRC] User %s, Network %s: Connecting", s.Username, netConfig.NetworkName)
+		if _, err := establishConnection(s, netConfig); err != nil {
+			connectFailed(s, netConfig, err)
+		}
+	}()
+	return nil
+}
+
+// DisconnectNetwork disconnects a network, or cancels its pending retry. It
+// returns false if the network was neither connected nor trying to connect.
+func DisconnectNetwork(s *session.UserSession, netConfig *session.UserNetwork) bool {
+	netConfig.Mutex.Lock()
+	switch netConfig.State {
+	case "", session.StateIdle:
+		netConfig.Mutex.Unlock()
+		return false
+	case session.StateBackoff:
+		stopRetryLocked(netConfig)
+		netConfig.State = session.StateIdle
+		netConfig.Mutex.Unlock()
+		broadcastStatus(s, netConfig)
+		return true
+	case session.StateDisconnecting:
+		netConfig.RestartPending = false
+		netConfig.Mutex.Unlock()
+		return true
+	}
+
+	// Connecting or registering attempts notice this state when they finish.
+	netConfig.State = session.StateDisconnecting
+	netConfig.RestartPending = false
+	conn := netConfig.IRC
+	netConfig.Mutex.Unlock()
+	broadcastStatus(s, netConfig)
+
+	if conn != nil {
+		quitConnection(netConfig, conn)
+	}
+	return true
+}
+
+// RestartNetwork reconnects a network so changed settings take effect. An
+// idle network is left alone.
+func RestartNetwork(s *session.UserSession, netConfig *session.UserNetwork) {
+	netConfig.Mutex.Lock()
+	switch netConfig.State {
+	case "", session.StateIdle:
+		netConfig.Mutex.Unlock()
+		return
+	case session.StateBackoff:
+		netConfig.Mutex.Unlock()
+		if err := ConnectNetwork(s, netConfig); err != nil {
+			log.Printf("[IRC] Network %s: Restart failed: %v", netConfig.NetworkName, err)
+		}
+		return
+	case session.StateDisconnecting:
+		netConfig.RestartPending = true
+		netConfig.Mutex.Unlock()
+		return
+	}
+
+	log.Printf("[IRC] User %s, Network %s: Reconnecting to apply new settings", s.Username, netConfig.NetworkName)
+	netConfig.State = session.StateDisconnecting
+	netConfig.RestartPending = true
+	conn := netConfig.IRC
+	netConfig.Mutex.Unlock()
+	broadcastStatus(s, netConfig)
+
+	if conn != nil {
+		quitConnection(netConfig, conn)
+	}
+}
+
+// CancelRetry cancels a network's pending retry. It returns false if no
+// retry was pending.
+func CancelRetry(s *session.UserSession, netConfig *session.UserNetwork) bool {
+	netConfig.Mutex.Lock()
+	if netConfig.State != session.StateBackoff {
+		netConfig.Mutex.Unlock()
+		return false
+	}
+	stopRetryLocked(netConfig)
+	netConfig.State = session.StateIdle
+	netConfig.Mutex.Unlock()
+
+	log.Printf("[IRC] User %s, Network %s: Retry cancelled", s.Username, netConfig.NetworkName)
+	broadcastStatus(s, netConfig)
+	return true
+}
+
+// quitConnection sends QUIT and closes the connection from our side if the
+// server hasn't closed it after quitGracePeriod.
+func quitConnection(netConfig *session.UserNetwork, conn *ircevent.Connection) {
+	conn.Quit()
+	time.AfterFunc(quitGracePeriod, func() {
+		netConfig.Mutex.RLock()
+		stillOpen := netConfig.IRC == conn
+		netConfig.Mutex.RUnlock()
+		if stillOpen {
+			log.Printf("[IRC] Network %s: Server did not close the connection after QUIT, closing it", netConfig.NetworkName)
+			conn.Abort(errQuitTimeout)
+		}
+	})
+}
+
+// connectFailed handles a connection attempt that ended without registering.
+func connectFailed(s *session.UserSession, netConfig *session.UserNetwork, err error) {
+	log.Printf("[IRC] User %s, Network %s: Connection attempt failed: %v", s.Username, netConfig.NetworkName, err)
+	s.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
+		"network_id":   netConfig.ID,
+		"network_name": netConfig.NetworkName,
+		"status":       "failed",
+		"reason":       err.Error(),
+	})
+
+	netConfig.Mutex.Lock()
+	netConfig.LastError = err.Error()
+	wasStopped := netConfig.State == session.StateDisconnecting
+	restart := netConfig.RestartPending
+	netConfig.RestartPending = false
+	netConfig.Mutex.Unlock()
+
+	switch {
+	case restart:
+		setState(s, netConfig, session.StateIdle)
+		if err := ConnectNetwork(s, netConfig); err != nil {
+			log.Printf("[IRC] Network %s: Restart failed: %v", netConfig.NetworkName, err)
+		}
+	case wasStopped || !netConfig.AutoReconnect:
+		setState(s, netConfig, session.StateIdle)
+	default:
+		scheduleRetry(s, netConfig)
+	}
+}
+
+// connectionClosed handles the end of a registered connection.
+func connectionClosed(s *session.UserSession, netConfig *session.UserNetwork, conn *ircevent.Connection, reason string) {
+	netConfig.Mutex.Lock()
+	if netConfig.IRC != conn {
+		// A connection that never registered, or one already replaced.
+		netConfig.Mutex.Unlock()
+		return
+	}
+	netConfig.IRC = nil
+	netConfig.Lag = 0
+	requested := netConfig.State == session.StateDisconnecting
+	restart := netConfig.RestartPending
+	netConfig.RestartPending = false
+	if !requested {
+		netConfig.LastError = fmt.Sprintf("connection lost: %s", reason)
+	}
+	netConfig.Mutex.Unlock()
+
+	log.Printf("[IRC] User %s, Network %s: Disconnected from IRC: %s", s.Username, netConfig.NetworkName, reason)
+	s.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
+		"network_id":   netConfig.ID,
+		"network_name": netConfig.NetworkName,
+		"status":       "disconnected",
+		"reason":       reason,
+	})
+
+	switch {
+	case restart:
+		setState(s, netConfig, session.StateIdle)
+		if err := ConnectNetwork(s, netConfig); err != nil {
+			log.Printf("[IRC] Network %s: Restart failed: %v", netConfig.NetworkName, err)
+		}
+	case requested || !netConfig.AutoReconnect:
+		setState(s, netConfig, session.StateIdle)
+	default:
+		scheduleRetry(s, netConfig)
+	}
+}
+
+// scheduleRetry puts a network into backoff with an exponentially growing delay.
+func scheduleRetry(s *session.UserSession, netConfig *session.UserNetwork) {
+	netConfig.Mutex.Lock()
+	stopRetryLocked(netConfig)
+	netConfig.Attempts++
+	delay := retryDelay(netConfig.Attempts)
+	netConfig.State = session.StateBackoff
+	netConfig.NextRetry = time.Now().Add(delay)
+	netConfig.RetryTimer = time.AfterFunc(delay, func() {
+		netConfig.Mutex.Lock()
+		due := netConfig.State == session.StateBackoff
+		netConfig.RetryTimer = nil
+		netConfig.Mutex.Unlock()
+		if !due {
+			return
+		}
+		if err := ConnectNetwork(s, netConfig); err != nil {
+			log.Printf("[IRC] Network %s: Retry not started: %v", netConfig.NetworkName, err)
+		}
+	})
+	attempts := netConfig.Attempts
+	netConfig.Mutex.Unlock()
+
+	log.Printf("[IRC] Scheduling reconnect for %s in %v (attempt %d)", netConfig.NetworkName, delay, attempts)
+	broadcastStatus(s, netConfig)
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(math.Pow(2, float64(attempts))) * time.Second
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,154 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"iris-gateway/session"
+)
+
+// How long dialing the server (or proxy) may take.
+const dialTimeout = 30 * time.Second
+
+// dialNetwork maps a network's address family preference to a Go network name.
+func dialNetwork(addressFamily string) (string, error) {
+	switch addressFamily {
+	case "":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("unknown address family %q", addressFamily)
+}
+
+// buildDialer returns the dial function for a network, honouring its proxy,
+// bind address and address family settings. With a proxy, the bind address
+// and address family apply to the connection to the proxy.
+func buildDialer(netConfig *session.UserNetwork) (func(network, addr string) (net.Conn, error), error) {
+	family, err := dialNetwork(netConfig.AddressFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &net.Dialer{Timeout: dialTimeout}
+	if netConfig.BindAddress != "" {
+		ip := net.ParseIP(netConfig.BindAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %q", netConfig.BindAddress)
+		}
+		base.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if netConfig.ProxyURL == "" {
+		return func(_, addr string) (net.Conn, error) {
+			return base.Dial(family, addr)
+		}, nil
+	}
+
+	proxyURL, err := url.Parse(netConfig.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	// The password is stored apart from the URL
+	if proxyURL.User != nil && netConfig.ProxyPassword != "" {
+		proxyURL.User = url.UserPassword(proxyURL.User.Username(), netConfig.ProxyPassword)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5(family, proxyURL.Host, auth, base)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOCKS5 proxy: %w", err)
+		}
+		return func(_, addr string) (net.Conn, error) {
+			conn, err := socks.Dial("tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("SOCKS5 proxy %s: %w", proxyURL.Host, err)
+			}
+			return conn, nil
+		}, nil
+	case "http", "https":
+		return func(_, addr string) (net.Conn, error) {
+			return dialHTTPConnect(base, family, proxyURL, addr)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialHTTPConnect opens a tunnel to addr through an HTTP proxy using CONNECT.
+func dialHTTPConnect(base *net.Dialer, family string, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	conn, err := base.Dial(family, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy %s: %w", proxyAddr, err)
+	}
+	// The TLS handshake and CONNECT must finish in time too.
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("HTTP proxy %s: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy %s refused CONNECT: %s", proxyAddr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The server may speak first, so keep anything read past the response.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,164 @@
+package irc
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	ircevent "github.com/thoj/go-ircevent"
+	"iris-gateway/events"
+	"iris-gateway/session"
+)
+
+// numericError describes an IRC error numeric we surface to clients, along with
+// the commands that can cause it (most likely first).
+type numericError struct {
+	Name     string
+	Commands []string
+}
+
+var errorNumerics = map[string]numericError{
+	"401": {"ERR_NOSUCHNICK", []string{"PRIVMSG", "NOTICE", "WHOIS", "INVITE", "MODE"}},
+	"403": {"ERR_NOSUCHCHANNEL", []string{"JOIN", "PART", "TOPIC", "NAMES"}},
+	"404": {"ERR_CANNOTSENDTOCHAN", []string{"PRIVMSG", "NOTICE"}},
+	"405": {"ERR_TOOMANYCHANNELS", []string{"JOIN"}},
+	"442": {"ERR_NOTONCHANNEL", []string{"PART", "TOPIC", "INVITE", "KICK"}},
+	"471": {"ERR_CHANNELISFULL", []string{"JOIN"}},
+	"473": {"ERR_INVITEONLYCHAN", []string{"JOIN"}},
+	"474": {"ERR_BANNEDFROMCHAN", []string{"JOIN"}},
+	"475": {"ERR_BADCHANNELKEY", []string{"JOIN"}},
+	"476": {"ERR_BADCHANMASK", []string{"JOIN"}},
+	"477": {"ERR_NEEDREGGEDNICK", []string{"JOIN", "PRIVMSG"}},
+	"482": {"ERR_CHANOPRIVSNEEDED", []string{"TOPIC", "MODE", "KICK", "INVITE"}},
+}
+
+// saslNumerics are the SASL replies reported as errors, with their severity.
+// They arrive during registration, in answer to AUTHENTICATE.
+var saslNumerics = map[string]struct{ Name, Severity string }{
+	"902": {"ERR_NICKLOCKED", "error"},
+	"904": {"ERR_SASLFAIL", "error"},
+	"905": {"ERR_SASLTOOLONG", "error"},
+	"906": {"ERR_SASLABORTED", "error"},
+	"907": {"ERR_SASLALREADY", "warning"},
+	"908": {"RPL_SASLMECHS", "error"},
+}
+
+// How long a sent command is remembered for matching against an error reply.
+const commandTrackingWindow = 30 * time.Second
+
+// sentCommands stores when a command was last sent to a target.
+// Key is "networkID_target_COMMAND" (e.g., "1_#general_PRIVMSG").
+var sentCommands = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// TrackCommand records that a command was sent to a target on a network so that
+// a later error reply for the same target can be tied back to it.
+func TrackCommand(networkID int, command, target string) {
+	key := fmt.Sprintf("%d_%s_%s", networkID, strings.ToLower(target), strings.ToUpper(command))
+	now := time.Now()
+
+	sentCommands.Lock()
+	defer sentCommands.Unlock()
+	sentCommands.m[key] = now
+
+	// Opportunistically drop entries that can no longer be matched.
+	for k, sentAt := range sentCommands.m {
+		if now.Sub(sentAt) > commandTrackingWindow {
+			delete(sentCommands.m, k)
+		}
+	}
+}
+
+// lookupCommand returns the most recently sent of the candidate commands for a
+// target, or an empty string if none was sent within the tracking window.
+func lookupCommand(networkID int, target string, candidates []string) string {
+	sentCommands.Lock()
+	defer sentCommands.Unlock()
+
+	best := ""
+	var bestAt time.Time
+	for _, command := range candidates {
+		key := fmt.Sprintf("%d_%s_%s", networkID, strings.ToLower(target), command)
+		sentAt, ok := sentCommands.m[key]
+		if !ok || time.Since(sentAt) > commandTrackingWindow {
+			continue
+		}
+		if best == "" || sentAt.After(bestAt) {
+			best = command
+			bestAt = sentAt
+		}
+	}
+	return best
+}
+
+// addErrorHandlers registers callbacks that turn error numerics and IRCv3
+// standard replies (FAIL/WARN) into irc_error events for the user's clients.
+func addErrorHandlers(irc *IRCClientWrapper) {
+	s := irc.UserSession
+	netConfig := irc.NetworkConfig
+
+	for code, info := range errorNumerics {
+		irc.AddCallback(code, func(e *ircevent.Event) {
+			// Format: <our nick> <target> :<text>
+			target := ""
+			if len(e.Arguments) >= 3 {
+				target = e.Arguments[1]
+			}
+			command := lookupCommand(netConfig.ID, target, info.Commands)
+			log.Printf("[IRC] User %s, Network %s: Received %s (%s) for %s: %s", s.Username, netConfig.NetworkName, code, info.Name, target, e.Message())
+			if command == "JOIN" {
+				resolvePendingJoin(netConfig.ID, target, fmt.Errorf("%s (%s)", e.Message(), code))
+			}
+			broadcastIRCError(s, netConfig, "error", code, info.Name, command, target, e.Message())
+		})
+	}
+
+	for code, info := range saslNumerics {
+		irc.AddCallback(code, func(e *ircevent.Event) {
+			text := e.Message()
+			if code == "908" && len(e.Arguments) >= 3 {
+				// Format: <nick> <mechanisms> :are available SASL mechanisms
+				text = fmt.Sprintf("%s: %s", text, e.Arguments[1])
+			}
+			log.Printf("[IRC] User %s, Network %s: Received %s (%s): %s", s.Username, netConfig.NetworkName, code, info.Name, text)
+			broadcastIRCError(s, netConfig, info.Severity, code, info.Name, "AUTHENTICATE", "", text)
+		})
+	}
+
+	standardReply := func(severity string) func(e *ircevent.Event) {
+		return func(e *ircevent.Event) {
+			// Format: <command> <code> [<context>...] :<description>
+			if len(e.Arguments) < 3 {
+				return
+			}
+			command := e.Arguments[0]
+			code := e.Arguments[1]
+			target := ""
+			if len(e.Arguments) > 3 {
+				target = e.Arguments[2]
+			}
+			log.Printf("[IRC] User %s, Network %s: Received %s %s %s: %s", s.Username, netConfig.NetworkName, e.Code, command, code, e.Message())
+			broadcastIRCError(s, netConfig, severity, code, "", command, target, e.Message())
+		}
+	}
+	irc.AddCallback("FAIL", standardReply("error"))
+	irc.AddCallback("WARN", standardReply("warning"))
+}
+
+func broadcastIRCError(s *session.UserSession, netConfig *session.UserNetwork, severity, code, name, command, target, text string) {
+	s.Broadcast(events.EventTypeIRCError, map[string]interface{}{
+		"network_id":   netConfig.ID,
+		"network_name": netConfig.NetworkName,
+		"severity":     severity,
+		"code":         code,
+		"name":         name,
+		"command":      command,
+		"target":       target,
+		"text":         text,
+		"time":         time.Now().UTC().Format(time.RFC3339),
+	})
+}
@@ -30,6 +30,34 @@ var historyMapMutex sync.RWMutex
 // Global history duration (can be moved to config if needed)
 var historyDuration = 7 * 24 * time.Hour // Default 7 days
 
+// Retention of networks whose owner's quota differs from historyDuration,
+// keyed by network ID
+var networkRetention = make(map[int]time.Duration)
+var networkRetentionMutex sync.RWMutex
+
+// SetHistoryRetention sets how long a network's history is kept, from its
+// owner's quota.
+func SetHistoryRetention(networkID int, retention time.Duration) {
+	networkRetentionMutex.Lock()
+	defer networkRetentionMutex.Unlock()
+	if retention <= 0 || retention == historyDuration {
+		delete(networkRetention, networkID)
+		return
+	}
+	networkRetention[networkID] = retention
+}
+
+// historyCutoff returns the time before which a network's messages are dropped.
+func historyCutoff(networkID int) time.Time {
+	networkRetentionMutex.RLock()
+	retention, ok := networkRetention[networkID]
+	networkRetentionMutex.RUnlock()
+	if !ok {
+		retention = historyDuration
+	}
+	return time.Now().Add(-retention)
+}
+
 func InitHistory(duration string) {
 	parsedDuration, err := time.ParseDuration(duration)
 	if err != nil {
@@ -61,7 +89,7 @@ func AddMessageToHistory(networkID int, channel string, message Message) {
 	chHistory.Messages = append(chHistory.Messages, message)
 
 	// Clean up old messages
-	cutoff := time.Now().Add(-historyDuration)
+	cutoff := historyCutoff(networkID)
 	var firstValidIndex = -1
 	for i, msg := range chHistory.Messages {
 		if msg.Timestamp.After(cutoff) {
@@ -93,21 +121,28 @@ func GetChannelHistory(networkID int, channel string, limit int) []Message {
 	chHistory.mutex.RLock()
 	defer chHistory.mutex.RUnlock()
 
-	if len(chHistory.Messages) == 0 {
+	// Messages are only pruned as new ones arrive, so skip any past retention
+	cutoff := historyCutoff(networkID)
+	messages := chHistory.Messages
+	for len(messages) > 0 && !messages[0].Timestamp.After(cutoff) {
+		messages = messages[1:]
+	}
+
+	if len(messages) == 0 {
 		log.Printf("[History] Network %d, channel %s history is empty", networkID, channelKey)
 		return nil
 	}
 
-	if limit <= 0 || limit >= len(chHistory.Messages) {
+	if limit <= 0 || limit >= len(messages) {
 		// Return a copy to avoid race conditions on the slice
-		messagesCopy := make([]Message, len(chHistory.Messages))
-		copy(messagesCopy, chHistory.Messages)
+		messagesCopy := make([]Message, len(messages))
+		copy(messagesCopy, messages)
 		return messagesCopy
 	}
 
 	// Return a copy of the slice segment (most recent 'limit' messages)
-	start := len(chHistory.Messages) - limit
+	start := len(messages) - limit
 	messagesCopy := make([]Message, limit)
-	copy(messagesCopy, chHistory.Messages[start:])
+	copy(messagesCopy, messages[start:])
 	return messagesCopy
 }
\ No newline at end of file
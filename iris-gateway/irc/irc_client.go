@@ -1,11 +1,12 @@
 package irc
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
-	"math"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"iris-gateway/events"
 	"iris-gateway/push"
 	"iris-gateway/session"
+	"iris-gateway/users"
 )
 
 // IRCClientWrapper wraps ircevent.Connection and adds session/network context.
@@ -20,34 +22,78 @@ type IRCClientWrapper struct {
 	*ircevent.Connection
 	UserSession   *session.UserSession
 	NetworkConfig *session.UserNetwork
+
+	abandoned bool // Given up on before registering; guarded by NetworkConfig.Mutex
+}
+
+// abandon gives up on a connection that hasn't registered and closes it, so
+// a late 001 can't take over the network. It returns false if the connection
+// registered after all.
+func (irc *IRCClientWrapper) abandon(err error) bool {
+	netConfig := irc.NetworkConfig
+	netConfig.Mutex.Lock()
+	registered := netConfig.IRC == irc.Connection
+	if !registered {
+		irc.abandoned = true
+	}
+	netConfig.Mutex.Unlock()
+	if registered {
+		return false
+	}
+	irc.Abort(err)
+	return true
 }
 
-// EstablishIRCConnection establishes an IRC connection for a specific UserNetwork.
-// It returns an IRCClientWrapper and any error.
-func EstablishIRCConnection(
+// establishConnection connects a network, failing over through its servers.
+// Callers go through ConnectNetwork, which owns the connection state.
+func establishConnection(
 	userSession *session.UserSession,
 	netConfig *session.UserNetwork,
-	clientIP string,
 ) (*IRCClientWrapper, error) {
-	// --- BEGIN GATEKEEPER LOGIC ---
-	netConfig.Mutex.Lock()
-	if netConfig.IsConnecting || netConfig.ReconnectTimer != nil {
-		netConfig.Mutex.Unlock()
-		log.Printf("[IRC] Network %s: Aborting connection attempt, another one is already in progress.", netConfig.NetworkName)
-		return nil, fmt.Errorf("connection attempt already in progress for network %s", netConfig.NetworkName)
+	// Start with the server that last worked and fail over through the rest.
+	servers := netConfig.ServerList()
+	netConfig.Mutex.RLock()
+	start := netConfig.ServerIndex
+	netConfig.Mutex.RUnlock()
+	if start < 0 || start >= len(servers) {
+		start = 0
 	}
-	netConfig.IsConnecting = true
-	netConfig.Mutex.Unlock()
 
-	defer func() {
-		netConfig.Mutex.Lock()
-		netConfig.IsConnecting = false
-		netConfig.Mutex.Unlock()
-		log.Printf("[IRC] Network %s: Connection attempt has finished.", netConfig.NetworkName)
-	}()
-	// --- END GATEKEEPER LOGIC ---
+	var lastErr error
+	for i := range servers {
+		index := (start + i) % len(servers)
+		if !setAttemptState(userSession, netConfig, session.StateConnecting) {
+			return nil, errConnectionCancelled
+		}
+		ircWrapper, err := connectToServer(userSession, netConfig, index, servers[index])
+		if err == nil {
+			if index != start {
+				if err := users.SetNetworkServerIndex(netConfig.ID, index); err != nil {
+					log.Printf("[IRC] Network %s: Failed to save last server: %v", netConfig.NetworkName, err)
+				}
+			}
+			netConfig.Mutex.Lock()
+			netConfig.ServerIndex = index
+			netConfig.Mutex.Unlock()
+			return ircWrapper, nil
+		}
+		lastErr = err
+		if len(servers) > 1 {
+			log.Printf("[IRC] Network %s: Server %s:%d failed: %v", netConfig.NetworkName, servers[index].Hostname, servers[index].Port, err)
+		}
+	}
+	return nil, lastErr
+}
 
-	ircServerAddr := fmt.Sprintf("%s:%d", netConfig.Hostname, netConfig.Port)
+// connectToServer connects a network to one of its servers and performs the
+// post-registration setup (perform commands, channel joins).
+func connectToServer(
+	userSession *session.UserSession,
+	netConfig *session.UserNetwork,
+	index int,
+	server session.NetworkServer,
+) (*IRCClientWrapper, error) {
+	ircServerAddr := net.JoinHostPort(server.Hostname, strconv.Itoa(server.Port))
 
 	// Ensure ident is not empty.
 	ident := netConfig.Ident
@@ -58,14 +104,32 @@ func EstablishIRCConnection(
 
 	ircClient := ircevent.IRC(netConfig.Nickname, ident)
 	ircClient.RealName = netConfig.Realname
-	ircClient.UseTLS = netConfig.UseSSL
+	ircClient.UseTLS = server.UseSSL
+
+	dial, err := buildDialer(netConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection settings for network %s: %w", netConfig.NetworkName, err)
+	}
+	ircClient.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err == nil {
+			setAttemptState(userSession, netConfig, session.StateRegistering)
+		}
+		return conn, err
+	}
+	// Reconnecting is left to the connection state machine.
+	ircClient.NoReconnect = true
+	if netConfig.ProxyURL != "" {
+		log.Printf("[IRC] Network %s: Connecting through proxy", netConfig.NetworkName)
+	}
 
 	if ircClient.UseTLS {
-		ircClient.TLSConfig = &tls.Config{
-			ServerName: netConfig.Hostname,
-			MinVersion: tls.VersionTLS12,
+		tlsConfig, err := buildTLSConfig(userSession, netConfig, index, server)
+		if err != nil {
+			return nil, err
 		}
-		log.Printf("[IRC] Network %s: TLS enabled with SNI for host '%s'", netConfig.NetworkName, netConfig.Hostname)
+		ircClient.TLSConfig = tlsConfig
+		log.Printf("[IRC] Network %s: TLS enabled with SNI for host '%s'", netConfig.NetworkName, server.Hostname)
 	}
 
 	ircClient.VerboseCallbackHandler = false
@@ -75,7 +139,6 @@ func EstablishIRCConnection(
 		"server-time",
 		"away-notify",
 		"multi-prefix",
-		"sasl",
 		"draft/chathistory",
 		"draft/event-playback",
 	}
@@ -90,27 +153,8 @@ func EstablishIRCConnection(
 
 	addIRCEventHandlers(ircWrapper, connectionDone)
 
-	hasSASLModule := false
-	for _, module := range netConfig.Modules {
-		if strings.ToLower(module) == "sasl" {
-			hasSASLModule = true
-			break
-		}
-	}
-
-	if hasSASLModule && netConfig.ServerPassword != "" {
-		ircClient.UseSASL = true
-		ircClient.SASLLogin = netConfig.Nickname
-		ircClient.SASLPassword = netConfig.ServerPassword
-		log.Printf("[IRC] Network %s: SASL enabled with login %s", netConfig.NetworkName, ircClient.SASLLogin)
-		ircClient.AddCallback("904", func(e *ircevent.Event) {
-			connectionDone <- fmt.Errorf("SASL authentication failed (904): %s", e.Message())
-		})
-		ircClient.AddCallback("905", func(e *ircevent.Event) {
-			connectionDone <- fmt.Errorf("SASL authentication aborted (905): %s", e.Message())
-		})
-	} else {
-		ircClient.Password = netConfig.ServerPassword
+	if err := configureSASL(ircClient, netConfig, server.Password); err != nil {
+		return nil, err
 	}
 
 	log.Printf("[IRC] User %s, Network %s: Attempting to connect to %s...", userSession.Username, netConfig.NetworkName, ircServerAddr)
@@ -123,42 +167,135 @@ func EstablishIRCConnection(
 	select {
 	case err := <-connectionDone:
 		if err != nil {
-			ircClient.Quit()
+			ircWrapper.abandon(err)
 			return nil, err
 		}
 	case <-time.After(40 * time.Second):
-		ircClient.Quit()
-		return nil, fmt.Errorf("authentication/connection timed out for %s on network %s", netConfig.Nickname, netConfig.NetworkName)
+		err := fmt.Errorf("authentication/connection timed out for %s on network %s", netConfig.Nickname, netConfig.NetworkName)
+		if ircWrapper.abandon(err) {
+			return nil, err
+		}
+		// Registered just as the attempt timed out.
 	}
 
+	// Channels joined by perform commands count against the channel limit
+	// too; channels over it are left out.
+	budget := channelBudget(userSession, netConfig)
 	for _, cmd := range netConfig.PerformCommands {
+		cmd, joined := limitJoinCommand(cmd, budget)
+		if cmd == "" {
+			log.Printf("[IRC] Network %s: Skipping perform command, channel limit reached", netConfig.NetworkName)
+			continue
+		}
+		if budget >= 0 {
+			budget -= joined
+		}
 		log.Printf("[IRC] Network %s: Executing perform command: %s", netConfig.NetworkName, cmd)
 		ircClient.SendRaw(cmd)
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	for _, channel := range netConfig.InitialChannels {
-		log.Printf("[IRC] Network %s: Joining initial channel: %s", netConfig.NetworkName, channel)
-		ircClient.Join(channel)
+	channels := channelsToJoin(netConfig)
+	if budget >= 0 && len(channels) > budget {
+		log.Printf("[IRC] Network %s: Channel limit reached, not joining %d of %d channels", netConfig.NetworkName, len(channels)-budget, len(channels))
+		channels = channels[:budget]
+	}
+	for _, entry := range channels {
+		channel, key := session.ParseChannelEntry(entry)
+		log.Printf("[IRC] Network %s: Joining channel: %s", netConfig.NetworkName, channel)
+		JoinChannel(ircClient, netConfig.ID, channel, key)
 		time.Sleep(150 * time.Millisecond)
 	}
 
 	return ircWrapper, nil
 }
 
+// channelsToJoin merges the network's initial channels with the channels saved
+// from earlier sessions. A key given in the initial channels takes precedence.
+func channelsToJoin(netConfig *session.UserNetwork) []string {
+	saved, err := users.GetNetworkChannels(netConfig.ID)
+	if err != nil {
+		log.Printf("[IRC] Network %s: Failed to load saved channels: %v", netConfig.NetworkName, err)
+	}
+
+	seen := make(map[string]bool)
+	entries := make([]string, 0, len(netConfig.InitialChannels)+len(saved))
+	for _, entry := range append(append([]string{}, netConfig.InitialChannels...), saved...) {
+		channel, _ := session.ParseChannelEntry(entry)
+		if channel == "" || seen[strings.ToLower(channel)] {
+			continue
+		}
+		seen[strings.ToLower(channel)] = true
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// errConnectionCancelled is returned when the user disconnects a network
+// while it is still connecting.
+var errConnectionCancelled = errors.New("connection cancelled")
+
+// setAttemptState moves a network that is connecting or registering to the
+// given state. It returns false if the attempt has been cancelled.
+func setAttemptState(s *session.UserSession, netConfig *session.UserNetwork, state session.ConnState) bool {
+	netConfig.Mutex.Lock()
+	if netConfig.State == session.StateDisconnecting {
+		netConfig.Mutex.Unlock()
+		return false
+	}
+	changed := netConfig.State != state
+	netConfig.State = state
+	netConfig.Mutex.Unlock()
+	if changed {
+		broadcastStatus(s, netConfig)
+	}
+	return true
+}
+
 // addIRCEventHandlers sets up callbacks for a given IRCClientWrapper.
 func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 	s := irc.UserSession
 	netConfig := irc.NetworkConfig
+	lag := newLagMonitor()
+
+	// Whether SASL logged in, whichever way it was configured: 903 is a
+	// successful login and 907 means already logged in. Both arrive before
+	// 001, on the same read loop.
+	saslLoggedIn := false
+	for _, code := range []string{"903", "907"} {
+		irc.AddCallback(code, func(e *ircevent.Event) {
+			saslLoggedIn = true
+		})
+	}
 
 	irc.AddCallback("001", func(e *ircevent.Event) {
 		log.Printf("[IRC] User %s, Network %s: Successfully connected to IRC server (001).", s.Username, netConfig.NetworkName)
 		netConfig.Mutex.Lock()
-		netConfig.IsConnected = true
-		netConfig.ReconnectAttempts = 0
+		attempting := netConfig.State == session.StateConnecting || netConfig.State == session.StateRegistering
+		if irc.abandoned || !(attempting || netConfig.State == session.StateDisconnecting) {
+			// A connection given up on after a timeout: the network has moved
+			// on to another server, a retry or another connection.
+			netConfig.Mutex.Unlock()
+			log.Printf("[IRC] User %s, Network %s: Ignoring 001 from an abandoned connection", s.Username, netConfig.NetworkName)
+			return
+		}
+		if netConfig.State == session.StateDisconnecting {
+			// Disconnected by the user while registering.
+			netConfig.Mutex.Unlock()
+			select {
+			case connectionDone <- errConnectionCancelled:
+			default:
+			}
+			return
+		}
+		netConfig.IRC = irc.Connection
+		netConfig.State = session.StateConnected
+		netConfig.Attempts = 0
+		netConfig.LastError = ""
+		netConfig.Lag = 0
 		netConfig.Mutex.Unlock()
-
-		irc.SendRaw("CAP END")
+		broadcastStatus(s, netConfig)
+		go lag.run(s, netConfig, irc.Connection)
 
 		select {
 		case connectionDone <- nil:
@@ -172,9 +309,24 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 			"nickname":     e.Arguments[0],
 		})
 
+		// Identify with NickServ unless SASL already logged in.
+		if netConfig.NickServPassword != "" && !saslLoggedIn {
+			irc.Privmsg("NickServ", "IDENTIFY "+netConfig.NickServPassword)
+		}
+
+		// Keep the user away while none of their clients are connected.
+		s.Mutex.RLock()
+		isAway, awayMessage := s.IsAway, s.AwayMessage
+		s.Mutex.RUnlock()
+		if isAway {
+			irc.SendRawf("AWAY :%s", awayMessage)
+		}
+
 		irc.SendRaw("LIST")
 	})
 
+	addErrorHandlers(irc)
+
 	// --- START FIX: Robust BATCH Parsing ---
 	irc.AddCallback("BATCH", func(e *ircevent.Event) {
 		if len(e.Arguments) < 3 || e.Arguments[1] != "chathistory-messages" {
@@ -246,7 +398,11 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 		currentNick := irc.GetNick()
 		if strings.EqualFold(joiningUser, netConfig.Nickname) || strings.EqualFold(joiningUser, currentNick) {
 			log.Printf("[IRC] User %s, Network %s: Confirmed JOIN to channel %s.", s.Username, netConfig.NetworkName, channelName)
-			netConfig.AddChannelToNetwork(channelName)
+			key, _ := resolvePendingJoin(netConfig.ID, channelName, nil)
+			netConfig.AddChannelToNetwork(channelName, key)
+			if err := users.SaveNetworkChannel(netConfig.ID, channelName, key); err != nil {
+				log.Printf("[IRC] User %s, Network %s: %v", s.Username, netConfig.NetworkName, err)
+			}
 			s.Broadcast(events.EventTypeChannelJoin, map[string]interface{}{
 				"network_id": netConfig.ID,
 				"name":       channelName,
@@ -265,9 +421,12 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 		channelName := e.Arguments[0]
 		partingUser := e.Nick
 
-		if strings.EqualFold(partingUser, netConfig.Nickname) {
+		if strings.EqualFold(partingUser, netConfig.Nickname) || strings.EqualFold(partingUser, irc.GetNick()) {
 			log.Printf("[IRC] User %s, Network %s: Confirmed PART from channel %s.", s.Username, netConfig.NetworkName, channelName)
 			netConfig.RemoveChannelFromNetwork(channelName)
+			if err := users.RemoveNetworkChannel(netConfig.ID, channelName); err != nil {
+				log.Printf("[IRC] User %s, Network %s: %v", s.Username, netConfig.NetworkName, err)
+			}
 			s.Broadcast(events.EventTypeChannelPart, map[string]interface{}{
 				"network_id": netConfig.ID,
 				"name":       channelName,
@@ -365,6 +524,10 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 		irc.SendRaw("PONG " + e.Arguments[0])
 	})
 
+	irc.AddCallback("PONG", func(e *ircevent.Event) {
+		lag.pong(e.Message())
+	})
+
 	// PRIVMSG (Channel messages and DMs)
 	irc.AddCallback("PRIVMSG", func(e *ircevent.Event) {
 		target := e.Arguments[0]       // Channel or our nick
@@ -402,8 +565,27 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 			"id":           messageID,
 		})
 
+		isDM := isPrivateMessage && strings.EqualFold(target, netConfig.Nickname)
+		isMention := !isPrivateMessage && strings.ToLower(sender) != strings.ToLower(netConfig.Nickname) && mentionInMessage(netConfig.Nickname, messageContent)
+		if (!isDM && !isMention) || s.IsActive() {
+			return
+		}
+
+		missedType := "mention"
+		if isDM {
+			missedType = "dm"
+		}
+		s.AddMissedMessage(session.MissedMessage{
+			NetworkID:   netConfig.ID,
+			ChannelName: conversationTarget,
+			Sender:      sender,
+			Text:        messageContent,
+			Type:        missedType,
+			Time:        now.UTC(),
+		})
+
 		if s.FCMToken != "" {
-			if isPrivateMessage && strings.EqualFold(target, netConfig.Nickname) && !s.IsActive() {
+			if isDM {
 				log.Printf("[Push] Sending DM push to %s from %s on network %s", s.Username, sender, netConfig.NetworkName)
 				push.SendPushNotification(
 					s.FCMToken,
@@ -416,7 +598,7 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 						"type":         "dm",
 					},
 				)
-			} else if !isPrivateMessage && strings.ToLower(sender) != strings.ToLower(netConfig.Nickname) && mentionInMessage(netConfig.Nickname, messageContent) && !s.IsActive() {
+			} else {
 				log.Printf("[Push] Sending mention push to %s in %s on network %s", s.Username, target, netConfig.NetworkName)
 				push.SendPushNotification(
 					s.FCMToken,
@@ -451,62 +633,10 @@ func addIRCEventHandlers(irc *IRCClientWrapper, connectionDone chan error) {
 		})
 	})
 
-	// DISCONNECT
+	// DISCONNECT is fired by ircevent's Loop when the connection ends.
 	irc.AddCallback("DISCONNECT", func(e *ircevent.Event) {
-		log.Printf("[IRC] User %s, Network %s: Disconnected from IRC.", s.Username, netConfig.NetworkName)
-
-		netConfig.Mutex.Lock()
-		wasConnected := netConfig.IsConnected
-		netConfig.IsConnected = false
-		netConfig.IRC = nil
-		netConfig.Mutex.Unlock()
-
-		if wasConnected {
-			s.Broadcast(events.EventTypeNetworkDisconnect, map[string]interface{}{
-				"network_id":   netConfig.ID,
-				"network_name": netConfig.NetworkName,
-				"status":       "disconnected",
-				"reason":       e.Message(),
-			})
-		}
-
-		if netConfig.AutoReconnect {
-			netConfig.Mutex.Lock()
-			defer netConfig.Mutex.Unlock()
-
-			if netConfig.ReconnectTimer == nil {
-				netConfig.ReconnectAttempts++
-				attempts := netConfig.ReconnectAttempts
-
-				delaySec := math.Pow(2, float64(attempts))
-				if delaySec > 120 {
-					delaySec = 120
-				}
-				delay := time.Duration(delaySec) * time.Second
-
-				log.Printf("[IRC] Scheduling reconnect for %s in %v (attempt %d)", netConfig.NetworkName, delay, attempts)
-
-				netConfig.ReconnectTimer = time.AfterFunc(delay, func() {
-					netConfig.Mutex.Lock()
-					netConfig.ReconnectTimer = nil
-					netConfig.Mutex.Unlock()
-
-					log.Printf("[IRC] Attempting auto-reconnect for %s (attempt %d)", netConfig.NetworkName, attempts)
-					newIRC, connErr := EstablishIRCConnection(s, netConfig, "")
-					if connErr != nil {
-						log.Printf("[IRC] Reconnect failed for %s: %v", netConfig.NetworkName, connErr)
-					} else {
-						netConfig.Mutex.Lock()
-						netConfig.IRC = newIRC.Connection
-						netConfig.IsConnected = true
-						netConfig.Mutex.Unlock()
-						log.Printf("[IRC] Reconnect successful for %s", netConfig.NetworkName)
-					}
-				})
-			} else {
-				log.Printf("[IRC] Reconnect already scheduled for %s", netConfig.NetworkName)
-			}
-		}
+		lag.close()
+		connectionClosed(s, netConfig, irc.Connection, e.Message())
 	})
 }
 
@@ -0,0 +1,71 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ircevent "github.com/thoj/go-ircevent"
+)
+
+// How long an unanswered JOIN is remembered before it is forgotten.
+const pendingJoinLifetime = 2 * time.Minute
+
+type pendingJoin struct {
+	key    string
+	sentAt time.Time
+	result chan error
+}
+
+// pendingJoins tracks JOINs sent by the gateway that the server has not yet
+// confirmed or rejected. Key is "networkID_channelName" (e.g., "1_#general").
+var pendingJoins = struct {
+	sync.Mutex
+	m map[string]*pendingJoin
+}{m: make(map[string]*pendingJoin)}
+
+// JoinChannel sends a JOIN for a channel (with an optional key) and returns a
+// channel that receives nil once the server confirms the join, or an error if
+// the server rejects it. Nothing is sent on the channel if the server never answers.
+func JoinChannel(conn *ircevent.Connection, networkID int, channel, key string) <-chan error {
+	result := make(chan error, 1)
+	pk := fmt.Sprintf("%d_%s", networkID, strings.ToLower(channel))
+
+	pendingJoins.Lock()
+	now := time.Now()
+	for k, pj := range pendingJoins.m {
+		if now.Sub(pj.sentAt) > pendingJoinLifetime {
+			delete(pendingJoins.m, k)
+		}
+	}
+	pendingJoins.m[pk] = &pendingJoin{key: key, sentAt: now, result: result}
+	pendingJoins.Unlock()
+
+	TrackCommand(networkID, "JOIN", channel)
+	if key != "" {
+		conn.Join(channel + " " + key)
+	} else {
+		conn.Join(channel)
+	}
+	return result
+}
+
+// resolvePendingJoin completes a pending JOIN for a channel with the given
+// result. It returns the key the JOIN was sent with, if any.
+func resolvePendingJoin(networkID int, channel string, err error) (string, bool) {
+	pk := fmt.Sprintf("%d_%s", networkID, strings.ToLower(channel))
+
+	pendingJoins.Lock()
+	pj, ok := pendingJoins.m[pk]
+	if ok {
+		delete(pendingJoins.m, pk)
+	}
+	pendingJoins.Unlock()
+
+	if !ok {
+		return "", false
+	}
+	pj.result <- err
+	return pj.key, true
+}
@@ -0,0 +1,118 @@
+package irc
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ircevent "github.com/thoj/go-ircevent"
+	"iris-gateway/session"
+)
+
+const (
+	// How often the gateway PINGs a registered connection.
+	lagPingInterval = 60 * time.Second
+	// How long the server may take to answer before the connection is dropped.
+	lagPingTimeout = 45 * time.Second
+	// Marks PINGs sent by the lag monitor, so their PONGs can be told apart.
+	lagTokenPrefix = "iris-lag-"
+)
+
+// errPingTimeout is the disconnect reason for a connection that stopped
+// answering PINGs.
+var errPingTimeout = errors.New("ping timeout: the server stopped responding")
+
+// lagMonitor PINGs a connection on an interval, records the round trip as the
+// network's lag and aborts the connection when a PONG doesn't come back in
+// time, so a dead link is noticed well before the TCP timeout.
+type lagMonitor struct {
+	pongs    chan string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newLagMonitor() *lagMonitor {
+	return &lagMonitor{
+		pongs: make(chan string, 1),
+		stop:  make(chan struct{}),
+	}
+}
+
+// pong passes on the token of a PONG answering one of our PINGs.
+func (m *lagMonitor) pong(token string) {
+	if !strings.HasPrefix(token, lagTokenPrefix) {
+		return
+	}
+	select {
+	case m.pongs <- token:
+	default:
+	}
+}
+
+// close stops the monitor. It is safe to call more than once.
+func (m *lagMonitor) close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// run monitors conn until the monitor is closed. To be used as a goroutine.
+func (m *lagMonitor) run(s *session.UserSession, netConfig *session.UserNetwork, conn *ircevent.Connection) {
+	ticker := time.NewTicker(lagPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		sent := time.Now()
+		token := lagTokenPrefix + strconv.FormatInt(sent.UnixNano(), 10)
+		conn.SendRawf("PING :%s", token)
+
+		if !m.awaitPong(token) {
+			select {
+			case <-m.stop:
+				return
+			default:
+			}
+			log.Printf("[IRC] User %s, Network %s: No PONG within %v, dropping the connection", s.Username, netConfig.NetworkName, lagPingTimeout)
+			conn.Abort(errPingTimeout)
+			return
+		}
+
+		lag := time.Since(sent)
+		netConfig.Mutex.Lock()
+		current := netConfig.IRC == conn
+		if current {
+			netConfig.Lag = lag
+		}
+		netConfig.Mutex.Unlock()
+		if !current {
+			return
+		}
+		broadcastStatus(s, netConfig)
+	}
+}
+
+// awaitPong waits for the PONG carrying token. PONGs for earlier PINGs that
+// arrive late are skipped. It returns false on timeout or when stopped.
+func (m *lagMonitor) awaitPong(token string) bool {
+	timeout := time.NewTimer(lagPingTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case got := <-m.pongs:
+			if got == token {
+				return true
+			}
+		case <-timeout.C:
+			return false
+		case <-m.stop:
+			return false
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// ErrConnectionQuota is returned by ConnectNetwork when the user already has
+// as many networks connected as their quota allows.
+var ErrConnectionQuota = errors.New("connection limit reached")
+
+// connectionQuotaMutex is held from checking the connection quota until the
+// network is marked as connecting, so networks connecting at the same time
+// can't all see the same free slot.
+var connectionQuotaMutex sync.Mutex
+
+// activeConnections counts the user's networks, other than except, that are
+// connected or trying to connect, including ones waiting to retry.
+func activeConnections(s *session.UserSession, except *session.UserNetwork) int {
+	s.Mutex.RLock()
+	networks := make([]*session.UserNetwork, 0, len(s.Networks))
+	for _, netConfig := range s.Networks {
+		if netConfig != except {
+			networks = append(networks, netConfig)
+		}
+	}
+	s.Mutex.RUnlock()
+
+	active := 0
+	for _, netConfig := range networks {
+		netConfig.Mutex.RLock()
+		switch netConfig.State {
+		case session.StateConnecting, session.StateRegistering, session.StateConnected, session.StateBackoff:
+			active++
+		}
+		netConfig.Mutex.RUnlock()
+	}
+	return active
+}
+
+// checkConnectionQuota returns an error wrapping ErrConnectionQuota if
+// connecting netConfig would exceed the user's connection limit. The caller
+// holds connectionQuotaMutex.
+func checkConnectionQuota(s *session.UserSession, netConfig *session.UserNetwork) error {
+	limit := users.GetQuota(s.UserID).MaxConnections
+	if limit > 0 && activeConnections(s, netConfig) >= limit {
+		return fmt.Errorf("%w: at most %d networks can be connected at once", ErrConnectionQuota, limit)
+	}
+	return nil
+}
+
+// channelBudget returns how many channels netConfig may join given the
+// channels the user is in on their other networks, or -1 if there is no
+// channel limit.
+func channelBudget(s *session.UserSession, netConfig *session.UserNetwork) int {
+	limit := users.GetQuota(s.UserID).MaxChannels
+	if limit <= 0 {
+		return -1
+	}
+
+	s.Mutex.RLock()
+	networks := make([]*session.UserNetwork, 0, len(s.Networks))
+	for _, other := range s.Networks {
+		if other != netConfig {
+			networks = append(networks, other)
+		}
+	}
+	s.Mutex.RUnlock()
+
+	for _, other := range networks {
+		other.Mutex.RLock()
+		limit -= len(other.Channels)
+		other.Mutex.RUnlock()
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// limitJoinCommand cuts the channels of a raw JOIN command down to budget,
+// returning the command to send ("" if none) and how many channels it joins.
+// Other commands are returned unchanged. A negative budget means no limit.
+func limitJoinCommand(command string, budget int) (string, int) {
+	fields := strings.Fields(command)
+	if len(fields) < 2 || !strings.EqualFold(strings.TrimPrefix(fields[0], "/"), "JOIN") || fields[1] == "0" {
+		return command, 0
+	}
+	channels := strings.Split(fields[1], ",")
+	if budget < 0 || len(channels) <= budget {
+		return command, len(channels)
+	}
+	if budget == 0 {
+		return "", 0
+	}
+
+	limited := []string{fields[0], strings.Join(channels[:budget], ",")}
+	if len(fields) > 2 {
+		keys := strings.Split(fields[2], ",")
+		if len(keys) > budget {
+			keys = keys[:budget]
+		}
+		limited = append(limited, strings.Join(keys, ","))
+	}
+	return strings.Join(limited, " "), budget
+}
@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	ircevent "github.com/thoj/go-ircevent"
+	"github.com/xdg-go/scram"
+	"iris-gateway/session"
+)
+
+// scramMechanism implements SASL SCRAM-SHA-256 for ircevent.
+type scramMechanism struct {
+	conv *scram.ClientConversation
+}
+
+func newSCRAMMechanism(username, password string) (*scramMechanism, error) {
+	client, err := scram.SHA256.NewClient(username, password, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare SCRAM credentials: %w", err)
+	}
+	return &scramMechanism{conv: client.NewConversation()}, nil
+}
+
+func (m *scramMechanism) Name() string { return "SCRAM-SHA-256" }
+
+func (m *scramMechanism) Next(challenge []byte) ([]byte, error) {
+	if m.conv.Done() {
+		// The server sent something after its final message; there is nothing left to say.
+		return nil, nil
+	}
+	response, err := m.conv.Step(string(challenge))
+	if err != nil {
+		return nil, fmt.Errorf("SCRAM-SHA-256 exchange failed: %w", err)
+	}
+	return []byte(response), nil
+}
+
+// configureSASL sets up SASL authentication for a connection from the
+// network's settings, and sends the server password as PASS unless it is the
+// SASL secret. Networks created before SASL had its own settings use the
+// "sasl" module, which means PLAIN with the nickname and server password.
+func configureSASL(ircClient *ircevent.Connection, netConfig *session.UserNetwork, serverPassword string) error {
+	mechanism := strings.ToUpper(netConfig.SASLMechanism)
+	username := netConfig.SASLUsername
+	password := netConfig.SASLPassword
+
+	if mechanism == "" {
+		for _, module := range netConfig.Modules {
+			if strings.ToLower(module) == "sasl" && serverPassword != "" {
+				mechanism = "PLAIN"
+				password = serverPassword
+				break
+			}
+		}
+	}
+	if mechanism == "" {
+		ircClient.Password = serverPassword
+		return nil
+	}
+	if username == "" {
+		username = netConfig.Nickname
+	}
+	if password != serverPassword {
+		ircClient.Password = serverPassword
+	}
+
+	switch mechanism {
+	case "PLAIN", "EXTERNAL":
+		ircClient.SASLMech = mechanism
+		ircClient.SASLLogin = username
+		ircClient.SASLPassword = password
+	case "SCRAM-SHA-256":
+		mech, err := newSCRAMMechanism(username, password)
+		if err != nil {
+			return err
+		}
+		ircClient.SASLMechanism = mech
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", mechanism)
+	}
+
+	ircClient.UseSASL = true
+	log.Printf("[IRC] Network %s: SASL %s enabled with login %s", netConfig.NetworkName, mechanism, username)
+	return nil
+}
@@ -0,0 +1,113 @@
+package irc
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"iris-gateway/events"
+	"iris-gateway/session"
+	"iris-gateway/users"
+)
+
+// TLS verification modes for a network.
+const (
+	TLSVerify   = "verify"   // Verify the server certificate against the system roots
+	TLSPin      = "pin"      // Accept only the pinned certificate, pinning the first one seen
+	TLSInsecure = "insecure" // Accept any certificate
+)
+
+// NormalizeFingerprint lowercases a hex fingerprint and strips the colons
+// and spaces it is often written with.
+func NormalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(fingerprint)
+	fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+	return strings.ReplaceAll(fingerprint, " ", "")
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of a DER certificate as hex.
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildTLSConfig creates the TLS configuration for connecting a network to the
+// server at index according to its verification mode, including its client
+// certificate if it has one. Each server is pinned to its own certificate, so
+// a network can fail over between servers that present different ones.
+func buildTLSConfig(userSession *session.UserSession, netConfig *session.UserNetwork, index int, server session.NetworkServer) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: server.Hostname,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch netConfig.TLSVerifyMode {
+	case "", TLSVerify:
+	case TLSInsecure:
+		tlsConfig.InsecureSkipVerify = true
+		log.Printf("[IRC] Network %s: WARNING: TLS certificate verification is disabled", netConfig.NetworkName)
+	case TLSPin:
+		// Chain verification is replaced by the fingerprint check below.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinnedCertificate(userSession, netConfig, index, server, rawCerts)
+		}
+	default:
+		return nil, fmt.Errorf("unknown TLS verify mode %q for network %s", netConfig.TLSVerifyMode, netConfig.NetworkName)
+	}
+
+	if netConfig.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(netConfig.ClientCert), []byte(netConfig.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate for network %s: %w", netConfig.NetworkName, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		log.Printf("[IRC] Network %s: Using client certificate", netConfig.NetworkName)
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPinnedCertificate checks the leaf certificate of the server at index
+// against its pinned fingerprint. The first certificate seen is trusted and
+// pinned.
+func verifyPinnedCertificate(userSession *session.UserSession, netConfig *session.UserNetwork, index int, server session.NetworkServer, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	fingerprint := CertificateFingerprint(rawCerts[0])
+
+	pinned := NormalizeFingerprint(netConfig.PinnedFingerprint(index))
+	if pinned == "" {
+		netConfig.SetPinnedFingerprint(index, fingerprint)
+		log.Printf("[IRC] Network %s: Pinning certificate %s of server %s on first use", netConfig.NetworkName, fingerprint, server.Hostname)
+		if err := users.SetNetworkServerPinnedFingerprint(netConfig.ID, index, fingerprint); err != nil {
+			log.Printf("[IRC] Network %s: Failed to save pinned fingerprint: %v", netConfig.NetworkName, err)
+		}
+		return nil
+	}
+	if pinned == fingerprint {
+		return nil
+	}
+
+	subject := ""
+	if cert, err := x509.ParseCertificate(rawCerts[0]); err == nil {
+		subject = cert.Subject.String()
+	}
+	log.Printf("[IRC] Network %s: Certificate %s of server %s does not match pinned %s", netConfig.NetworkName, fingerprint, server.Hostname, pinned)
+	userSession.Broadcast(events.EventTypeTLSCertificateChanged, map[string]interface{}{
+		"network_id":           netConfig.ID,
+		"network_name":         netConfig.NetworkName,
+		"server_index":         index,
+		"hostname":             server.Hostname,
+		"pinned_fingerprint":   pinned,
+		"received_fingerprint": fingerprint,
+		"subject":              subject,
+	})
+	return fmt.Errorf("server certificate fingerprint %s does not match pinned fingerprint %s", fingerprint, pinned)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -12,28 +14,101 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"iris-gateway/auth"
 	"iris-gateway/config"
 	"iris-gateway/handlers"
 	"iris-gateway/irc" // Keep this import for the new irc_client and history
 	"iris-gateway/push"
+	"iris-gateway/secrets"
+	"iris-gateway/session"
 	"iris-gateway/users"
 )
 
+// redactedLogFormatter formats request logs like gin's default logger, with
+// the token in /ws/:token paths, ?ticket= values, the authorization code of
+// OIDC callbacks and webhook secrets passed in ?token= replaced.
+func redactedLogFormatter(param gin.LogFormatterParams) string {
+	if strings.HasPrefix(param.Path, "/ws/") {
+		param.Path = "/ws/[redacted]"
+	} else if strings.Contains(param.Path, "ticket=") || strings.HasPrefix(param.Path, "/api/login/oidc/callback?") ||
+		(strings.HasPrefix(param.Path, "/api/hooks/") && strings.Contains(param.Path, "?")) {
+		param.Path = strings.SplitN(param.Path, "?", 2)[0] + "?[redacted]"
+	}
+	return defaultLogFormatter(param)
+}
+
+// defaultLogFormatter is gin's default log format.
+func defaultLogFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
+
+// readPassword reads one line from stdin, prompting for it on stderr.
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password given")
+	}
+	return password, nil
+}
+
 func main() {
 	// Command-line flags for user management
 	createUserFlag := flag.String("createuser", "", "Create a new user. Format: --createuser <username>:<password>")
 	deleteUserFlag := flag.String("deleteuser", "", "Delete a user. Format: --deleteuser <username>")
 	suspendUserFlag := flag.String("suspenduser", "", "Suspend a user. Format: --suspenduser <username>")
 	unsuspendUserFlag := flag.String("unsuspenduser", "", "Unsuspend a user. Format: --unsuspenduser <username>")
+	makeAdminFlag := flag.String("makeadmin", "", "Give a user the admin role. Format: --makeadmin <username>")
+	revokeAdminFlag := flag.String("revokeadmin", "", "Remove a user's admin role. Format: --revokeadmin <username>")
+	resetPasswordFlag := flag.String("resetpassword", "", "Set a user's password, read from stdin, and log out their devices. Format: --resetpassword <username>")
+	reset2FAFlag := flag.String("reset2fa", "", "Turn off two-factor authentication for a user. Format: --reset2fa <username>")
+	rotateKeyFlag := flag.Bool("rotatekey", false, "Re-encrypt all stored secrets with a new master key")
+	loginAttemptsFlag := flag.String("loginattempts", "", "Show recent failed logins. Format: --loginattempts <username> (or 'all')")
 
 	flag.Parse()
 
+	// Load the master key before anything reads or writes encrypted secrets
+	if err := secrets.Init(config.Cfg.MasterKeyFile); err != nil {
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+
 	// Initialize the user database before any flag operations
 	if err := users.InitDB(config.Cfg.SQLiteDBPath); err != nil {
 		log.Fatalf("Failed to initialize user database: %v", err)
 	}
 	defer users.CloseDB()
 
+	// Check passwords against the configured directory
+	if err := auth.Setup(); err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
+
+	// Ending a session disconnects its networks the same way as the API does
+	session.SetNetworkDisconnecter(func(s *session.UserSession, netConfig *session.UserNetwork) {
+		irc.DisconnectNetwork(s, netConfig)
+	})
+
 	// Handle user management commands first
 	if *createUserFlag != "" {
 		parts := strings.SplitN(*createUserFlag, ":", 2)
@@ -73,12 +148,85 @@ func main() {
 		return // Exit after user management command
 	}
 
+	if *makeAdminFlag != "" {
+		if err := users.SetAdmin(*makeAdminFlag, true); err != nil {
+			log.Fatalf("Failed to make %s an admin: %v", *makeAdminFlag, err)
+		}
+		log.Printf("User '%s' is now an admin.", *makeAdminFlag)
+		return // Exit after user management command
+	}
+
+	if *revokeAdminFlag != "" {
+		if err := users.SetAdmin(*revokeAdminFlag, false); err != nil {
+			log.Fatalf("Failed to remove admin role from %s: %v", *revokeAdminFlag, err)
+		}
+		log.Printf("User '%s' is no longer an admin.", *revokeAdminFlag)
+		return // Exit after user management command
+	}
+
+	if *resetPasswordFlag != "" {
+		// The password is read from stdin so it stays out of shell history
+		// and the process list.
+		username := *resetPasswordFlag
+		if strings.Contains(username, ":") {
+			log.Fatalf("Invalid --resetpassword format. Use: <username>, and enter the password when asked")
+		}
+		password, err := readPassword(fmt.Sprintf("New password for %s: ", username))
+		if err != nil {
+			log.Fatalf("Failed to read the new password: %v", err)
+		}
+		if err := users.ResetPassword(username, password); err != nil {
+			log.Fatalf("Failed to reset password for %s: %v", username, err)
+		}
+		log.Printf("Password for '%s' reset and their sessions revoked.", username)
+		return // Exit after user management command
+	}
+
+	if *reset2FAFlag != "" {
+		if err := users.ResetTwoFactor(*reset2FAFlag); err != nil {
+			log.Fatalf("Failed to reset two-factor authentication for %s: %v", *reset2FAFlag, err)
+		}
+		log.Printf("Two-factor authentication for '%s' turned off.", *reset2FAFlag)
+		return // Exit after user management command
+	}
+
+	if *rotateKeyFlag {
+		path, converted, err := users.RotateMasterKey(config.Cfg.MasterKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to rotate master key: %v", err)
+		}
+		log.Printf("Re-encrypted %d secrets with a new master key, stored in %s.", converted, path)
+		if os.Getenv(secrets.MasterKeyEnv) != "" {
+			log.Printf("%s is set: replace its value with the contents of %s before restarting.", secrets.MasterKeyEnv, path)
+		}
+		return // Exit after user management command
+	}
+
+	if *loginAttemptsFlag != "" {
+		username := *loginAttemptsFlag
+		if username == "all" {
+			username = ""
+		}
+		attempts, err := users.ListLoginAttempts(username, true, 100)
+		if err != nil {
+			log.Fatalf("Failed to list login attempts: %v", err)
+		}
+		for _, attempt := range attempts {
+			fmt.Printf("%s  %-20s  %-39s  %s\n", attempt.AttemptedAt.Local().Format("2006-01-02 15:04:05"), attempt.Username, attempt.IP, attempt.Reason)
+		}
+		log.Printf("%d failed login attempts shown.", len(attempts))
+		return // Exit after user management command
+	}
+
 	// Initialize Firebase Cloud Messaging
 	push.InitFCM()
 
 	// Initialize IRC history manager
 	irc.InitHistory(config.Cfg.HistoryDuration)
 
+	// Connect every user's auto-connect networks, whether or not they log in
+	irc.StartBouncer()
+
 	// Clean up any files older than configured duration on startup
 	go func() {
 		files, err := os.ReadDir(config.Cfg.ImageBaseDir)
@@ -106,11 +254,61 @@ func main() {
 					log.Printf("Failed to cleanup old file %s: %v", path, err)
 				} else {
 					log.Printf("Cleaned up old file %s", path)
+					users.DeleteAttachment(file.Name())
 				}
 			}
 		}
 	}()
 
+	// Remove expired login sessions hourly
+	go func() {
+		for ; ; time.Sleep(time.Hour) {
+			if removed, err := users.DeleteExpiredSessions(); err != nil {
+				log.Printf("Failed to clean up expired sessions: %v", err)
+			} else if removed > 0 {
+				log.Printf("Removed %d expired sessions", removed)
+			}
+		}
+	}()
+
+	// End the live sessions of users suspended with --suspenduser while the
+	// gateway was running, which can't reach this process
+	go func() {
+		for ; ; time.Sleep(time.Minute) {
+			suspended, err := users.GetSuspendedUserIDs()
+			if err != nil {
+				log.Printf("Failed to check for suspended users: %v", err)
+				continue
+			}
+			for _, userID := range suspended {
+				if sess, found := session.GetSessionByUserID(userID); found {
+					log.Printf("Ending session of suspended user %s", sess.Username)
+					session.RemoveSession(userID)
+				}
+			}
+		}
+	}()
+
+	// Suspend users the directory has disabled, and unsuspend those it has
+	// enabled again
+	if users.ExternalAuth() {
+		go func() {
+			interval, err := time.ParseDuration(config.Cfg.AuthSyncInterval)
+			if err != nil || interval <= 0 {
+				log.Printf("Invalid auth sync interval '%s', defaulting to 15m", config.Cfg.AuthSyncInterval)
+				interval = 15 * time.Minute
+			}
+			for ; ; time.Sleep(interval) {
+				suspended, restored, err := users.SyncDirectoryAccounts()
+				if err != nil {
+					log.Printf("Failed to check directory accounts: %v", err)
+				} else if suspended > 0 || restored > 0 {
+					log.Printf("Directory sync suspended %d and unsuspended %d users", suspended, restored)
+				}
+			}
+		}()
+	}
+
 	// HTTP->HTTPS redirect logic
 	if config.Cfg.HTTPRedirect && config.Cfg.HTTPPort != "" {
 		go func() {
@@ -125,10 +323,15 @@ func main() {
 		}()
 	}
 
-	router := gin.Default()
+	// gin.Default's logger, except that credentials in WebSocket URLs are redacted
+	router := gin.New()
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: redactedLogFormatter}), gin.Recovery())
 
-	// CORS Middleware
-	router.Use(cors.Default())
+	// CORS Middleware, limited to the configured origins
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOriginFunc = handlers.OriginAllowed
+	corsConfig.AllowHeaders = append(corsConfig.AllowHeaders, "Authorization")
+	router.Use(cors.New(corsConfig))
 
 	// Serve static avatar files
 	router.StaticFS("/avatars", http.Dir(config.Cfg.AvatarDir))
@@ -138,12 +341,61 @@ func main() {
 
 	// API routes
 	router.POST("/api/login", handlers.LoginHandler)
+	router.POST("/api/login/2fa", handlers.LoginTwoFactorHandler)
+	router.GET("/api/login/oidc", handlers.OIDCLoginHandler)
+	router.GET("/api/login/oidc/callback", handlers.OIDCCallbackHandler)
+	router.GET("/api/auth", handlers.AuthInfoHandler)
+	router.POST("/api/register", handlers.RegisterHandler)
 	router.GET("/api/validate-session", handlers.ValidateSessionHandler)
+	router.GET("/api/sessions", handlers.ListSessionsHandler)
+	router.DELETE("/api/sessions", handlers.RevokeAllSessionsHandler)
+	router.DELETE("/api/sessions/:id", handlers.RevokeSessionHandler)
+	router.POST("/api/logout", handlers.LogoutHandler)
+	router.POST("/api/password", handlers.ChangePasswordHandler)
+	router.GET("/api/quota", handlers.QuotaHandler)
+	// Personal access tokens for scripts and bots
+	router.GET("/api/tokens", handlers.ListAPITokensHandler)
+	router.POST("/api/tokens", handlers.CreateAPITokenHandler)
+	router.DELETE("/api/tokens/:id", handlers.RevokeAPITokenHandler)
+	router.POST("/api/messages", handlers.SendMessageHandler)
+	// Incoming webhooks that post to IRC channels for CI, monitoring and git hosting
+	router.GET("/api/webhooks", handlers.ListWebhooksHandler)
+	router.POST("/api/webhooks", handlers.CreateWebhookHandler)
+	router.DELETE("/api/webhooks/:id", handlers.DeleteWebhookHandler)
+	router.POST("/api/webhooks/:id/secret", handlers.RotateWebhookSecretHandler)
+	router.POST("/api/hooks/:id", handlers.IncomingWebhookHandler) // Authenticated by the webhook's secret
+	// Devices are login sessions; these routes are the same as /api/sessions
+	router.GET("/api/devices", handlers.ListSessionsHandler)
+	router.DELETE("/api/devices/:id", handlers.RevokeSessionHandler)
 	router.POST("/api/channels/join", handlers.JoinChannelHandler) // Still useful, but needs network_id
 	router.POST("/api/channels/part", handlers.PartChannelHandler) // Still useful, but needs network_id
 	router.GET("/api/channels", handlers.ListChannelsHandler)      // Needs to list channels per network
 	router.GET("/api/history/:networkId/:channel", handlers.ChannelHistoryHandler) // New history endpoint
 
+	// Admin API
+	router.GET("/api/admin/users", handlers.AdminListUsersHandler)
+	router.POST("/api/admin/users", handlers.AdminCreateUserHandler)
+	router.DELETE("/api/admin/users/:id", handlers.AdminDeleteUserHandler)
+	router.POST("/api/admin/users/:id/suspend", handlers.AdminSuspendUserHandler)
+	router.POST("/api/admin/users/:id/unsuspend", handlers.AdminUnsuspendUserHandler)
+	router.POST("/api/admin/users/:id/admin", handlers.AdminSetRoleHandler)
+	router.POST("/api/admin/users/:id/password", handlers.AdminResetPasswordHandler)
+	router.POST("/api/admin/users/:id/disconnect", handlers.AdminDisconnectUserHandler)
+	router.POST("/api/admin/users/:id/link", handlers.AdminLinkAccountHandler)
+	router.GET("/api/admin/login-attempts", handlers.AdminLoginAttemptsHandler)
+	router.GET("/api/admin/users/:id/quota", handlers.AdminGetQuotaHandler)
+	router.PUT("/api/admin/users/:id/quota", handlers.AdminSetQuotaHandler)
+	router.GET("/api/admin/invites", handlers.AdminListInvitesHandler)
+	router.POST("/api/admin/invites", handlers.AdminCreateInviteHandler)
+	router.DELETE("/api/admin/invites/:id", handlers.AdminRevokeInviteHandler)
+
+	// Two-factor authentication
+	router.GET("/api/2fa", handlers.TwoFactorStatusHandler)
+	router.POST("/api/2fa/setup", handlers.SetupTwoFactorHandler)
+	router.POST("/api/2fa/enable", handlers.EnableTwoFactorHandler)
+	router.POST("/api/2fa/disable", handlers.DisableTwoFactorHandler)
+	router.POST("/api/2fa/recovery-codes", handlers.RegenerateRecoveryCodesHandler)
+
 	// New API endpoints for IRC network management
 	router.POST("/api/irc/networks", handlers.AddNetworkHandler)
 	router.GET("/api/irc/networks", handlers.ListNetworksHandler)
@@ -151,11 +403,21 @@ func main() {
 	router.DELETE("/api/irc/networks/:id", handlers.DeleteNetworkHandler)
 	router.POST("/api/irc/networks/:id/connect", handlers.ConnectNetworkHandler)
 	router.POST("/api/irc/networks/:id/disconnect", handlers.DisconnectNetworkHandler)
+	router.POST("/api/irc/networks/:id/cancel-retry", handlers.CancelRetryHandler)
 
 	// Register the new API endpoint for fetching a single IRC network's details
 	router.GET("/api/irc/networks/:id", handlers.GetNetworkDetailsHandler)
 
-	router.GET("/ws/:token", handlers.WebSocketHandler)
+	// Client certificates (CertFP) for IRC networks
+	router.GET("/api/irc/networks/:id/cert", handlers.GetClientCertHandler)
+	router.POST("/api/irc/networks/:id/cert/generate", handlers.GenerateClientCertHandler)
+	router.PUT("/api/irc/networks/:id/cert", handlers.UploadClientCertHandler)
+	router.DELETE("/api/irc/networks/:id/cert", handlers.DeleteClientCertHandler)
+	router.POST("/api/irc/networks/:id/tls/trust", handlers.TrustServerCertHandler)
+
+	router.GET("/ws", handlers.WebSocketHandler)
+	router.GET("/ws/:token", handlers.WebSocketHandler) // Deprecated: the token ends up in logs
+	router.POST("/api/ws-ticket", handlers.CreateWSTicketHandler)
 	router.POST("/api/upload-avatar", handlers.UploadAvatarHandler)
 	router.POST("/api/upload-attachment", handlers.UploadAttachmentHandler)
 	router.POST("/api/register-fcm-token", handlers.RegisterFCMTokenHandler)
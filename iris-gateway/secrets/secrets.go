@@ -0,0 +1,182 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// MasterKeyEnv names the environment variable that can hold the master key
+// (base64-encoded, 32 bytes). It takes precedence over the key file.
+const MasterKeyEnv = "IRIS_MASTER_KEY"
+
+// Prefix marks a value encrypted with the master key.
+const Prefix = "enc:v1:"
+
+const keySize = 32
+
+var aead cipher.AEAD
+
+// Init loads the master key used to encrypt secrets at rest. The key comes
+// from IRIS_MASTER_KEY if set, otherwise from keyFile, which is created with
+// a new random key if it doesn't exist yet.
+func Init(keyFile string) error {
+	key, err := loadKey(keyFile)
+	if err != nil {
+		return err
+	}
+	aead, err = newAEAD(key)
+	return err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return gcm, nil
+}
+
+func loadKey(keyFile string) ([]byte, error) {
+	if encoded := strings.TrimSpace(os.Getenv(MasterKeyEnv)); encoded != "" {
+		return decodeKey(encoded, MasterKeyEnv)
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		return decodeKey(strings.TrimSpace(string(data)), keyFile)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read master key file %s: %w", keyFile, err)
+	}
+
+	key, err := generateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Generated new master key in %s. Back it up: encrypted secrets cannot be recovered without it.", keyFile)
+	return key, nil
+}
+
+// generateKey writes a new random key to keyFile.
+func generateKey(keyFile string) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(keyFile, []byte(encoded), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write master key file %s: %w", keyFile, err)
+	}
+	return key, nil
+}
+
+func decodeKey(encoded, source string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key in %s: %w", source, err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid master key in %s: expected %d bytes, got %d", source, keySize, len(key))
+	}
+	return key, nil
+}
+
+// Encrypt encrypts a value with the master key. Empty values stay empty.
+func Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if aead == nil {
+		return "", errors.New("secrets: master key not initialized")
+	}
+	return seal(aead, plaintext)
+}
+
+func seal(a cipher.AEAD, plaintext string) (string, error) {
+	nonce := make([]byte, a.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := a.Seal(nonce, nonce, []byte(plaintext), nil)
+	return Prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt. Values without the encryption prefix are returned
+// unchanged, so data stored before encryption was introduced still reads.
+func Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, Prefix) {
+		return value, nil
+	}
+	if aead == nil {
+		return "", errors.New("secrets: master key not initialized")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, Prefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted value: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value (wrong master key?): %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Rotate replaces the master key with a new random one. reencrypt is given a
+// function that converts a stored value to the new key (encrypting it if it
+// was still plaintext); if reencrypt fails, the current key stays in use.
+//
+// The new key is written to keyFile+".new" before anything is converted, so
+// it can't be lost. It then replaces keyFile, unless the key comes from
+// IRIS_MASTER_KEY, in which case the file is left for the operator to install.
+// Rotate returns the path of the new key.
+func Rotate(keyFile string, reencrypt func(convert func(string) (string, error)) error) (string, error) {
+	if aead == nil {
+		return "", errors.New("secrets: master key not initialized")
+	}
+	pendingFile := keyFile + ".new"
+	key, err := generateKey(pendingFile)
+	if err != nil {
+		return "", err
+	}
+	newCipher, err := newAEAD(key)
+	if err != nil {
+		os.Remove(pendingFile)
+		return "", err
+	}
+
+	convert := func(value string) (string, error) {
+		plaintext, err := Decrypt(value)
+		if err != nil || plaintext == "" {
+			return "", err
+		}
+		return seal(newCipher, plaintext)
+	}
+	if err := reencrypt(convert); err != nil {
+		os.Remove(pendingFile)
+		return "", err
+	}
+	aead = newCipher
+
+	if os.Getenv(MasterKeyEnv) != "" {
+		return pendingFile, nil
+	}
+	if err := os.Rename(pendingFile, keyFile); err != nil {
+		return pendingFile, fmt.Errorf("secrets were re-encrypted but the new key could not replace %s; it is in %s: %w", keyFile, pendingFile, err)
+	}
+	return keyFile, nil
+}
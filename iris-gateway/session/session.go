@@ -21,12 +21,22 @@ type ChannelMember struct {
 
 type ChannelState struct {
 	Name       string          `json:"name"`
+	Key        string          `json:"-"` // Channel key (+k) used to join, if any
 	Topic      string          `json:"topic"`
 	Members    []ChannelMember `json:"members"`
 	LastUpdate time.Time       `json:"last_update"`
 	Mutex      sync.RWMutex    `json:"-"` // Changed to RWMutex
 }
 
+// NetworkServer is one of the servers an IRC network can be reached on.
+type NetworkServer struct {
+	Hostname          string `json:"hostname"`
+	Port              int    `json:"port"`
+	UseSSL            bool   `json:"use_ssl"`
+	Password          string `json:"password,omitempty"`           // Server password (PASS), omitted in JSON when empty
+	PinnedFingerprint string `json:"pinned_fingerprint,omitempty"` // SHA-256 of this server's pinned certificate, hex
+}
+
 // UserNetwork represents a single IRC network configuration for a user.
 type UserNetwork struct {
 	ID              int                  `json:"id"` // Unique ID for the network config
@@ -35,36 +45,178 @@ type UserNetwork struct {
 	Hostname        string               `json:"hostname"`
 	Port            int                  `json:"port"`
 	UseSSL          bool                 `json:"use_ssl"`
-	ServerPassword  string               `json:"server_password,omitempty"` // Omitted in JSON for security
+	ServerPassword  string               `json:"-"` // Decrypted; never sent to clients
+	Servers         []NetworkServer      `json:"servers"` // Tried in order; Hostname/Port/UseSSL/ServerPassword mirror the first
+	ServerIndex     int                  `json:"-"`       // Server to try first: the last one that worked
 	AutoReconnect   bool                 `json:"auto_reconnect"`
 	Modules         []string             `json:"modules"`          // e.g., ["sasl", "nickserv"]
 	PerformCommands []string             `json:"perform_commands"` // Commands to run on connect
-	InitialChannels []string             `json:"initial_channels"` // Channels to join on connect
+	InitialChannels []string             `json:"initial_channels"` // Channels to join on connect, as "#channel" or "#channel key"
 	Nickname        string               `json:"nickname"`
 	AltNickname     string               `json:"alt_nickname"`
 	Ident           string               `json:"ident"` // Username
 	Realname        string               `json:"realname"`
 	QuitMessage     string               `json:"quit_message"`
+	SASLMechanism   string               `json:"sasl_mechanism"`          // "", "PLAIN", "EXTERNAL" or "SCRAM-SHA-256"
+	SASLUsername    string               `json:"sasl_username"`           // Account name; defaults to the nickname
+	SASLPassword    string               `json:"-"`                       // Decrypted; never sent to clients
+	NickServPassword string              `json:"-"`                       // Sent to NickServ with IDENTIFY on connect, decrypted
+	TLSVerifyMode   string               `json:"tls_verify_mode"`        // "verify" (default), "pin" or "insecure"
+	TLSPinnedFingerprint string          `json:"tls_pinned_fingerprint"` // SHA-256 of the pinned server certificate, hex
+	ProxyURL        string               `json:"proxy_url,omitempty"` // socks5://, socks5h://, http:// or https:// proxy, with optional user but no password
+	ProxyPassword   string               `json:"-"`                   // Password for the proxy user, decrypted
+	BindAddress     string               `json:"bind_address"`        // Local source IP for outgoing connections
+	AddressFamily   string               `json:"address_family"`      // "" (any), "ipv4" or "ipv6"
+	ClientCert      string               `json:"-"` // PEM client certificate for CertFP, if any
+	ClientKey       string               `json:"-"` // PEM private key for ClientCert, decrypted
 
 	// Live connection details
 	IRC            *ircevent.Connection       `json:"-"` // Actual IRC connection, not marshaled
-	IsConnected    bool                       `json:"is_connected"`
-	IsConnecting   bool                       `json:"-"` // Track connection attempts
 	Channels       map[string]*ChannelState   `json:"channels"` // Channels for this specific network
 
+	// Connection state machine, driven by the irc package
+	State          ConnState   `json:"state"`
+	LastError      string      `json:"last_error,omitempty"` // Why the last attempt or connection failed
+	NextRetry      time.Time   `json:"-"`                    // When the next attempt is due, in StateBackoff
+	Attempts       int         `json:"attempts"`             // Consecutive failed attempts
+	RetryTimer     *time.Timer `json:"-"`                    // Pending retry, in StateBackoff
+	RestartPending bool        `json:"-"`                    // Connect again once the current connection closes
+	Lag            time.Duration `json:"-"`                  // Round trip of the last gateway PING, while connected
+
 	// Mutex for this specific network's state
 	Mutex sync.RWMutex `json:"-"`
+}
+
+// ConnState is where a network is in its connection lifecycle.
+type ConnState string
+
+const (
+	StateIdle          ConnState = "idle"          // Not connected, no retry pending
+	StateConnecting    ConnState = "connecting"    // Dialing a server
+	StateRegistering   ConnState = "registering"   // Connected, waiting for registration (001)
+	StateConnected     ConnState = "connected"     // Registered with the server
+	StateBackoff       ConnState = "backoff"       // Waiting to retry after a failure
+	StateDisconnecting ConnState = "disconnecting" // QUIT sent, waiting for the connection to close
+)
+
+// IsConnected reports whether the network is registered with its server.
+func (n *UserNetwork) IsConnected() bool {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+	return n.State == StateConnected && n.IRC != nil
+}
+
+// Status returns the network's connection state as sent to clients.
+func (n *UserNetwork) Status() map[string]interface{} {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+	return n.StatusLocked()
+}
 
-	ReconnectAttempts int         `json:"-"` // Tracks consecutive reconnect attempts
-	ReconnectTimer    *time.Timer `json:"-"` // Timer for exponential backoff reconnects
+// StatusLocked is Status for callers that already hold the network's Mutex.
+func (n *UserNetwork) StatusLocked() map[string]interface{} {
+	state := n.State
+	if state == "" {
+		state = StateIdle
+	}
+	var nextRetry interface{}
+	if state == StateBackoff && !n.NextRetry.IsZero() {
+		nextRetry = n.NextRetry.UTC().Format(time.RFC3339)
+	}
+	var lagMs interface{}
+	if state == StateConnected && n.Lag > 0 {
+		lagMs = n.Lag.Milliseconds()
+	}
+	return map[string]interface{}{
+		"network_id":   n.ID,
+		"network_name": n.NetworkName,
+		"state":        state,
+		"is_connected": state == StateConnected,
+		"last_error":   n.LastError,
+		"next_retry":   nextRetry,
+		"attempts":     n.Attempts,
+		"lag_ms":       lagMs,
+	}
+}
+
+// ServerList returns the network's servers in order. Networks configured
+// before server lists existed have only their Hostname/Port server.
+func (n *UserNetwork) ServerList() []NetworkServer {
+	if len(n.Servers) > 0 {
+		return n.Servers
+	}
+	return []NetworkServer{{
+		Hostname:          n.Hostname,
+		Port:              n.Port,
+		UseSSL:            n.UseSSL,
+		Password:          n.ServerPassword,
+		PinnedFingerprint: n.TLSPinnedFingerprint,
+	}}
+}
+
+// PinnedFingerprint returns the certificate fingerprint pinned for the server
+// at index, or "" if none is pinned yet.
+func (n *UserNetwork) PinnedFingerprint(index int) string {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+	if index < len(n.Servers) {
+		return n.Servers[index].PinnedFingerprint
+	}
+	return n.TLSPinnedFingerprint
+}
+
+// SetPinnedFingerprint pins the server at index to a certificate. The first
+// server's pin is also the network's TLSPinnedFingerprint.
+func (n *UserNetwork) SetPinnedFingerprint(index int, fingerprint string) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	if index < len(n.Servers) {
+		n.Servers[index].PinnedFingerprint = fingerprint
+	}
+	if index == 0 {
+		n.TLSPinnedFingerprint = fingerprint
+	}
+}
+
+// ApplySettings replaces the network's configuration with that of settings,
+// leaving its live connection state alone.
+func (n *UserNetwork) ApplySettings(settings *UserNetwork) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+	n.NetworkName = settings.NetworkName
+	n.Hostname = settings.Hostname
+	n.Port = settings.Port
+	n.UseSSL = settings.UseSSL
+	n.ServerPassword = settings.ServerPassword
+	n.Servers = settings.Servers
+	n.ServerIndex = settings.ServerIndex
+	n.AutoReconnect = settings.AutoReconnect
+	n.Modules = settings.Modules
+	n.PerformCommands = settings.PerformCommands
+	n.InitialChannels = settings.InitialChannels
+	n.Nickname = settings.Nickname
+	n.AltNickname = settings.AltNickname
+	n.Ident = settings.Ident
+	n.Realname = settings.Realname
+	n.QuitMessage = settings.QuitMessage
+	n.SASLMechanism = settings.SASLMechanism
+	n.SASLUsername = settings.SASLUsername
+	n.SASLPassword = settings.SASLPassword
+	n.NickServPassword = settings.NickServPassword
+	n.TLSVerifyMode = settings.TLSVerifyMode
+	n.TLSPinnedFingerprint = settings.TLSPinnedFingerprint
+	n.ProxyURL = settings.ProxyURL
+	n.ProxyPassword = settings.ProxyPassword
+	n.BindAddress = settings.BindAddress
+	n.AddressFamily = settings.AddressFamily
 }
 
 type UserSession struct {
-	Token       string
 	Username    string
 	Password    string
 	FCMToken    string
 	WebSockets  []*websocket.Conn
+	WebSocketLogins map[*websocket.Conn]int // Login session (sessions table ID) of each WebSocket
 	WsMutex     sync.Mutex
 	Mutex       sync.RWMutex
 	IsAway      bool
@@ -74,8 +226,26 @@ type UserSession struct {
 	// Map of network ID to UserNetwork for this session
 	// This will hold the *live* IRC connections and their states
 	Networks map[int]*UserNetwork
+
+	// DMs and mentions received while no client was connected
+	Missed []MissedMessage
 }
 
+// MissedMessage is a DM or mention that arrived while none of the user's
+// clients were connected. Missed messages are handed to the next client in
+// its initial state.
+type MissedMessage struct {
+	NetworkID   int       `json:"network_id"`
+	ChannelName string    `json:"channel_name"`
+	Sender      string    `json:"sender"`
+	Text        string    `json:"text"`
+	Type        string    `json:"type"` // "dm" or "mention"
+	Time        time.Time `json:"time"`
+}
+
+// Most missed messages kept per user; the oldest are dropped first.
+const maxMissedMessages = 500
+
 func NewUserSession(username string) *UserSession {
 	return &UserSession{
 		Username: username,
@@ -89,11 +259,52 @@ func (s *UserSession) IsActive() bool {
 	return len(s.WebSockets) > 0
 }
 
-// AddWebSocket adds a WebSocket connection to the session.
-func (s *UserSession) AddWebSocket(conn *websocket.Conn) {
+// AddMissedMessage buffers a DM or mention for the user's next client.
+func (s *UserSession) AddMissedMessage(msg MissedMessage) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	s.Missed = append(s.Missed, msg)
+	if len(s.Missed) > maxMissedMessages {
+		s.Missed = append([]MissedMessage(nil), s.Missed[len(s.Missed)-maxMissedMessages:]...)
+	}
+}
+
+// TakeMissedMessages returns the buffered DMs and mentions and clears the buffer.
+func (s *UserSession) TakeMissedMessages() []MissedMessage {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	missed := s.Missed
+	s.Missed = nil
+	if missed == nil {
+		missed = []MissedMessage{}
+	}
+	return missed
+}
+
+// AddWebSocket adds a WebSocket connection opened with the given login session.
+func (s *UserSession) AddWebSocket(conn *websocket.Conn, loginID int) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 	s.WebSockets = append(s.WebSockets, conn)
+	if s.WebSocketLogins == nil {
+		s.WebSocketLogins = make(map[*websocket.Conn]int)
+	}
+	s.WebSocketLogins[conn] = loginID
+}
+
+// CloseWebSockets closes the WebSockets whose login session matches, so a
+// revoked token loses its connections at once. It returns how many it closed.
+func (s *UserSession) CloseWebSockets(match func(loginID int) bool) int {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	closed := 0
+	for _, conn := range s.WebSockets {
+		if match(s.WebSocketLogins[conn]) {
+			conn.Close() // The connection's reader removes it from the session
+			closed++
+		}
+	}
+	return closed
 }
 
 // RemoveWebSocket removes a WebSocket connection from the session.
@@ -103,6 +314,7 @@ func (s *UserSession) RemoveWebSocket(conn *websocket.Conn) {
 	for i, ws := range s.WebSockets {
 		if ws == conn {
 			s.WebSockets = append(s.WebSockets[:i], s.WebSockets[i+1:]...)
+			delete(s.WebSocketLogins, conn)
 			break
 		}
 	}
@@ -133,84 +345,89 @@ func (s *UserSession) Broadcast(eventType string, payload any) {
 	}
 }
 
-// ForEachSession iterates over all active user sessions.
+// ForEachSession iterates over all user sessions, once per user.
 func ForEachSession(callback func(s *UserSession)) {
 	mutex.RLock()
 	defer mutex.RUnlock()
-	for _, s := range sessionMap {
+	for _, s := range userSessions {
 		callback(s)
 	}
 }
 
-// FindSessionTokenByUsername finds an existing session token for a given username.
-func FindSessionTokenByUsername(username string) (string, bool) {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	for token, sess := range sessionMap {
-		if strings.EqualFold(sess.Username, username) {
-			return token, true
-		}
-	}
-	return "", false
-}
-
 var (
-	sessionMap = make(map[string]*UserSession)
-	mutex      = sync.RWMutex{}
+	// Each user has one session, which outlives logins while the bouncer keeps
+	// their networks connected. Login tokens are kept in the database.
+	userSessions = make(map[int]*UserSession)
+	mutex        = sync.RWMutex{}
 )
 
-func AddSession(token string, s *UserSession) {
+// GetOrCreateUserSession returns the user's session, creating it if the user
+// has none. The second result reports whether it was created.
+func GetOrCreateUserSession(userID int, username string) (*UserSession, bool) {
 	mutex.Lock()
 	defer mutex.Unlock()
-	s.Token = token
-	sessionMap[token] = s
+	if sess, ok := userSessions[userID]; ok {
+		return sess, false
+	}
+	sess := NewUserSession(username)
+	sess.UserID = userID
+	userSessions[userID] = sess
+	return sess, true
 }
 
-func GetSession(token string) (*UserSession, bool) {
-	mutex.RLock()
-	defer mutex.RUnlock()
-	sess, found := sessionMap[token]
-	return sess, found
+// networkDisconnecter ends a network's connection; the irc package provides
+// it with SetNetworkDisconnecter, since this package can't import it.
+var networkDisconnecter = func(s *UserSession, netConfig *UserNetwork) {
+	netConfig.Mutex.Lock()
+	if netConfig.RetryTimer != nil {
+		netConfig.RetryTimer.Stop()
+		netConfig.RetryTimer = nil
+	}
+	netConfig.State = StateDisconnecting // Keeps the DISCONNECT handler from retrying
+	conn := netConfig.IRC
+	netConfig.Mutex.Unlock()
+	if conn != nil {
+		conn.Quit()
+	}
+}
+
+// SetNetworkDisconnecter sets how RemoveSession disconnects each network.
+func SetNetworkDisconnecter(disconnect func(s *UserSession, netConfig *UserNetwork)) {
+	networkDisconnecter = disconnect
 }
 
-// RemoveSession cleans up all resources associated with a session, including IRC connections.
-func RemoveSession(token string) {
+// RemoveSession cleans up all resources associated with a user's session, including IRC connections.
+func RemoveSession(userID int) {
+	// Only take the session out under the locks: disconnecting waits for the
+	// connection's callbacks, which need them
 	mutex.Lock()
-	defer mutex.Unlock()
-	if sess, ok := sessionMap[token]; ok {
-		sess.Mutex.Lock()
-		defer sess.Mutex.Unlock()
+	sess, ok := userSessions[userID]
+	if !ok {
+		mutex.Unlock()
+		return
+	}
+	delete(userSessions, userID)
+	sess.Mutex.Lock()
+	sockets := sess.WebSockets
+	sess.WebSockets = nil
+	sess.WebSocketLogins = nil
+	networks := make([]*UserNetwork, 0, len(sess.Networks))
+	for _, netConfig := range sess.Networks {
+		networks = append(networks, netConfig)
+	}
+	sess.Mutex.Unlock()
+	mutex.Unlock()
 
-		// Close all WebSocket connections gracefully
-		for _, conn := range sess.WebSockets {
-			conn.Close()
-		}
-		sess.WebSockets = nil
-
-		// Disconnect all IRC connections
-		for _, netConfig := range sess.Networks {
-			if netConfig.IRC != nil {
-				log.Printf("Disconnecting IRC for user %s, network %s", sess.Username, netConfig.NetworkName)
-				netConfig.IRC.Quit()
-				// The ircevent library usually closes the underlying connection after Quit
-				// but adding a Disconnect call if available on the type is safer.
-				if disconnecter, ok := interface{}(netConfig.IRC).(interface{ Disconnect() }); ok {
-					disconnecter.Disconnect()
-				}
-				netConfig.IRC = nil
-				netConfig.IsConnected = false
-			}
-		}
-		delete(sessionMap, token)
+	// Close all WebSocket connections gracefully
+	for _, conn := range sockets {
+		conn.Close()
 	}
-}
 
-// UnmapToken only removes the token from the session map, it does not close connections.
-// This is used when re-issuing a token for an existing session.
-func UnmapToken(token string) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	delete(sessionMap, token)
+	// Disconnect all IRC connections
+	for _, netConfig := range networks {
+		log.Printf("Disconnecting IRC for user %s, network %s", sess.Username, netConfig.NetworkName)
+		networkDisconnecter(sess, netConfig)
+	}
 }
 
 // SetAway sends an AWAY message to all connected IRC networks for the user.
@@ -219,7 +436,7 @@ func (s *UserSession) SetAway(message string) {
 	s.IsAway = true
 	s.AwayMessage = message
 	for _, netConfig := range s.Networks {
-		if netConfig.IRC != nil && netConfig.IsConnected {
+		if netConfig.IsConnected() {
 			netConfig.IRC.SendRawf("AWAY :%s", message)
 		}
 	}
@@ -236,7 +453,7 @@ func (s *UserSession) SetBack() {
 	s.IsAway = false
 	s.AwayMessage = ""
 	for _, netConfig := range s.Networks {
-		if netConfig.IRC != nil && netConfig.IsConnected {
+		if netConfig.IsConnected() {
 			netConfig.IRC.SendRaw("BACK")
 		}
 	}
@@ -256,8 +473,23 @@ func (s *UserSession) GetNetwork(networkID int) (*UserNetwork, bool) {
 	return netConfig, ok
 }
 
+// ParseChannelEntry splits a channel entry such as "#channel" or "#channel key"
+// into the channel name and its (possibly empty) key.
+func ParseChannelEntry(entry string) (string, string) {
+	fields := strings.Fields(entry)
+	switch len(fields) {
+	case 0:
+		return "", ""
+	case 1:
+		return fields[0], ""
+	default:
+		return fields[0], fields[1]
+	}
+}
+
 // AddChannelToNetwork adds a channel to a specific network's state for the user.
-func (un *UserNetwork) AddChannelToNetwork(channelName string) {
+// The key is remembered so the channel can be rejoined later.
+func (un *UserNetwork) AddChannelToNetwork(channelName, key string) {
 	normalizedChannelName := strings.ToLower(channelName)
 	un.Mutex.Lock()
 	defer un.Mutex.Unlock()
@@ -266,13 +498,21 @@ func (un *UserNetwork) AddChannelToNetwork(channelName string) {
 		un.Channels = make(map[string]*ChannelState)
 	}
 
-	if _, ok := un.Channels[normalizedChannelName]; !ok {
-		un.Channels[normalizedChannelName] = &ChannelState{
-			Name:       channelName,
-			Topic:      "",
-			Members:    []ChannelMember{},
-			LastUpdate: time.Now(),
+	if existing, ok := un.Channels[normalizedChannelName]; ok {
+		if key != "" {
+			existing.Mutex.Lock()
+			existing.Key = key
+			existing.Mutex.Unlock()
 		}
+		return
+	}
+
+	un.Channels[normalizedChannelName] = &ChannelState{
+		Name:       channelName,
+		Key:        key,
+		Topic:      "",
+		Members:    []ChannelMember{},
+		LastUpdate: time.Now(),
 	}
 }
 
@@ -413,42 +653,16 @@ func (un *UserNetwork) UpdateAwayStatusForNetworkMember(nick string, isAway bool
 	}
 }
 
-// GetSessionByUserID is a helper function to retrieve a UserSession by UserID.
-// This is needed because `sessionMap` is keyed by token, not UserID.
-// This might be inefficient for many users and could be optimized with another map.
+// GetSessionByUserID returns the user's session, including one started by the
+// bouncer that no client has logged in to yet.
 func GetSessionByUserID(userID int) (*UserSession, bool) {
 	mutex.RLock()
 	defer mutex.RUnlock()
-	for _, sess := range sessionMap {
-		// Assuming Username can be mapped back to UserID from users.User
-		// For now, we'll just check if the username exists in any session.
-		// A proper implementation would likely need a map[int]*UserSession.
-		// For this refactor, we'll assume `users.GetUserByUsername` can fetch the ID.
-		// This will require modifying `UserSession` to store `UserID`.
-		// (Assuming `sess.UserID` is now populated during login)
-		if sess.UserID == userID {
-			return sess, true
-		}
-	}
-	return nil, false
+	sess, found := userSessions[userID]
+	return sess, found
 }
 
 // Add UserID to UserSession to enable GetSessionByUserID
 func (s *UserSession) SetUserID(id int) {
 	s.UserID = id
 }
-
-// ReconnectNetwork is a placeholder to resolve circular dependency.
-// The actual reconnection logic is orchestrated in handlers/irc_networks.go
-// This method serves to allow irc_client.go to trigger a reconnection attempt
-// on the session object, which then calls the handler.
-func (s *UserSession) ReconnectNetwork(networkID int) {
-	// This function is intentionally left empty here to break a circular dependency
-	// between session and handlers/irc_networks. The actual re-connection logic
-	// is now handled by a dedicated function in handlers/irc_networks.go,
-	// which can be called by irc_client.go via a function reference passed during
-	// connection establishment, or by looking up the session.
-	// For now, this is a no-op that satisfies the interface requirement if any.
-	// The primary trigger for auto-reconnect will be the DISCONNECT callback in irc_client.go
-	// which will call the public ReconnectNetwork function in handlers.
-}
\ No newline at end of file
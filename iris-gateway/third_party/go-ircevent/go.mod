@@ -0,0 +1,8 @@
+module github.com/thoj/go-ircevent
+
+go 1.12
+
+require (
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
+	golang.org/x/text v0.3.6
+)
@@ -0,0 +1,314 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers a client over an in-memory connection. reply is called
+// with every line the client sends and returns the lines to send back.
+type fakeServer struct {
+	conn  net.Conn
+	reply func(line string) []string
+
+	mu       sync.Mutex
+	received []string
+}
+
+// connectFake connects irccon to a fake server and returns the server and
+// the error from Connect.
+func connectFake(t *testing.T, irccon *Connection, reply func(line string) []string) (*fakeServer, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	fake := &fakeServer{conn: server, reply: reply}
+	go fake.serve()
+
+	irccon.Log = log.New(ioutil.Discard, "", 0)
+	irccon.Dial = func(network, addr string) (net.Conn, error) {
+		return client, nil
+	}
+	err := irccon.Connect("irc.example.org:6667")
+	t.Cleanup(func() {
+		server.Close()
+		if err == nil {
+			irccon.Disconnect()
+		}
+	})
+	return fake, err
+}
+
+func (s *fakeServer) serve() {
+	scanner := bufio.NewScanner(s.conn)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		s.mu.Lock()
+		s.received = append(s.received, line)
+		s.mu.Unlock()
+		for _, response := range s.reply(line) {
+			if _, err := fmt.Fprintf(s.conn, "%s\r\n", response); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// lines returns the lines the client has sent so far.
+func (s *fakeServer) lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// waitFor waits for the client to send line, which it may still have queued
+// when Connect returns, and returns its position, or -1 if it isn't sent.
+func (s *fakeServer) waitFor(line string) int {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if i := s.index(line); i >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// index returns the position of the first line the client sent that equals
+// line, or -1.
+func (s *fakeServer) index(line string) int {
+	for i, received := range s.lines() {
+		if received == line {
+			return i
+		}
+	}
+	return -1
+}
+
+// capServer returns a reply function offering caps with CAP LS and handing
+// other lines to next.
+func capServer(caps string, next func(line string) []string) func(line string) []string {
+	return func(line string) []string {
+		if line == "CAP LS 302" {
+			return []string{":irc.example.org CAP * LS :" + caps}
+		}
+		if next != nil {
+			return next(line)
+		}
+		return nil
+	}
+}
+
+// ackAll acknowledges every CAP REQ.
+func ackAll(line string) []string {
+	if strings.HasPrefix(line, "CAP REQ :") {
+		return []string{":irc.example.org CAP * ACK :" + strings.TrimPrefix(line, "CAP REQ :")}
+	}
+	return nil
+}
+
+// plainServer acknowledges every CAP REQ and accepts the SASL PLAIN
+// credentials login and password.
+func plainServer(caps, login, password string) func(line string) []string {
+	want := "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(login+"\x00"+login+"\x00"+password))
+	return capServer(caps, func(line string) []string {
+		switch {
+		case strings.HasPrefix(line, "CAP REQ :"):
+			return ackAll(line)
+		case line == "AUTHENTICATE PLAIN":
+			return []string{"AUTHENTICATE +"}
+		case line == want:
+			return []string{
+				":irc.example.org 900 test test!test@host test :You are now logged in as test",
+				":irc.example.org 903 test :SASL authentication successful",
+			}
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			return []string{":irc.example.org 904 test :SASL authentication failed"}
+		}
+		return nil
+	})
+}
+
+func TestCapRequestsOfferedCaps(t *testing.T) {
+	irccon := IRC("test", "test")
+	irccon.RequestCaps = []string{"server-time", "away-notify", "multi-prefix"}
+	server, err := connectFake(t, irccon, capServer("multi-prefix server-time sasl=PLAIN,EXTERNAL", ackAll))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	if server.index("CAP REQ :server-time multi-prefix") < 0 {
+		t.Errorf("client didn't request just the offered caps, sent %q", server.lines())
+	}
+	if got := strings.Join(irccon.AcknowledgedCaps, " "); got != "server-time multi-prefix" {
+		t.Errorf("AcknowledgedCaps = %q, want server-time multi-prefix", got)
+	}
+	if irccon.AvailableCaps["sasl"] != "PLAIN,EXTERNAL" {
+		t.Errorf("sasl cap value = %q, want PLAIN,EXTERNAL", irccon.AvailableCaps["sasl"])
+	}
+	if server.waitFor("CAP END") < 0 {
+		t.Errorf("client didn't end negotiation")
+	}
+}
+
+func TestCapLSMultiline(t *testing.T) {
+	irccon := IRC("test", "test")
+	irccon.RequestCaps = []string{"server-time", "away-notify"}
+	server, err := connectFake(t, irccon, func(line string) []string {
+		if line == "CAP LS 302" {
+			return []string{
+				":irc.example.org CAP * LS * :multi-prefix server-time",
+				":irc.example.org CAP * LS :away-notify",
+			}
+		}
+		return ackAll(line)
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if server.index("CAP REQ :server-time away-notify") < 0 {
+		t.Errorf("client didn't request caps from both LS lines, sent %q", server.lines())
+	}
+}
+
+func TestSASLPlain(t *testing.T) {
+	irccon := IRC("test", "test")
+	irccon.UseSASL = true
+	irccon.SASLLogin = "test"
+	irccon.SASLPassword = "secret"
+	server, err := connectFake(t, irccon, plainServer("sasl=PLAIN", "test", "secret"))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	end := server.waitFor("CAP END")
+	if end < 0 || end < server.index("AUTHENTICATE PLAIN") {
+		t.Errorf("CAP END wasn't sent after authenticating, sent %q", server.lines())
+	}
+}
+
+func TestSASLFailure(t *testing.T) {
+	irccon := IRC("test", "test")
+	irccon.UseSASL = true
+	irccon.SASLLogin = "test"
+	irccon.SASLPassword = "wrong"
+	server, err := connectFake(t, irccon, plainServer("sasl", "test", "secret"))
+	if err == nil {
+		t.Fatalf("Connect succeeded with a wrong password")
+	}
+	if !strings.Contains(err.Error(), "904") {
+		t.Errorf("error %q doesn't mention the 904 numeric", err)
+	}
+	if server.waitFor("CAP END") < 0 {
+		t.Errorf("client didn't end negotiation after the failure")
+	}
+}
+
+func TestSASLMechanismNotOffered(t *testing.T) {
+	irccon := IRC("test", "test")
+	irccon.UseSASL = true
+	irccon.SASLLogin = "test"
+	irccon.SASLPassword = "secret"
+	server, err := connectFake(t, irccon, plainServer("sasl=EXTERNAL", "test", "secret"))
+	if err == nil || !strings.Contains(err.Error(), "PLAIN") {
+		t.Fatalf("Connect: got %v, want an error about PLAIN", err)
+	}
+	if server.index("AUTHENTICATE PLAIN") >= 0 {
+		t.Errorf("client tried a mechanism the server doesn't offer")
+	}
+}
+
+func TestSASLRetriedAfterNAK(t *testing.T) {
+	irccon := IRC("test", "test")
+	irccon.RequestCaps = []string{"server-time"}
+	irccon.UseSASL = true
+	irccon.SASLLogin = "test"
+	irccon.SASLPassword = "secret"
+	plain := plainServer("server-time sasl", "test", "secret")
+	server, err := connectFake(t, irccon, func(line string) []string {
+		// The server refuses to grant server-time, and with it the whole REQ
+		if strings.HasPrefix(line, "CAP REQ :") && strings.Contains(line, "server-time") {
+			return []string{":irc.example.org CAP * NAK :" + strings.TrimPrefix(line, "CAP REQ :")}
+		}
+		return plain(line)
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if server.index("CAP REQ :sasl") < 0 {
+		t.Errorf("client didn't request sasl on its own, sent %q", server.lines())
+	}
+	if !containsString(irccon.AcknowledgedCaps, "sasl") || containsString(irccon.AcknowledgedCaps, "server-time") {
+		t.Errorf("AcknowledgedCaps = %q, want only sasl", irccon.AcknowledgedCaps)
+	}
+}
+
+// recordingMechanism returns response and records the challenges it gets.
+type recordingMechanism struct {
+	response   []byte
+	challenges [][]byte
+}
+
+func (m *recordingMechanism) Name() string { return "TEST" }
+
+func (m *recordingMechanism) Next(challenge []byte) ([]byte, error) {
+	m.challenges = append(m.challenges, challenge)
+	return m.response, nil
+}
+
+func TestSASLChunking(t *testing.T) {
+	// 300 bytes encode to exactly 400 characters, so an empty line must
+	// follow; 450 bytes are sent as 400 characters and the rest.
+	for _, size := range []int{300, 450} {
+		mech := &recordingMechanism{response: []byte(strings.Repeat("x", size))}
+		challenge := strings.Repeat("c", 400)
+		encodedChallenge := base64.StdEncoding.EncodeToString([]byte(challenge))
+
+		var authenticate []string
+		var mu sync.Mutex
+		irccon := IRC("test", "test")
+		irccon.UseSASL = true
+		irccon.SASLMechanism = mech
+		_, err := connectFake(t, irccon, capServer("sasl=TEST", func(line string) []string {
+			switch {
+			case strings.HasPrefix(line, "CAP REQ :"):
+				return ackAll(line)
+			case line == "AUTHENTICATE TEST":
+				// A challenge longer than one line, split like the response
+				return []string{
+					"AUTHENTICATE " + encodedChallenge[:400],
+					"AUTHENTICATE " + encodedChallenge[400:],
+				}
+			case strings.HasPrefix(line, "AUTHENTICATE "):
+				mu.Lock()
+				defer mu.Unlock()
+				chunk := strings.TrimPrefix(line, "AUTHENTICATE ")
+				authenticate = append(authenticate, chunk)
+				if len(chunk) < 400 {
+					return []string{":irc.example.org 903 test :SASL authentication successful"}
+				}
+			}
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("Connect with a %d byte response: %v", size, err)
+		}
+
+		if len(mech.challenges) != 1 || string(mech.challenges[0]) != challenge {
+			t.Errorf("mechanism got challenges %q, want the one split challenge", mech.challenges)
+		}
+		mu.Lock()
+		encoded := base64.StdEncoding.EncodeToString(mech.response)
+		want := []string{encoded[:400], encoded[400:]}
+		if want[1] == "" {
+			want[1] = "+"
+		}
+		if strings.Join(authenticate, " ") != strings.Join(want, " ") {
+			t.Errorf("%d byte response sent as %q, want %q", size, authenticate, want)
+		}
+		mu.Unlock()
+	}
+}
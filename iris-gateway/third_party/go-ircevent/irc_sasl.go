@@ -0,0 +1,149 @@
+package irc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type SASLResult struct {
+	Failed bool
+	Err    error
+}
+
+// A SASLMechanism implements the client side of a SASL authentication
+// exchange. Set Connection.SASLMechanism to use a mechanism other than the
+// built-in PLAIN and EXTERNAL ones.
+type SASLMechanism interface {
+	// Name returns the mechanism name sent with "AUTHENTICATE <name>".
+	Name() string
+	// Next returns the response to a decoded server challenge. The first
+	// challenge of an exchange is empty.
+	Next(challenge []byte) ([]byte, error)
+}
+
+type plainMechanism struct {
+	login    string
+	password string
+}
+
+func (m *plainMechanism) Name() string { return "PLAIN" }
+
+func (m *plainMechanism) Next(challenge []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%s", m.login, m.login, m.password)), nil
+}
+
+type externalMechanism struct{}
+
+func (m *externalMechanism) Name() string { return "EXTERNAL" }
+
+func (m *externalMechanism) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// Maximum length of a single AUTHENTICATE payload, as defined by the IRCv3 SASL spec.
+const saslChunkSize = 400
+
+// Check if a space-separated list of arguments contains a value.
+func listContains(list string, value string) bool {
+	for _, arg_name := range strings.Split(strings.TrimSpace(list), " ") {
+		if arg_name == value {
+			return true
+		}
+	}
+	return false
+}
+
+// saslMechanism returns the mechanism configured for this connection.
+func (irc *Connection) saslMechanism() (SASLMechanism, error) {
+	if irc.SASLMechanism != nil {
+		return irc.SASLMechanism, nil
+	}
+	switch irc.SASLMech {
+	case "PLAIN":
+		return &plainMechanism{irc.SASLLogin, irc.SASLPassword}, nil
+	case "EXTERNAL":
+		return &externalMechanism{}, nil
+	}
+	return nil, errors.New("only PLAIN and EXTERNAL supported")
+}
+
+// sendAuthenticate sends a SASL response, split into chunks as required.
+func (irc *Connection) sendAuthenticate(response []byte) {
+	encoded := base64.StdEncoding.EncodeToString(response)
+	for len(encoded) >= saslChunkSize {
+		irc.SendRaw("AUTHENTICATE " + encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+	if encoded == "" {
+		// Either an empty response or the last chunk was exactly saslChunkSize long.
+		encoded = "+"
+	}
+	irc.SendRaw("AUTHENTICATE " + encoded)
+}
+
+func (irc *Connection) setupSASLCallbacks(mech SASLMechanism, result chan<- *SASLResult) (callbacks []CallbackID) {
+	var challenge strings.Builder
+
+	// Only the first result matters; never block the read loop on later ones.
+	report := func(res *SASLResult) {
+		select {
+		case result <- res:
+		default:
+		}
+	}
+
+	id := irc.AddCallback("AUTHENTICATE", func(e *Event) {
+		chunk := e.Message()
+		if chunk != "+" {
+			challenge.WriteString(chunk)
+		}
+		if len(chunk) == saslChunkSize {
+			// More of this challenge is on its way.
+			return
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(challenge.String())
+		challenge.Reset()
+		if err != nil {
+			irc.SendRaw("AUTHENTICATE *")
+			report(&SASLResult{true, fmt.Errorf("invalid SASL challenge: %v", err)})
+			return
+		}
+
+		response, err := mech.Next(decoded)
+		if err != nil {
+			irc.SendRaw("AUTHENTICATE *")
+			report(&SASLResult{true, err})
+			return
+		}
+		irc.sendAuthenticate(response)
+	})
+	callbacks = append(callbacks, CallbackID{"AUTHENTICATE", id})
+
+	fail := func(code, reason string) func(e *Event) {
+		return func(e *Event) {
+			report(&SASLResult{true, fmt.Errorf("%s (%s): %s", reason, code, e.Message())})
+		}
+	}
+	for code, reason := range map[string]string{
+		"902": "SASL authentication failed, nick locked",
+		"904": "SASL authentication failed",
+		"905": "SASL message too long",
+		"906": "SASL authentication aborted",
+	} {
+		id = irc.AddCallback(code, fail(code, reason))
+		callbacks = append(callbacks, CallbackID{code, id})
+	}
+
+	// 903 is a successful login; 907 means we were already authenticated.
+	for _, code := range []string{"903", "907"} {
+		id = irc.AddCallback(code, func(e *Event) {
+			report(&SASLResult{false, nil})
+		})
+		callbacks = append(callbacks, CallbackID{code, id})
+	}
+
+	return
+}
@@ -0,0 +1,95 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The RFC 6238 appendix B secret "12345678901234567890", base32-encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B SHA-1 test vectors, cut to six digits as the last six
+// of the eight the RFC lists.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, vector := range rfcVectors {
+		code, err := Code(rfcSecret, Step(time.Unix(vector.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", vector.unix, err)
+		}
+		if code != vector.code {
+			t.Errorf("Code at %d = %s, want %s", vector.unix, code, vector.code)
+		}
+	}
+}
+
+func TestValidateRFC6238(t *testing.T) {
+	for _, vector := range rfcVectors {
+		now := time.Unix(vector.unix, 0)
+		step, ok := Validate(rfcSecret, vector.code, now, 0)
+		if !ok {
+			t.Errorf("Validate rejected %s at %d", vector.code, vector.unix)
+			continue
+		}
+		if step != Step(now) {
+			t.Errorf("Validate at %d matched step %d, want %d", vector.unix, step, Step(now))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, err := Code(rfcSecret, current+offset)
+		if err != nil {
+			t.Fatalf("Code: %v", err)
+		}
+		_, ok := Validate(rfcSecret, code, now, 0)
+		if want := offset >= -skew && offset <= skew; ok != want {
+			t.Errorf("code %d steps away: accepted %t, want %t", offset, ok, want)
+		}
+	}
+}
+
+func TestValidateRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step, ok := Validate(rfcSecret, "005924", now, 0)
+	if !ok {
+		t.Fatalf("first use rejected")
+	}
+	if _, ok := Validate(rfcSecret, "005924", now, step); ok {
+		t.Errorf("the same code was accepted twice")
+	}
+	// Nor is the code of an earlier step once a later one was used
+	earlier, err := Code(rfcSecret, step-1)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	if _, ok := Validate(rfcSecret, earlier, now, step); ok {
+		t.Errorf("a code older than the last accepted one was accepted")
+	}
+}
+
+func TestValidateFormatting(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	if _, ok := Validate(rfcSecret, " 005 924 ", now, 0); !ok {
+		t.Errorf("code with spaces rejected")
+	}
+	for _, code := range []string{"", "05924", "0005924", "123456"} {
+		if _, ok := Validate(rfcSecret, code, now, 0); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package users
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APITokenPrefix starts every API token, so they can't be mistaken for login
+// tokens and are easy to find in leaked text.
+const APITokenPrefix = "iris_pat_"
+
+// Scopes an API token can be granted. Each may be narrowed to one network
+// with ":<network ID>", and scopes that deal with messages to one channel or
+// nick on it with ":<network ID>/<target>".
+const (
+	ScopeHistoryRead    = "history:read"
+	ScopeMessagesSend   = "messages:send"
+	ScopeNetworksManage = "networks:manage"
+)
+
+var (
+	// ErrAPITokenNotFound is returned for a token that is unknown, expired
+	// or revoked, or whose user is suspended.
+	ErrAPITokenNotFound = errors.New("API token not found")
+	// ErrInvalidScope wraps the reason a scope was refused.
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// APIToken is a personal access token for scripts and bots.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Username   string     `json:"-"`
+	Name       string     `json:"name"`
+	TokenHint  string     `json:"token_hint"` // Last characters of the token, to tell tokens apart
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastIP     string     `json:"last_ip,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // Never expires if nil
+}
+
+const apiTokenHintLength = 4
+
+// ParseScope splits a scope into its base scope, network ID (0 for all
+// networks) and target (empty for all targets).
+func ParseScope(scope string) (base string, networkID int, target string, err error) {
+	parts := strings.SplitN(scope, ":", 3)
+	if len(parts) < 2 {
+		return "", 0, "", fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+	}
+	base = parts[0] + ":" + parts[1]
+	switch base {
+	case ScopeHistoryRead, ScopeMessagesSend, ScopeNetworksManage:
+	default:
+		return "", 0, "", fmt.Errorf("%w: unknown scope %q", ErrInvalidScope, base)
+	}
+	if len(parts) == 2 {
+		return base, 0, "", nil
+	}
+
+	network, target, _ := strings.Cut(parts[2], "/")
+	networkID, err = strconv.Atoi(network)
+	if err != nil || networkID <= 0 {
+		return "", 0, "", fmt.Errorf("%w: %q has an invalid network ID", ErrInvalidScope, scope)
+	}
+	if strings.Contains(parts[2], "/") && (target == "" || strings.ContainsAny(target, " ,")) {
+		return "", 0, "", fmt.Errorf("%w: %q has an invalid target", ErrInvalidScope, scope)
+	}
+	if target != "" && base == ScopeNetworksManage {
+		return "", 0, "", fmt.Errorf("%w: %s can only be narrowed to a network", ErrInvalidScope, base)
+	}
+	return base, networkID, strings.ToLower(target), nil
+}
+
+// Allows reports whether the token grants scope for a network and target.
+// A networkID of 0 asks for the scope across all networks, and an empty
+// target for all targets on the network.
+func (t *APIToken) Allows(scope string, networkID int, target string) bool {
+	for _, granted := range t.Scopes {
+		base, grantedNetwork, grantedTarget, err := ParseScope(granted)
+		if err != nil || base != scope {
+			continue
+		}
+		if grantedNetwork == 0 {
+			return true
+		}
+		if grantedNetwork != networkID {
+			continue
+		}
+		if grantedTarget == "" || grantedTarget == strings.ToLower(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the token grants scope for anything at all.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if base, _, _, err := ParseScope(granted); err == nil && base == scope {
+			return true
+		}
+	}
+	return false
+}
+
+const apiTokenColumnsSQL = `t.id, t.user_id, u.username, t.name, t.token_hint, t.scopes, t.created_at, t.last_used_at, t.last_ip, t.expires_at`
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	token := &APIToken{}
+	var scopes string
+	var lastUsedAt, expiresAt sql.NullTime
+	var lastIP sql.NullString
+	if err := row.Scan(&token.ID, &token.UserID, &token.Username, &token.Name, &token.TokenHint, &scopes, &token.CreatedAt, &lastUsedAt, &lastIP, &expiresAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &token.Scopes); err != nil {
+		return nil, fmt.Errorf("invalid scopes of API token %d: %w", token.ID, err)
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	token.LastIP = lastIP.String
+	return token, nil
+}
+
+// CreateAPIToken issues an API token with the given scopes, expiring at
+// expiresAt unless it is nil. Only a hash of the token is stored, so it is
+// returned here and never again.
+func CreateAPIToken(userID int, name string, scopes []string, expiresAt *time.Time) (string, *APIToken, error) {
+	for _, scope := range scopes {
+		if _, _, _, err := ParseScope(scope); err != nil {
+			return "", nil, err
+		}
+	}
+	encodedScopes, err := json.Marshal(scopes)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode scopes: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := APITokenPrefix + hex.EncodeToString(raw)
+
+	var expires interface{}
+	if expiresAt != nil {
+		expires = expiresAt.UTC()
+	}
+	result, err := db.Exec(
+		"INSERT INTO api_tokens (user_id, name, token_hash, token_hint, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, name, hashToken(token), token[len(token)-apiTokenHintLength:], string(encodedScopes), time.Now().UTC(), expires,
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create API token: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get API token ID: %w", err)
+	}
+	stored, err := scanAPIToken(db.QueryRow("SELECT "+apiTokenColumnsSQL+" FROM api_tokens t JOIN users u ON u.id = t.user_id WHERE t.id = ?", id))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read API token: %w", err)
+	}
+	return token, stored, nil
+}
+
+// GetAPIToken returns the unexpired API token for a token string, if its
+// user isn't suspended.
+func GetAPIToken(token string) (*APIToken, error) {
+	stored, err := scanAPIToken(db.QueryRow(`
+		SELECT `+apiTokenColumnsSQL+`
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ? AND u.is_suspended = FALSE`,
+		hashToken(token),
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAPITokenNotFound
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	if stored.ExpiresAt != nil && time.Now().After(*stored.ExpiresAt) {
+		return nil, ErrAPITokenNotFound
+	}
+	return stored, nil
+}
+
+// TouchAPIToken records that an API token was used from ip.
+func TouchAPIToken(tokenID int, ip string) error {
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ?, last_ip = ? WHERE id = ?", time.Now().UTC(), ip, tokenID); err != nil {
+		return fmt.Errorf("failed to update API token: %w", err)
+	}
+	return nil
+}
+
+// ListAPITokens returns a user's API tokens, newest first, including expired
+// ones so their owner can see why a script stopped working.
+func ListAPITokens(userID int) ([]*APIToken, error) {
+	rows, err := db.Query(`
+		SELECT `+apiTokenColumnsSQL+`
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.user_id = ? ORDER BY t.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// CountAPITokens returns how many API tokens a user has.
+func CountAPITokens(userID int) (int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count API tokens: %w", err)
+	}
+	return count, nil
+}
+
+// RevokeAPIToken deletes one of a user's API tokens.
+func RevokeAPIToken(userID, tokenID int) error {
+	result, err := db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API token: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/bcrypt"
+	"iris-gateway/config"
+	"iris-gateway/secrets"
+)
+
+// LocalAuthSource is the auth_source of accounts whose password is stored in
+// the users table.
+const LocalAuthSource = "local"
+
+var (
+	// ErrUnknownAccount means there is no enabled account of that name.
+	ErrUnknownAccount = errors.New("user not found")
+	// ErrInvalidCredentials means the account exists but the password is wrong.
+	ErrInvalidCredentials = errors.New("invalid password")
+	// ErrPasswordLoginUnsupported means the directory logs users in some other
+	// way, such as an OIDC redirect.
+	ErrPasswordLoginUnsupported = errors.New("password login is not supported")
+	// ErrAccountConflict means a directory account's username is taken by an
+	// account from somewhere else.
+	ErrAccountConflict = errors.New("username belongs to another account")
+	// ErrDirectoryAccount means a change the directory is in charge of was
+	// attempted on one of its accounts.
+	ErrDirectoryAccount = errors.New("account is managed by the directory")
+)
+
+// Identity is an account as reported by an Authenticator.
+type Identity struct {
+	Username string
+	Subject  string // Stable ID that never moves to another person, if the directory has one
+	Token    string // Secret used later to check the account is still enabled, stored encrypted
+}
+
+// Authenticator is a source of user accounts. Accounts it vouches for are
+// created locally on first login and suspended when the directory disables
+// them.
+type Authenticator interface {
+	// Name is recorded as the auth_source of the accounts it provides.
+	Name() string
+	// Authenticate checks a username and password. It returns
+	// ErrUnknownAccount or ErrInvalidCredentials when the login is refused.
+	Authenticate(username, password string) (*Identity, error)
+	// AccountActive reports whether a user provided by this authenticator
+	// still has an enabled account.
+	AccountActive(user *User) (bool, error)
+}
+
+// localAuthenticator checks passwords against the bcrypt hashes in users.db.
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return LocalAuthSource }
+
+func (localAuthenticator) Authenticate(username, password string) (*Identity, error) {
+	user, err := authenticateLocal(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Username: user.Username}, nil
+}
+
+func (localAuthenticator) AccountActive(user *User) (bool, error) { return true, nil }
+
+var authenticator Authenticator = localAuthenticator{}
+
+// SetAuthenticator makes a directory the source of accounts. It is called
+// once at startup, before any login.
+func SetAuthenticator(a Authenticator) {
+	authenticator = a
+}
+
+// ExternalAuth reports whether accounts come from a directory rather than
+// users.db.
+func ExternalAuth() bool {
+	return authenticator.Name() != LocalAuthSource
+}
+
+// AuthBackend is the name of the configured authenticator.
+func AuthBackend() string {
+	return authenticator.Name()
+}
+
+// dummyPasswordHash is compared against when a username doesn't exist, so an
+// unknown user takes as long to reject as a wrong password.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("iris-dummy-password"), bcrypt.DefaultCost)
+
+// AuthenticateUser checks a username and password with the configured
+// authenticator and returns the local user, creating it on the first login
+// of a directory account. With a directory configured, accounts created in
+// IRIS itself can still log in if config.Cfg.AuthLocalUsers is set.
+func AuthenticateUser(username, password string) (*User, error) {
+	if !ExternalAuth() {
+		return authenticateLocal(username, password)
+	}
+
+	identity, err := authenticator.Authenticate(username, password)
+	if err == nil {
+		return ProvisionUser(identity)
+	}
+	if errors.Is(err, ErrUnknownAccount) {
+		// The directory no longer knows an account it provided
+		if user, lookupErr := GetUserByUsername(username); lookupErr == nil && user.AuthSource == authenticator.Name() && !user.IsSuspended {
+			if suspendErr := suspendFromDirectory(user); suspendErr != nil {
+				log.Printf("Failed to suspend user %s: %v", user.Username, suspendErr)
+			}
+		}
+	}
+	if !errors.Is(err, ErrUnknownAccount) && !errors.Is(err, ErrPasswordLoginUnsupported) {
+		return nil, err
+	}
+
+	if !config.Cfg.AuthLocalUsers {
+		return nil, err
+	}
+	if user, lookupErr := GetUserByUsername(username); lookupErr == nil && user.AuthSource != LocalAuthSource {
+		return nil, err
+	}
+	return authenticateLocal(username, password)
+}
+
+// authenticateLocal checks a password against the bcrypt hash in users.db.
+func authenticateLocal(username, password string) (*User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumnsSQL+" FROM users WHERE username = ?", username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+			return nil, ErrUnknownAccount
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// ProvisionUser returns the local user of an account the configured
+// authenticator has vouched for, found by its subject if the directory has
+// one. The user is created on its first login. A local account of the same
+// name is only used once an admin has linked it with LinkDirectoryAccount, so
+// a directory account can't take over someone else's. A user suspended
+// because the directory had disabled them is unsuspended.
+func ProvisionUser(identity *Identity) (*User, error) {
+	source := authenticator.Name()
+	token := ""
+	if identity.Token != "" {
+		var err error
+		if token, err = secrets.Encrypt(identity.Token); err != nil {
+			return nil, err
+		}
+	}
+
+	var user *User
+	if identity.Subject != "" {
+		linked, err := scanUser(db.QueryRow("SELECT "+userColumnsSQL+" FROM users WHERE auth_source = ? AND external_id = ?", source, identity.Subject))
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("database query error: %w", err)
+		}
+		user = linked
+	}
+
+	if user == nil {
+		existing, err := GetUserByUsername(identity.Username)
+		if err != nil {
+			// Directory accounts have no local password
+			if _, err := db.Exec(
+				"INSERT INTO users (username, hashed_password, auth_source, external_id, external_token) VALUES (?, '', ?, ?, ?)",
+				identity.Username, source, identity.Subject, token,
+			); err != nil {
+				return nil, fmt.Errorf("failed to create user: %w", err)
+			}
+			log.Printf("Created user '%s' on first login through %s", identity.Username, source)
+			return GetUserByUsername(identity.Username)
+		}
+
+		switch {
+		case existing.AuthSource == LocalAuthSource:
+			return nil, fmt.Errorf("%w: user '%s' is a local account that no admin has linked to %s", ErrAccountConflict, existing.Username, source)
+		case existing.AuthSource != source:
+			return nil, fmt.Errorf("%w: user '%s' belongs to %s, not %s", ErrAccountConflict, existing.Username, existing.AuthSource, source)
+		case existing.ExternalID != identity.Subject:
+			// The directory gave the name to a different person
+			return nil, fmt.Errorf("%w: user '%s' belongs to a different %s account", ErrAccountConflict, existing.Username, source)
+		}
+		user = existing
+	}
+
+	if _, err := db.Exec(
+		"UPDATE users SET hashed_password = '', external_token = COALESCE(NULLIF(?, ''), external_token) WHERE id = ?",
+		token, user.ID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	if user.DirectorySuspended {
+		if err := restoreFromDirectory(user); err != nil {
+			return nil, err
+		}
+		log.Printf("User '%s' unsuspended: enabled again in %s", user.Username, source)
+	}
+	return GetUserByID(user.ID)
+}
+
+// LinkDirectoryAccount hands a local account to the configured directory.
+// From then on the directory account with the given subject logs in as it,
+// or for a directory without subjects, the one with the same username. The
+// account's own password stops working.
+func LinkDirectoryAccount(userID int, subject string) error {
+	if !ExternalAuth() {
+		return errors.New("no directory is configured")
+	}
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.AuthSource != LocalAuthSource {
+		return ErrDirectoryAccount
+	}
+	source := authenticator.Name()
+	if subject != "" {
+		var taken int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE auth_source = ? AND external_id = ?", source, subject).Scan(&taken); err != nil {
+			return fmt.Errorf("database query error: %w", err)
+		}
+		if taken > 0 {
+			return fmt.Errorf("%w: the %s account is already linked", ErrAccountConflict, source)
+		}
+	}
+
+	if _, err := db.Exec(
+		"UPDATE users SET auth_source = ?, external_id = ? WHERE id = ? AND auth_source = ?",
+		source, subject, userID, LocalAuthSource,
+	); err != nil {
+		return fmt.Errorf("failed to link user: %w", err)
+	}
+	log.Printf("User '%s' is now managed by %s", user.Username, source)
+	return nil
+}
+
+// GetExternalToken returns the secret an authenticator stored for a user.
+func GetExternalToken(userID int) (string, error) {
+	var token sql.NullString
+	if err := db.QueryRow("SELECT external_token FROM users WHERE id = ?", userID).Scan(&token); err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	return secrets.Decrypt(token.String)
+}
+
+// SetExternalToken replaces the secret an authenticator stored for a user.
+func SetExternalToken(userID int, token string) error {
+	encrypted, err := secrets.Encrypt(token)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET external_token = ? WHERE id = ?", encrypted, userID); err != nil {
+		return fmt.Errorf("failed to store token: %w", err)
+	}
+	return nil
+}
+
+// suspendFromDirectory suspends a user the directory has disabled. Unlike a
+// suspension by an admin, it is lifted when the directory enables them again.
+func suspendFromDirectory(user *User) error {
+	if err := SuspendUser(user.Username); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET directory_suspended = TRUE WHERE id = ?", user.ID); err != nil {
+		return fmt.Errorf("failed to suspend user: %w", err)
+	}
+	log.Printf("User '%s' suspended: disabled in %s", user.Username, user.AuthSource)
+	return nil
+}
+
+// restoreFromDirectory lifts a suspension made by suspendFromDirectory.
+func restoreFromDirectory(user *User) error {
+	if _, err := db.Exec("UPDATE users SET is_suspended = FALSE, directory_suspended = FALSE WHERE id = ? AND directory_suspended = TRUE", user.ID); err != nil {
+		return fmt.Errorf("failed to unsuspend user: %w", err)
+	}
+	return nil
+}
+
+// SyncDirectoryAccounts checks every account provided by the configured
+// directory, suspending those it has disabled or removed and unsuspending
+// those it has enabled again. Accounts that can't be checked are left alone.
+func SyncDirectoryAccounts() (suspended, restored int, err error) {
+	if !ExternalAuth() {
+		return 0, 0, nil
+	}
+	accounts, err := queryUsers("SELECT "+userColumnsSQL+" FROM users WHERE auth_source = ?", authenticator.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, user := range accounts {
+		active, err := authenticator.AccountActive(user)
+		if err != nil {
+			log.Printf("Failed to check %s account of user %s: %v", user.AuthSource, user.Username, err)
+			continue
+		}
+		switch {
+		case !active && !user.IsSuspended:
+			if err := suspendFromDirectory(user); err != nil {
+				log.Printf("Failed to suspend user %s: %v", user.Username, err)
+				continue
+			}
+			suspended++
+		case active && user.DirectorySuspended:
+			if err := restoreFromDirectory(user); err != nil {
+				log.Printf("Failed to unsuspend user %s: %v", user.Username, err)
+				continue
+			}
+			log.Printf("User '%s' unsuspended: enabled again in %s", user.Username, user.AuthSource)
+			restored++
+		}
+	}
+	return suspended, restored, nil
+}
+
+// ManagedByDirectory reports whether the configured directory is in charge
+// of a user's password.
+func ManagedByDirectory(userID int) (bool, error) {
+	var source sql.NullString
+	if err := db.QueryRow("SELECT auth_source FROM users WHERE id = ?", userID).Scan(&source); err != nil {
+		return false, fmt.Errorf("user not found")
+	}
+	return ExternalAuth() && source.String == authenticator.Name(), nil
+}
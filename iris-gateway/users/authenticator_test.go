@@ -0,0 +1,247 @@
+package users
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"iris-gateway/config"
+	"iris-gateway/secrets"
+)
+
+// fakeDirectory is an in-memory Authenticator standing in for LDAP or OIDC.
+type fakeDirectory struct {
+	accounts map[string]*fakeAccount // By username
+}
+
+type fakeAccount struct {
+	password string
+	subject  string
+	disabled bool
+}
+
+func (*fakeDirectory) Name() string { return "fake" }
+
+func (d *fakeDirectory) Authenticate(username, password string) (*Identity, error) {
+	account, found := d.accounts[username]
+	if !found || account.disabled {
+		return nil, ErrUnknownAccount
+	}
+	if account.password != password {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Username: username, Subject: account.subject}, nil
+}
+
+func (d *fakeDirectory) AccountActive(user *User) (bool, error) {
+	for _, account := range d.accounts {
+		if account.subject == user.ExternalID && !account.disabled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+const testPassword = "correct horse battery staple"
+
+// setupDirectory opens an empty database in a temporary directory and makes
+// a fake directory with the given accounts the authenticator.
+func setupDirectory(t *testing.T, accounts map[string]*fakeAccount) *fakeDirectory {
+	t.Helper()
+	dir := t.TempDir()
+	if err := secrets.Init(filepath.Join(dir, "master.key")); err != nil {
+		t.Fatalf("secrets.Init: %v", err)
+	}
+	if err := InitDB(filepath.Join(dir, "users.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	directory := &fakeDirectory{accounts: accounts}
+	SetAuthenticator(directory)
+	localUsers := config.Cfg.AuthLocalUsers
+	t.Cleanup(func() {
+		SetAuthenticator(localAuthenticator{})
+		config.Cfg.AuthLocalUsers = localUsers
+		CloseDB()
+	})
+	return directory
+}
+
+func TestAuthenticateUserCreatesUserOnFirstLogin(t *testing.T) {
+	setupDirectory(t, map[string]*fakeAccount{
+		"alice": {password: "directory password", subject: "uid-alice"},
+	})
+
+	user, err := AuthenticateUser("alice", "directory password")
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if user.AuthSource != "fake" || user.ExternalID != "uid-alice" {
+		t.Errorf("user has auth source %q and external ID %q, want fake and uid-alice", user.AuthSource, user.ExternalID)
+	}
+	if user.HashedPassword != "" {
+		t.Errorf("directory user has a local password hash")
+	}
+
+	again, err := AuthenticateUser("alice", "directory password")
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("second login returned user %d, want %d", again.ID, user.ID)
+	}
+
+	if _, err := AuthenticateUser("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: got %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestDirectorySuspendsAndUnsuspends(t *testing.T) {
+	directory := setupDirectory(t, map[string]*fakeAccount{
+		"alice": {password: "directory password", subject: "uid-alice"},
+	})
+	if _, err := AuthenticateUser("alice", "directory password"); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+
+	directory.accounts["alice"].disabled = true
+	if suspended, restored, err := SyncDirectoryAccounts(); err != nil || suspended != 1 || restored != 0 {
+		t.Fatalf("sync after disabling: suspended %d, restored %d, err %v; want 1, 0, nil", suspended, restored, err)
+	}
+	user, _ := GetUserByUsername("alice")
+	if !user.IsSuspended || !user.DirectorySuspended {
+		t.Fatalf("disabled account: suspended %t, by directory %t; want both", user.IsSuspended, user.DirectorySuspended)
+	}
+
+	directory.accounts["alice"].disabled = false
+	if suspended, restored, err := SyncDirectoryAccounts(); err != nil || suspended != 0 || restored != 1 {
+		t.Fatalf("sync after enabling: suspended %d, restored %d, err %v; want 0, 1, nil", suspended, restored, err)
+	}
+	if user, _ = GetUserByUsername("alice"); user.IsSuspended {
+		t.Fatalf("enabled account is still suspended")
+	}
+
+	// A suspension by an admin is not the directory's to lift
+	if err := SuspendUser("alice"); err != nil {
+		t.Fatalf("SuspendUser: %v", err)
+	}
+	if _, _, err := SyncDirectoryAccounts(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if user, _ = GetUserByUsername("alice"); !user.IsSuspended {
+		t.Errorf("sync lifted an admin's suspension")
+	}
+	if user, err := AuthenticateUser("alice", "directory password"); err != nil || !user.IsSuspended {
+		t.Errorf("login lifted an admin's suspension: %v", err)
+	}
+}
+
+func TestAuthenticateUserSuspendsRemovedAccount(t *testing.T) {
+	directory := setupDirectory(t, map[string]*fakeAccount{
+		"alice": {password: "directory password", subject: "uid-alice"},
+	})
+	if _, err := AuthenticateUser("alice", "directory password"); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+
+	delete(directory.accounts, "alice")
+	if _, err := AuthenticateUser("alice", "directory password"); !errors.Is(err, ErrUnknownAccount) {
+		t.Fatalf("login of removed account: got %v, want ErrUnknownAccount", err)
+	}
+	user, _ := GetUserByUsername("alice")
+	if !user.IsSuspended || !user.DirectorySuspended {
+		t.Errorf("removed account: suspended %t, by directory %t; want both", user.IsSuspended, user.DirectorySuspended)
+	}
+
+	directory.accounts["alice"] = &fakeAccount{password: "directory password", subject: "uid-alice"}
+	user, err := AuthenticateUser("alice", "directory password")
+	if err != nil {
+		t.Fatalf("login of restored account: %v", err)
+	}
+	if user.IsSuspended {
+		t.Errorf("restored account is still suspended")
+	}
+}
+
+func TestProvisionUserRefusesUnlinkedLocalAccount(t *testing.T) {
+	setupDirectory(t, map[string]*fakeAccount{
+		"carol": {password: "directory password", subject: "uid-carol"},
+	})
+	config.Cfg.AuthLocalUsers = true
+	if err := CreateUser("carol", testPassword); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	local, _ := GetUserByUsername("carol")
+
+	if _, err := AuthenticateUser("carol", "directory password"); !errors.Is(err, ErrAccountConflict) {
+		t.Fatalf("directory login to a local account: got %v, want ErrAccountConflict", err)
+	}
+	if user, _ := GetUserByUsername("carol"); user.AuthSource != LocalAuthSource {
+		t.Fatalf("refused login changed the account to %q", user.AuthSource)
+	}
+
+	if err := LinkDirectoryAccount(local.ID, "uid-carol"); err != nil {
+		t.Fatalf("LinkDirectoryAccount: %v", err)
+	}
+	user, err := AuthenticateUser("carol", "directory password")
+	if err != nil {
+		t.Fatalf("login after linking: %v", err)
+	}
+	if user.ID != local.ID {
+		t.Errorf("login after linking returned user %d, want %d", user.ID, local.ID)
+	}
+	if _, err := AuthenticateUser("carol", testPassword); err == nil {
+		t.Errorf("the local password still works after linking")
+	}
+}
+
+func TestProvisionUserMatchesSubject(t *testing.T) {
+	setupDirectory(t, nil)
+
+	first, err := ProvisionUser(&Identity{Username: "alice", Subject: "uid-1"})
+	if err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+
+	// The directory gave the name to someone else
+	if _, err := ProvisionUser(&Identity{Username: "alice", Subject: "uid-2"}); !errors.Is(err, ErrAccountConflict) {
+		t.Errorf("other subject with the same name: got %v, want ErrAccountConflict", err)
+	}
+
+	// The account was renamed in the directory
+	renamed, err := ProvisionUser(&Identity{Username: "alice2", Subject: "uid-1"})
+	if err != nil {
+		t.Fatalf("renamed account: %v", err)
+	}
+	if renamed.ID != first.ID {
+		t.Errorf("renamed account got user %d, want %d", renamed.ID, first.ID)
+	}
+}
+
+func TestAuthLocalUsersFallback(t *testing.T) {
+	setupDirectory(t, map[string]*fakeAccount{
+		"alice": {password: "directory password", subject: "uid-alice"},
+	})
+	if err := CreateUser("dave", testPassword); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := AuthenticateUser("alice", "directory password"); err != nil {
+		t.Fatalf("directory login: %v", err)
+	}
+
+	config.Cfg.AuthLocalUsers = true
+	if _, err := AuthenticateUser("dave", testPassword); err != nil {
+		t.Errorf("local login with AuthLocalUsers: %v", err)
+	}
+	if _, err := AuthenticateUser("dave", "wrong password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong local password: got %v, want ErrInvalidCredentials", err)
+	}
+	// Directory accounts have no local password to fall back to
+	if _, err := AuthenticateUser("alice", ""); err == nil {
+		t.Errorf("directory account logged in without its directory password")
+	}
+
+	config.Cfg.AuthLocalUsers = false
+	if _, err := AuthenticateUser("dave", testPassword); !errors.Is(err, ErrUnknownAccount) {
+		t.Errorf("local login without AuthLocalUsers: got %v, want ErrUnknownAccount", err)
+	}
+}
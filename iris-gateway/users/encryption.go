@@ -0,0 +1,174 @@
+package users
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"iris-gateway/secrets"
+	"iris-gateway/session"
+)
+
+// encryptedColumns are the columns holding secrets encrypted with the master key.
+var encryptedColumns = []struct{ table, column string }{
+	{"irc_networks", "server_password"},
+	{"irc_networks", "sasl_password"},
+	{"irc_networks", "nickserv_password"},
+	{"irc_networks", "proxy_password"},
+	{"irc_networks", "client_key"},
+	{"irc_network_servers", "password"},
+	{"users", "totp_secret"},
+	{"users", "external_token"},
+	{"webhooks", "secret"},
+}
+
+// networkSecrets are a network's secrets, encrypted for storage.
+type networkSecrets struct {
+	serverPassword   string
+	saslPassword     string
+	nickServPassword string
+	proxyPassword    string
+}
+
+func encryptNetworkSecrets(netConfig *session.UserNetwork) (*networkSecrets, error) {
+	var secret networkSecrets
+	var err error
+	if secret.serverPassword, err = secrets.Encrypt(netConfig.ServerPassword); err != nil {
+		return nil, err
+	}
+	if secret.saslPassword, err = secrets.Encrypt(netConfig.SASLPassword); err != nil {
+		return nil, err
+	}
+	if secret.nickServPassword, err = secrets.Encrypt(netConfig.NickServPassword); err != nil {
+		return nil, err
+	}
+	if secret.proxyPassword, err = secrets.Encrypt(netConfig.ProxyPassword); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// moveProxyPasswords takes the passwords out of proxy URLs saved before
+// proxy passwords had their own column. They are left in plaintext for
+// encryptStoredSecrets to encrypt.
+func moveProxyPasswords() error {
+	rows, err := db.Query("SELECT id, proxy_url FROM irc_networks WHERE proxy_url LIKE '%@%'")
+	if err != nil {
+		return fmt.Errorf("failed to read proxy URLs: %w", err)
+	}
+	proxyURLs := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var proxyURL string
+		if err := rows.Scan(&id, &proxyURL); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read proxy URLs: %w", err)
+		}
+		proxyURLs[id] = proxyURL
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read proxy URLs: %w", err)
+	}
+
+	for id, proxyURL := range proxyURLs {
+		parsed, err := url.Parse(proxyURL)
+		if err != nil || parsed.User == nil {
+			continue
+		}
+		password, hasPassword := parsed.User.Password()
+		if !hasPassword {
+			continue
+		}
+		parsed.User = url.User(parsed.User.Username())
+		if _, err := db.Exec("UPDATE irc_networks SET proxy_url = ?, proxy_password = ? WHERE id = ?", parsed.String(), password, id); err != nil {
+			return fmt.Errorf("failed to move proxy password of network %d: %w", id, err)
+		}
+	}
+	if len(proxyURLs) > 0 {
+		log.Printf("Moved the passwords of %d proxy URLs to their own column.", len(proxyURLs))
+	}
+	return nil
+}
+
+// encryptStoredSecrets encrypts secrets stored in plaintext before
+// encryption was introduced.
+func encryptStoredSecrets() error {
+	converted, err := convertSecrets(func(value string) (string, error) {
+		if strings.HasPrefix(value, secrets.Prefix) {
+			return value, nil
+		}
+		return secrets.Encrypt(value)
+	})
+	if err != nil {
+		return err
+	}
+	if converted > 0 {
+		log.Printf("Encrypted %d secrets that were stored in plaintext.", converted)
+	}
+	return nil
+}
+
+// RotateMasterKey re-encrypts every stored secret with a new master key and
+// returns the path of the file holding it.
+func RotateMasterKey(keyFile string) (string, int, error) {
+	var converted int
+	path, err := secrets.Rotate(keyFile, func(convert func(string) (string, error)) error {
+		var err error
+		converted, err = convertSecrets(convert)
+		return err
+	})
+	return path, converted, err
+}
+
+// convertSecrets rewrites every non-empty value of the encrypted columns with
+// convert, in one transaction, and returns how many values changed.
+func convertSecrets(convert func(string) (string, error)) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	converted := 0
+	for _, col := range encryptedColumns {
+		rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %s IS NOT NULL AND %s != ''", col.column, col.table, col.column, col.column))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s.%s: %w", col.table, col.column, err)
+		}
+		values := make(map[int64]string)
+		for rows.Next() {
+			var rowID int64
+			var value string
+			if err := rows.Scan(&rowID, &value); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to read %s.%s: %w", col.table, col.column, err)
+			}
+			values[rowID] = value
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("failed to read %s.%s: %w", col.table, col.column, err)
+		}
+
+		for rowID, value := range values {
+			newValue, err := convert(value)
+			if err != nil {
+				return 0, fmt.Errorf("failed to convert %s.%s of row %d: %w", col.table, col.column, rowID, err)
+			}
+			if newValue == value {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", col.table, col.column), newValue, rowID); err != nil {
+				return 0, fmt.Errorf("failed to update %s.%s: %w", col.table, col.column, err)
+			}
+			converted++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit secrets: %w", err)
+	}
+	return converted, nil
+}
@@ -0,0 +1,226 @@
+package users
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInviteInvalid is returned for an invite code that is unknown,
+	// expired, revoked or used up.
+	ErrInviteInvalid = errors.New("invalid invite code")
+	// ErrUsernameTaken is returned when registering a username that exists.
+	ErrUsernameTaken = errors.New("username already exists")
+)
+
+// Invite is a code that lets someone register an account.
+type Invite struct {
+	ID        int        `json:"id"`
+	CodeHint  string     `json:"code_hint"` // First characters of the code, to tell invites apart
+	Note      string     `json:"note,omitempty"`
+	CreatedBy string     `json:"created_by"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// InviteUse records an account registered with an invite.
+type InviteUse struct {
+	InviteID int       `json:"invite_id"`
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	IP       string    `json:"ip"`
+	UsedAt   time.Time `json:"used_at"`
+}
+
+const inviteCodeHintLength = 4
+
+// normalizeInviteCode ignores case and the dashes codes are displayed with.
+func normalizeInviteCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// CreateInvite creates an invite code usable maxUses times until expiresAt.
+// Only a hash of the code is stored, so it is returned here and never again.
+func CreateInvite(createdBy int, note string, maxUses int, expiresAt time.Time) (string, *Invite, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate invite code: %w", err)
+	}
+	encoded := hex.EncodeToString(raw)
+	code := encoded[:5] + "-" + encoded[5:10] + "-" + encoded[10:15] + "-" + encoded[15:]
+
+	now := time.Now().UTC()
+	result, err := db.Exec(
+		"INSERT INTO invites (code_hash, code_hint, note, created_by, max_uses, uses, created_at, expires_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?)",
+		hashToken(normalizeInviteCode(code)), encoded[:inviteCodeHintLength], note, createdBy, maxUses, now, expiresAt.UTC(),
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get invite ID: %w", err)
+	}
+	invite, err := getInvite(int(id))
+	if err != nil {
+		return "", nil, err
+	}
+	return code, invite, nil
+}
+
+const inviteColumnsSQL = `i.id, i.code_hint, i.note, COALESCE(u.username, ''), i.max_uses, i.uses, i.created_at, i.expires_at, i.revoked_at`
+
+func scanInvite(row rowScanner) (*Invite, error) {
+	invite := &Invite{}
+	var note sql.NullString
+	var revokedAt sql.NullTime
+	if err := row.Scan(&invite.ID, &invite.CodeHint, &note, &invite.CreatedBy, &invite.MaxUses, &invite.Uses, &invite.CreatedAt, &invite.ExpiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	invite.Note = note.String
+	if revokedAt.Valid {
+		invite.RevokedAt = &revokedAt.Time
+	}
+	return invite, nil
+}
+
+func getInvite(id int) (*Invite, error) {
+	invite, err := scanInvite(db.QueryRow("SELECT "+inviteColumnsSQL+" FROM invites i LEFT JOIN users u ON u.id = i.created_by WHERE i.id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("invite not found")
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	return invite, nil
+}
+
+// ListInvites returns every invite, newest first.
+func ListInvites() ([]*Invite, error) {
+	rows, err := db.Query("SELECT " + inviteColumnsSQL + " FROM invites i LEFT JOIN users u ON u.id = i.created_by ORDER BY i.id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invites: %w", err)
+	}
+	defer rows.Close()
+
+	var invites []*Invite
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan invite: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// ListInviteUses returns the accounts registered with each invite, oldest first.
+func ListInviteUses() ([]*InviteUse, error) {
+	rows, err := db.Query("SELECT invite_id, user_id, username, ip, used_at FROM invite_uses ORDER BY used_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invite uses: %w", err)
+	}
+	defer rows.Close()
+
+	var uses []*InviteUse
+	for rows.Next() {
+		use := &InviteUse{}
+		if err := rows.Scan(&use.InviteID, &use.UserID, &use.Username, &use.IP, &use.UsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan invite use: %w", err)
+		}
+		uses = append(uses, use)
+	}
+	return uses, rows.Err()
+}
+
+// RevokeInvite stops an invite from being used again.
+func RevokeInvite(id int) error {
+	result, err := db.Exec("UPDATE invites SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("invite not found or already revoked")
+	}
+	return nil
+}
+
+// RegisterWithInvite creates a user with an invite code, using up one of its
+// uses. The password must meet the policy.
+func RegisterWithInvite(code, username, password, ip string) (*User, error) {
+	if err := CheckPasswordPolicy(username, password); err != nil {
+		return nil, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Claim a use first, so concurrent registrations can't exceed max_uses.
+	now := time.Now().UTC()
+	var inviteID int
+	var expiresAt time.Time
+	err = tx.QueryRow("SELECT id, expires_at FROM invites WHERE code_hash = ?", hashToken(normalizeInviteCode(code))).Scan(&inviteID, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInviteInvalid
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	if now.After(expiresAt) {
+		return nil, ErrInviteInvalid
+	}
+	result, err := tx.Exec(
+		"UPDATE invites SET uses = uses + 1 WHERE id = ? AND revoked_at IS NULL AND uses < max_uses",
+		inviteID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use invite: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return nil, ErrInviteInvalid
+	}
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	if exists > 0 {
+		return nil, ErrUsernameTaken
+	}
+	result, err = tx.Exec("INSERT INTO users (username, hashed_password) VALUES (?, ?)", username, string(hashedPassword))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user ID: %w", err)
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO invite_uses (invite_id, user_id, username, ip, used_at) VALUES (?, ?, ?, ?, ?)",
+		inviteID, userID, username, ip, now,
+	); err != nil {
+		return nil, fmt.Errorf("failed to record invite use: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to register user: %w", err)
+	}
+	return GetUserByID(int(userID))
+}
@@ -0,0 +1,123 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LoginAttempt is an entry in the login audit log.
+type LoginAttempt struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	IP          string    `json:"ip"`
+	Success     bool      `json:"success"`
+	Reason      string    `json:"reason,omitempty"` // Why a failed attempt failed
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// LoginThrottle is the failed-login state of one username or IP address.
+type LoginThrottle struct {
+	Key         string // "user:<name>" or "ip:<address>"
+	Failures    int    // Consecutive failures
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// RecordLoginAttempt adds an entry to the login audit log.
+func RecordLoginAttempt(username, ip string, success bool, reason string) error {
+	_, err := db.Exec(
+		"INSERT INTO login_attempts (username, ip, success, reason, attempted_at) VALUES (?, ?, ?, ?, ?)",
+		username, ip, success, reason, time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record login attempt: %w", err)
+	}
+	return nil
+}
+
+// ListLoginAttempts returns the most recent entries of the login audit log,
+// newest first. An empty username lists every user.
+func ListLoginAttempts(username string, failedOnly bool, limit int) ([]*LoginAttempt, error) {
+	query := "SELECT id, username, ip, success, reason, attempted_at FROM login_attempts WHERE 1 = 1"
+	var args []interface{}
+	if username != "" {
+		query += " AND username = ?"
+		args = append(args, username)
+	}
+	if failedOnly {
+		query += " AND success = FALSE"
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query login attempts: %w", err)
+	}
+	defer rows.Close()
+
+	var attempts []*LoginAttempt
+	for rows.Next() {
+		attempt := &LoginAttempt{}
+		var reason sql.NullString
+		if err := rows.Scan(&attempt.ID, &attempt.Username, &attempt.IP, &attempt.Success, &reason, &attempt.AttemptedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan login attempt: %w", err)
+		}
+		attempt.Reason = reason.String
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// GetLoginThrottle returns the failed-login state for a key. A key with no
+// recorded failures has a zero state.
+func GetLoginThrottle(key string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Key: key}
+	var lastFailure, lockedUntil sql.NullTime
+	err := db.QueryRow(
+		"SELECT failures, last_failure, locked_until FROM login_throttle WHERE key = ?",
+		key,
+	).Scan(&throttle.Failures, &lastFailure, &lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	throttle.LastFailure = lastFailure.Time
+	throttle.LockedUntil = lockedUntil.Time
+	return throttle, nil
+}
+
+// AddLoginFailure counts a failed login against a key in one statement, so
+// concurrent failures are all counted. Failures older than window are
+// forgotten first, and once the key reaches limit failures it is locked out
+// for lockout; a limit of 0 never locks it out. It returns the number of
+// failures counted so far.
+func AddLoginFailure(key string, limit int, window, lockout time.Duration) (int, error) {
+	now := time.Now().UTC()
+	var failures int
+	err := db.QueryRow(`
+		INSERT INTO login_throttle (key, failures, last_failure, locked_until)
+		VALUES (?1, 1, ?2, CASE WHEN ?3 = 1 THEN ?4 END)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = CASE WHEN julianday(last_failure) < julianday(?5) THEN 1 ELSE failures + 1 END,
+			last_failure = ?2,
+			locked_until = CASE
+				WHEN ?3 > 0 AND (CASE WHEN julianday(last_failure) < julianday(?5) THEN 1 ELSE failures + 1 END) >= ?3 THEN ?4
+				ELSE locked_until
+			END
+		RETURNING failures`,
+		key, now, limit, now.Add(lockout), now.Add(-window),
+	).Scan(&failures)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save login throttle: %w", err)
+	}
+	return failures, nil
+}
+
+// ClearLoginThrottle forgets the failed logins for a key.
+func ClearLoginThrottle(key string) error {
+	if _, err := db.Exec("DELETE FROM login_throttle WHERE key = ?", key); err != nil {
+		return fmt.Errorf("failed to clear login throttle: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package users
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"iris-gateway/config"
+)
+
+// ErrPasswordPolicy wraps the reason a password was refused by the policy.
+var ErrPasswordPolicy = errors.New("password does not meet the policy")
+
+// commonPasswords are refused whatever the configured list holds.
+var commonPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "password", "password1",
+	"password123", "qwerty", "qwerty123", "qwertyuiop", "abc123", "111111",
+	"1q2w3e4r", "letmein", "welcome", "iloveyou", "admin", "admin123",
+	"monkey", "dragon", "football", "baseball", "sunshine", "princess",
+	"trustno1", "changeme", "passw0rd", "irc", "iris",
+}
+
+var bannedPasswords struct {
+	once sync.Once
+	set  map[string]bool
+}
+
+// loadBannedPasswords builds the banned list from the built-in passwords and
+// config.Cfg.BannedPasswordsFile, which has one password per line.
+func loadBannedPasswords() {
+	set := make(map[string]bool)
+	for _, p := range commonPasswords {
+		set[p] = true
+	}
+	if path := config.Cfg.BannedPasswordsFile; path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to read banned passwords from %s: %v", path, err)
+			}
+		} else {
+			defer file.Close()
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+					set[strings.ToLower(line)] = true
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				log.Printf("Failed to read banned passwords from %s: %v", path, err)
+			}
+		}
+	}
+	bannedPasswords.set = set
+}
+
+// CheckPasswordPolicy returns an error wrapping ErrPasswordPolicy if password
+// is too short, is a banned common password, or is the username.
+func CheckPasswordPolicy(username, password string) error {
+	if n := config.Cfg.PasswordMinLength; len([]rune(password)) < n {
+		return fmt.Errorf("%w: must be at least %d characters", ErrPasswordPolicy, n)
+	}
+	bannedPasswords.once.Do(loadBannedPasswords)
+	lower := strings.ToLower(password)
+	if bannedPasswords.set[lower] {
+		return fmt.Errorf("%w: is too common", ErrPasswordPolicy)
+	}
+	if strings.EqualFold(lower, username) {
+		return fmt.Errorf("%w: must not be the username", ErrPasswordPolicy)
+	}
+	return nil
+}
+
+// SetPassword replaces a user's password, after checking it against the policy.
+// Passwords of accounts the configured directory manages are refused.
+func SetPassword(userID int, password string) error {
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return fmt.Errorf("user not found")
+	}
+	if managed, err := ManagedByDirectory(userID); err != nil {
+		return err
+	} else if managed {
+		return ErrDirectoryAccount
+	}
+	if err := CheckPasswordPolicy(username, password); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	// An account left behind by a directory that is no longer configured
+	// becomes a local one
+	if _, err := db.Exec("UPDATE users SET hashed_password = ?, auth_source = ?, external_id = NULL, external_token = NULL, directory_suspended = FALSE WHERE id = ?", string(hashedPassword), LocalAuthSource, userID); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword sets a user's password by name and logs out all of their
+// devices, for users who have forgotten it.
+func ResetPassword(username, password string) error {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	if err := SetPassword(user.ID, password); err != nil {
+		return err
+	}
+	if _, err := RevokeAllSessions(user.ID, 0); err != nil {
+		return err
+	}
+	return nil
+}
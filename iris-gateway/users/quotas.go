@@ -0,0 +1,174 @@
+package users
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"iris-gateway/config"
+)
+
+// Quota is the resource limits that apply to a user. Zero means unlimited.
+type Quota struct {
+	MaxNetworks      int           `json:"max_networks"`
+	MaxConnections   int           `json:"max_connections"` // Networks connected or trying to connect at once
+	MaxChannels      int           `json:"max_channels"`    // Channels joined across all networks
+	AttachmentBytes  int64         `json:"attachment_bytes"`
+	HistoryRetention time.Duration `json:"-"` // How long channel history is kept
+}
+
+// QuotaOverrides are an admin's per-user changes to the default quota. Nil
+// fields use the default.
+type QuotaOverrides struct {
+	MaxNetworks      *int    `json:"max_networks"`
+	MaxConnections   *int    `json:"max_connections"`
+	MaxChannels      *int    `json:"max_channels"`
+	AttachmentBytes  *int64  `json:"attachment_bytes"`
+	HistoryRetention *string `json:"history_retention"` // Duration such as "72h"
+}
+
+// DefaultQuota returns the quota from the config.
+func DefaultQuota() Quota {
+	return Quota{
+		MaxNetworks:      config.Cfg.QuotaMaxNetworks,
+		MaxConnections:   config.Cfg.QuotaMaxConnections,
+		MaxChannels:      config.Cfg.QuotaMaxChannels,
+		AttachmentBytes:  config.Cfg.QuotaAttachmentBytes,
+		HistoryRetention: parseRetention(config.Cfg.HistoryDuration),
+	}
+}
+
+func parseRetention(value string) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return d
+}
+
+// GetQuotaOverrides returns the admin's changes to a user's quota.
+func GetQuotaOverrides(userID int) (*QuotaOverrides, error) {
+	var maxNetworks, maxConnections, maxChannels sql.NullInt64
+	var attachmentBytes sql.NullInt64
+	var historyRetention sql.NullString
+	err := db.QueryRow(
+		"SELECT max_networks, max_connections, max_channels, attachment_bytes, history_retention FROM user_quotas WHERE user_id = ?",
+		userID,
+	).Scan(&maxNetworks, &maxConnections, &maxChannels, &attachmentBytes, &historyRetention)
+	overrides := &QuotaOverrides{}
+	if err == sql.ErrNoRows {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+
+	intOverride := func(v sql.NullInt64) *int {
+		if !v.Valid {
+			return nil
+		}
+		n := int(v.Int64)
+		return &n
+	}
+	overrides.MaxNetworks = intOverride(maxNetworks)
+	overrides.MaxConnections = intOverride(maxConnections)
+	overrides.MaxChannels = intOverride(maxChannels)
+	if attachmentBytes.Valid {
+		overrides.AttachmentBytes = &attachmentBytes.Int64
+	}
+	if historyRetention.Valid {
+		overrides.HistoryRetention = &historyRetention.String
+	}
+	return overrides, nil
+}
+
+// SetQuotaOverrides replaces the admin's changes to a user's quota.
+func SetQuotaOverrides(userID int, overrides *QuotaOverrides) error {
+	if overrides.HistoryRetention != nil {
+		if d, err := time.ParseDuration(*overrides.HistoryRetention); err != nil || d <= 0 {
+			return fmt.Errorf("invalid history retention %q", *overrides.HistoryRetention)
+		}
+	}
+	_, err := db.Exec(`
+		INSERT INTO user_quotas (user_id, max_networks, max_connections, max_channels, attachment_bytes, history_retention) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET max_networks = excluded.max_networks, max_connections = excluded.max_connections,
+		max_channels = excluded.max_channels, attachment_bytes = excluded.attachment_bytes, history_retention = excluded.history_retention`,
+		userID, overrides.MaxNetworks, overrides.MaxConnections, overrides.MaxChannels, overrides.AttachmentBytes, overrides.HistoryRetention,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save quota: %w", err)
+	}
+	return nil
+}
+
+// GetQuota returns the quota that applies to a user: the defaults with the
+// admin's overrides applied. It falls back to the defaults if the overrides
+// can't be read.
+func GetQuota(userID int) Quota {
+	quota := DefaultQuota()
+	overrides, err := GetQuotaOverrides(userID)
+	if err != nil {
+		log.Printf("Failed to read quota of user %d, using defaults: %v", userID, err)
+		return quota
+	}
+	if overrides.MaxNetworks != nil {
+		quota.MaxNetworks = *overrides.MaxNetworks
+	}
+	if overrides.MaxConnections != nil {
+		quota.MaxConnections = *overrides.MaxConnections
+	}
+	if overrides.MaxChannels != nil {
+		quota.MaxChannels = *overrides.MaxChannels
+	}
+	if overrides.AttachmentBytes != nil {
+		quota.AttachmentBytes = *overrides.AttachmentBytes
+	}
+	if overrides.HistoryRetention != nil {
+		quota.HistoryRetention = parseRetention(*overrides.HistoryRetention)
+	}
+	return quota
+}
+
+// CountUserNetworks returns how many networks a user has configured.
+func CountUserNetworks(userID int) (int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM irc_networks WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("database query error: %w", err)
+	}
+	return count, nil
+}
+
+// RecordAttachment counts an uploaded file against a user's attachment storage.
+func RecordAttachment(userID int, filename string, size int64) error {
+	_, err := db.Exec(
+		"INSERT INTO attachments (user_id, filename, size, created_at) VALUES (?, ?, ?, ?)",
+		userID, filename, size, time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record attachment: %w", err)
+	}
+	return nil
+}
+
+// AttachmentUsage returns the bytes of a user's attachments that haven't
+// expired yet.
+func AttachmentUsage(userID int, storageDuration time.Duration) (int64, error) {
+	var used int64
+	err := db.QueryRow(
+		"SELECT COALESCE(SUM(size), 0) FROM attachments WHERE user_id = ? AND created_at > ?",
+		userID, time.Now().Add(-storageDuration).UTC(),
+	).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("database query error: %w", err)
+	}
+	return used, nil
+}
+
+// DeleteAttachment forgets an attachment whose file has been removed.
+func DeleteAttachment(filename string) error {
+	if _, err := db.Exec("DELETE FROM attachments WHERE filename = ?", filename); err != nil {
+		return fmt.Errorf("failed to delete attachment record: %w", err)
+	}
+	return nil
+}
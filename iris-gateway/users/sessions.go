@@ -0,0 +1,173 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSessionNotFound is returned for a token that is unknown, expired or
+// revoked, or whose user is suspended.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a login token stored in the sessions table. Each device that
+// logs in gets its own session.
+type Session struct {
+	ID            int
+	UserID        int
+	Username      string
+	DeviceName    string
+	ClientVersion string
+	LastIP        string
+	CreatedAt     time.Time
+	LastUsedAt    time.Time
+	ExpiresAt     time.Time
+}
+
+const sessionColumnsSQL = `s.id, s.user_id, u.username, s.device_name, s.client_version, s.last_ip, s.created_at, s.last_used_at, s.expires_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	sess := &Session{}
+	var deviceName, clientVersion, lastIP sql.NullString
+	err := row.Scan(&sess.ID, &sess.UserID, &sess.Username, &deviceName, &clientVersion, &lastIP, &sess.CreatedAt, &sess.LastUsedAt, &sess.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	sess.DeviceName = deviceName.String
+	sess.ClientVersion = clientVersion.String
+	sess.LastIP = lastIP.String
+	return sess, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession issues a new login token for the user and device described by
+// info, valid for lifetime unless it is used again. The token itself is only
+// returned here.
+func CreateSession(info Session, lifetime time.Duration) (string, *Session, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+
+	now := time.Now().UTC()
+	sess := &info
+	sess.CreatedAt = now
+	sess.LastUsedAt = now
+	sess.ExpiresAt = now.Add(lifetime)
+	result, err := db.Exec(
+		"INSERT INTO sessions (user_id, token_hash, device_name, client_version, last_ip, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		sess.UserID, hashToken(token), sess.DeviceName, sess.ClientVersion, sess.LastIP, sess.CreatedAt, sess.LastUsedAt, sess.ExpiresAt,
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create session: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get session ID: %w", err)
+	}
+	sess.ID = int(id)
+	return token, sess, nil
+}
+
+// GetSessionByToken returns the unexpired session for a token, if its user
+// isn't suspended.
+func GetSessionByToken(token string) (*Session, error) {
+	sess, err := scanSession(db.QueryRow(`
+		SELECT `+sessionColumnsSQL+`
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND u.is_suspended = FALSE`,
+		hashToken(token),
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+// TouchSession records that a session was used from ip and extends its expiry.
+func TouchSession(sessionID int, ip string, lifetime time.Duration) error {
+	now := time.Now().UTC()
+	_, err := db.Exec(
+		"UPDATE sessions SET last_used_at = ?, expires_at = ?, last_ip = ? WHERE id = ?",
+		now, now.Add(lifetime), ip, sessionID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+// ListSessions returns a user's unexpired sessions, most recently used first.
+func ListSessions(userID int) ([]*Session, error) {
+	rows, err := db.Query(`
+		SELECT `+sessionColumnsSQL+`
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.user_id = ? ORDER BY s.last_used_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var sessions []*Session
+	for rows.Next() {
+		sess, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		if now.After(sess.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes one of a user's sessions.
+func RevokeSession(userID, sessionID int) error {
+	result, err := db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions deletes all of a user's sessions except keepID, which
+// may be 0 to revoke every one. It returns the number revoked.
+func RevokeAllSessions(userID, keepID int) (int64, error) {
+	result, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, keepID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions removes sessions past their expiry.
+func DeleteExpiredSessions() (int64, error) {
+	result, err := db.Exec("DELETE FROM sessions WHERE expires_at < ?", time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
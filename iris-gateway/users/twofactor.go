@@ -0,0 +1,168 @@
+package users
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"iris-gateway/secrets"
+)
+
+// ErrTOTPCodeUsed is returned when a code's time step was already accepted,
+// for example by a concurrent login with the same code.
+var ErrTOTPCodeUsed = errors.New("TOTP code already used")
+
+// TwoFactor is a user's TOTP state.
+type TwoFactor struct {
+	Secret   string // Base32 secret, decrypted; set but not enabled while enrolling
+	Enabled  bool
+	LastStep int64 // Last time step a code was accepted for, to stop replays
+}
+
+// GetTwoFactor returns a user's TOTP state.
+func GetTwoFactor(userID int) (*TwoFactor, error) {
+	var secret sql.NullString
+	var enabled sql.NullBool
+	var lastStep sql.NullInt64
+	err := db.QueryRow(
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?",
+		userID,
+	).Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+
+	tf := &TwoFactor{Enabled: enabled.Bool, LastStep: lastStep.Int64}
+	if secret.String != "" {
+		tf.Secret, err = secrets.Decrypt(secret.String)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+		}
+	}
+	return tf, nil
+}
+
+// SetPendingTOTPSecret stores a new TOTP secret that is not enabled until the
+// user confirms it with a code.
+func SetPendingTOTPSecret(userID int, secret string) error {
+	encrypted, err := secrets.Encrypt(secret)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"UPDATE users SET totp_secret = ?, totp_enabled = FALSE, totp_last_step = 0 WHERE id = ? AND COALESCE(totp_enabled, FALSE) = FALSE",
+		encrypted, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication with the pending secret.
+func EnableTOTP(userID int, step int64) error {
+	_, err := db.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE id = ?", step, userID)
+	if err != nil {
+		return fmt.Errorf("failed to enable TOTP: %w", err)
+	}
+	return nil
+}
+
+// SetTOTPLastStep records the time step of an accepted code. Only one caller
+// can record a step, so a code checked by two requests at once is accepted
+// once; the other gets ErrTOTPCodeUsed.
+func SetTOTPLastStep(userID int, step int64) error {
+	res, err := db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND COALESCE(totp_last_step, 0) < ?", step, userID, step)
+	if err != nil {
+		return fmt.Errorf("failed to update TOTP step: %w", err)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrTOTPCodeUsed
+	}
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication and deletes the secret and
+// recovery codes.
+func DisableTOTP(userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to disable TOTP: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ResetTwoFactor turns off two-factor authentication for a user by name, for
+// users who have lost their authenticator and recovery codes.
+func ResetTwoFactor(username string) error {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	return DisableTOTP(user.ID)
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReplaceRecoveryCodes stores a new set of recovery codes, invalidating the old ones.
+func ReplaceRecoveryCodes(userID int, codes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(code)); err != nil {
+			return fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode redeems one of a user's unused recovery codes. It returns
+// false if the code is unknown or already used.
+func UseRecoveryCode(userID int, code string) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC(), userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has.
+func CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("database query error: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,46 @@
+package users
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSetTOTPLastStepOnce(t *testing.T) {
+	setupDirectory(t, nil)
+	if err := CreateUser("erin", testPassword); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	user, _ := GetUserByUsername("erin")
+
+	// Two logins racing with the same code: only one may record its step
+	var wg sync.WaitGroup
+	results := make([]error, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = SetTOTPLastStep(user.ID, 100)
+		}(i)
+	}
+	wg.Wait()
+	accepted := 0
+	for _, err := range results {
+		switch {
+		case err == nil:
+			accepted++
+		case !errors.Is(err, ErrTOTPCodeUsed):
+			t.Fatalf("SetTOTPLastStep: %v", err)
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("step recorded %d times, want once", accepted)
+	}
+
+	if err := SetTOTPLastStep(user.ID, 99); !errors.Is(err, ErrTOTPCodeUsed) {
+		t.Errorf("earlier step: got %v, want ErrTOTPCodeUsed", err)
+	}
+	if err := SetTOTPLastStep(user.ID, 101); err != nil {
+		t.Errorf("later step: %v", err)
+	}
+}
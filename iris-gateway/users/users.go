@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	// "strings" // Remove this unused import
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"iris-gateway/secrets"
 	"iris-gateway/session" // Import the session package
 )
 
@@ -19,6 +20,10 @@ type User struct {
 	Username       string
 	HashedPassword string
 	IsSuspended    bool
+	IsAdmin        bool // May use the admin API
+	AuthSource     string // "local", or the directory the account comes from
+	ExternalID     string // The account's ID in that directory, if it has one
+	DirectorySuspended bool // Suspended because the directory disabled the account
 	CreatedAt      time.Time
 }
 
@@ -74,12 +79,336 @@ func InitDB(dataSourceName string) error {
 		return fmt.Errorf("failed to create irc_networks table: %w", err)
 	}
 
+	// Columns added after the original irc_networks schema
+	networkColumns := []struct{ name, definition string }{
+		{"sasl_mechanism", "TEXT"}, // "", "PLAIN", "EXTERNAL" or "SCRAM-SHA-256"
+		{"sasl_username", "TEXT"},
+		{"sasl_password", "TEXT"},
+		{"client_cert", "TEXT"}, // PEM certificate
+		{"client_key", "TEXT"},  // PEM private key, encrypted with the master key
+		{"tls_verify_mode", "TEXT"}, // "verify", "pin" or "insecure"
+		{"tls_pinned_fingerprint", "TEXT"},
+		{"proxy_url", "TEXT"},
+		{"bind_address", "TEXT"},
+		{"address_family", "TEXT"}, // "", "ipv4" or "ipv6"
+		{"last_server_index", "INTEGER DEFAULT 0"}, // Position of the server that last worked
+		{"nickserv_password", "TEXT"},
+		{"proxy_password", "TEXT"},
+	}
+	for _, col := range networkColumns {
+		if err := addColumnIfMissing("irc_networks", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// Servers of each network, tried in order of position
+	createIRCNetworkServersTableSQL := `
+	CREATE TABLE IF NOT EXISTS irc_network_servers (
+		network_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		hostname TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		use_ssl BOOLEAN NOT NULL,
+		password TEXT,
+		FOREIGN KEY (network_id) REFERENCES irc_networks(id) ON DELETE CASCADE,
+		PRIMARY KEY (network_id, position)
+	);`
+
+	_, err = db.Exec(createIRCNetworkServersTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create irc_network_servers table: %w", err)
+	}
+	if err := addColumnIfMissing("irc_network_servers", "tls_pinned_fingerprint", "TEXT"); err != nil {
+		return err
+	}
+	// A network's pin used to cover all of its servers. Give it to the server
+	// that last worked, the only one it could have matched; the others pin
+	// their own certificate on first use.
+	_, err = db.Exec(`
+	UPDATE irc_network_servers SET tls_pinned_fingerprint = COALESCE((
+		SELECT n.tls_pinned_fingerprint FROM irc_networks n
+		WHERE n.id = irc_network_servers.network_id AND n.last_server_index = irc_network_servers.position
+	), '')
+	WHERE tls_pinned_fingerprint IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to migrate pinned fingerprints to servers: %w", err)
+	}
+
+	// Channels the user is currently joined to on each network, rejoined on connect
+	createIRCNetworkChannelsTableSQL := `
+	CREATE TABLE IF NOT EXISTS irc_network_channels (
+		network_id INTEGER NOT NULL,
+		channel TEXT NOT NULL, -- Lowercased channel name
+		name TEXT NOT NULL, -- Channel name as joined
+		channel_key TEXT,
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (network_id) REFERENCES irc_networks(id) ON DELETE CASCADE,
+		PRIMARY KEY (network_id, channel)
+	);`
+
+	_, err = db.Exec(createIRCNetworkChannelsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create irc_network_channels table: %w", err)
+	}
+
+	// Login tokens; only a SHA-256 hash of each token is stored
+	createSessionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		device_name TEXT,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`
+
+	_, err = db.Exec(createSessionsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions table: %w", err)
+	}
+
+	// Columns added after the original sessions schema
+	sessionColumns := []struct{ name, definition string }{
+		{"client_version", "TEXT"},
+		{"last_ip", "TEXT"},
+	}
+	for _, col := range sessionColumns {
+		if err := addColumnIfMissing("sessions", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// Columns added after the original users schema
+	userColumns := []struct{ name, definition string }{
+		{"totp_secret", "TEXT"}, // Base32 TOTP secret, encrypted with the master key
+		{"totp_enabled", "BOOLEAN DEFAULT FALSE"},
+		{"totp_last_step", "INTEGER DEFAULT 0"}, // Time step of the last accepted code
+		{"is_admin", "BOOLEAN DEFAULT FALSE"},
+		{"auth_source", "TEXT DEFAULT 'local'"}, // "local", "ldap" or "oidc"
+		{"external_id", "TEXT"},
+		{"external_token", "TEXT"}, // e.g. an OIDC refresh token, encrypted with the master key
+		{"directory_suspended", "BOOLEAN DEFAULT FALSE"},
+	}
+	for _, col := range userColumns {
+		if err := addColumnIfMissing("users", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// One-time recovery codes for two-factor authentication; only hashes are stored
+	createRecoveryCodesTableSQL := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		PRIMARY KEY (user_id, code_hash)
+	);`
+
+	_, err = db.Exec(createRecoveryCodesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create recovery_codes table: %w", err)
+	}
+
+	// Audit log of login attempts
+	createLoginAttemptsTableSQL := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		success BOOLEAN NOT NULL,
+		reason TEXT,
+		attempted_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_login_attempts_username ON login_attempts(username);`
+
+	_, err = db.Exec(createLoginAttemptsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create login_attempts table: %w", err)
+	}
+
+	// Failed-login counters per username and per IP, so lockouts survive a restart
+	createLoginThrottleTableSQL := `
+	CREATE TABLE IF NOT EXISTS login_throttle (
+		key TEXT PRIMARY KEY, -- "user:<name>" or "ip:<address>"
+		failures INTEGER NOT NULL,
+		last_failure DATETIME NOT NULL,
+		locked_until DATETIME
+	);`
+
+	_, err = db.Exec(createLoginThrottleTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create login_throttle table: %w", err)
+	}
+
+	// Invite codes for self-registration; only hashes of the codes are stored
+	createInvitesTableSQL := `
+	CREATE TABLE IF NOT EXISTS invites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		code_hash TEXT NOT NULL UNIQUE,
+		code_hint TEXT NOT NULL,
+		note TEXT,
+		created_by INTEGER, -- Admin who created it
+		max_uses INTEGER NOT NULL,
+		uses INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		revoked_at DATETIME
+	);`
+
+	_, err = db.Exec(createInvitesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create invites table: %w", err)
+	}
+
+	// Accounts registered with each invite, kept after the account is deleted
+	createInviteUsesTableSQL := `
+	CREATE TABLE IF NOT EXISTS invite_uses (
+		invite_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		used_at DATETIME NOT NULL,
+		FOREIGN KEY (invite_id) REFERENCES invites(id)
+	);`
+
+	_, err = db.Exec(createInviteUsesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create invite_uses table: %w", err)
+	}
+
+	// Per-user quota overrides set by admins; NULL columns use the config defaults
+	createUserQuotasTableSQL := `
+	CREATE TABLE IF NOT EXISTS user_quotas (
+		user_id INTEGER PRIMARY KEY,
+		max_networks INTEGER,
+		max_connections INTEGER,
+		max_channels INTEGER,
+		attachment_bytes INTEGER,
+		history_retention TEXT, -- Duration such as "72h"
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+
+	_, err = db.Exec(createUserQuotasTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create user_quotas table: %w", err)
+	}
+
+	// Uploaded attachments, counted against their uploader's storage quota
+	createAttachmentsTableSQL := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		filename TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_user ON attachments(user_id, created_at);`
+
+	_, err = db.Exec(createAttachmentsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create attachments table: %w", err)
+	}
+
+	// Personal access tokens for scripts and bots; only hashes are stored
+	createAPITokensTableSQL := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		token_hint TEXT NOT NULL,
+		scopes TEXT NOT NULL, -- JSON array of strings
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		last_ip TEXT,
+		expires_at DATETIME, -- NULL for tokens that don't expire
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);`
+
+	_, err = db.Exec(createAPITokensTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create api_tokens table: %w", err)
+	}
+
+	// Incoming webhooks that post to a channel of a user's network
+	createWebhooksTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		network_id INTEGER NOT NULL,
+		channel TEXT NOT NULL,
+		format TEXT NOT NULL, -- "auto", "text", "json", "github", "gitlab", "alertmanager" or "slack"
+		notice BOOLEAN NOT NULL DEFAULT FALSE,
+		rate_limit INTEGER NOT NULL, -- Posts per minute
+		secret TEXT NOT NULL, -- Encrypted with the master key, to check HMAC signatures
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (network_id) REFERENCES irc_networks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks(user_id);`
+
+	_, err = db.Exec(createWebhooksTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create webhooks table: %w", err)
+	}
+
+	// Proxy passwords used to be part of the proxy URL
+	if err := moveProxyPasswords(); err != nil {
+		return err
+	}
+	// Secrets from before encryption at rest are still plaintext
+	if err := encryptStoredSecrets(); err != nil {
+		return err
+	}
+
 	log.Println("User and IRC network databases initialized.")
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table, so databases created
+// by older versions pick up new fields.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s schema: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	log.Printf("Added column %s to %s table.", column, table)
+	return nil
+}
+
 // CreateUser hashes the password and inserts a new user into the database.
 func CreateUser(username, password string) error {
+	if err := CheckPasswordPolicy(username, password); err != nil {
+		return err
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("failed to hash password: %w", err)
@@ -96,58 +425,86 @@ func CreateUser(username, password string) error {
 	return nil
 }
 
-// AuthenticateUser checks the provided username and password against the database.
-// It returns the User object if authentication is successful, otherwise an error.
-func AuthenticateUser(username, password string) (*User, error) {
-	user := &User{}
-	err := db.QueryRow(
-		"SELECT id, username, hashed_password, is_suspended, created_at FROM users WHERE username = ?",
-		username,
-	).Scan(&user.ID, &user.Username, &user.HashedPassword, &user.IsSuspended, &user.CreatedAt)
-
+// DeleteUser removes a user from the database and ends their live session.
+func DeleteUser(username string) error {
+	user, err := GetUserByUsername(username)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found")
-		}
-		return nil, fmt.Errorf("database query error: %w", err)
+		return fmt.Errorf("user '%s' not found", username)
 	}
+	session.RemoveSession(user.ID)
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password)); err != nil {
-		return nil, fmt.Errorf("invalid password")
+	// Foreign keys are not enforced, so everything the user owns is deleted
+	// explicitly, all or nothing.
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	return user, nil
-}
-
-// DeleteUser removes a user from the database.
-func DeleteUser(username string) error {
-	result, err := db.Exec("DELETE FROM users WHERE username = ?", username)
-	if err != nil {
+	for _, table := range []string{"irc_network_servers", "irc_network_channels"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE network_id IN (SELECT id FROM irc_networks WHERE user_id = ?)", table), user.ID); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+	for _, table := range []string{"webhooks", "irc_networks", "sessions", "recovery_codes", "user_quotas", "api_tokens"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ?", table), user.ID); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+	// Invite uses stay as the audit trail of who registered with a code, from
+	// where; only the link to the deleted account goes, so a later account
+	// given the same ID isn't listed as their registration.
+	if _, err := tx.Exec("UPDATE invite_uses SET user_id = 0 WHERE user_id = ?", user.ID); err != nil {
+		return fmt.Errorf("failed to unlink invite uses: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", user.ID); err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("user '%s' not found", username)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
 	}
 	return nil
 }
 
-// SuspendUser sets the is_suspended flag to true for a given user.
+// SuspendUser sets the is_suspended flag to true for a given user, logs out
+// their devices and ends their live session and IRC connections.
 func SuspendUser(username string) error {
-	result, err := db.Exec("UPDATE users SET is_suspended = TRUE WHERE username = ?", username)
+	user, err := GetUserByUsername(username)
 	if err != nil {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	if _, err := db.Exec("UPDATE users SET is_suspended = TRUE, directory_suspended = FALSE WHERE id = ?", user.ID); err != nil {
 		return fmt.Errorf("failed to suspend user: %w", err)
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return fmt.Errorf("user '%s' not found", username)
+	if _, err := RevokeAllSessions(user.ID, 0); err != nil {
+		return err
 	}
+	session.RemoveSession(user.ID)
 	return nil
 }
 
+// GetSuspendedUserIDs returns the IDs of all suspended users.
+func GetSuspendedUserIDs() ([]int, error) {
+	rows, err := db.Query("SELECT id FROM users WHERE is_suspended = TRUE")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // UnsuspendUser sets the is_suspended flag to false for a given user.
 func UnsuspendUser(username string) error {
-	result, err := db.Exec("UPDATE users SET is_suspended = FALSE WHERE username = ?", username)
+	result, err := db.Exec("UPDATE users SET is_suspended = FALSE, directory_suspended = FALSE WHERE username = ?", username)
 	if err != nil {
 		return fmt.Errorf("failed to unsuspend user: %w", err)
 	}
@@ -158,14 +515,70 @@ func UnsuspendUser(username string) error {
 	return nil
 }
 
+// userColumnsSQL lists the users columns read by scanUser, in order.
+const userColumnsSQL = "id, username, hashed_password, is_suspended, is_admin, auth_source, external_id, directory_suspended, created_at"
+
+// scanUser reads one users row selected with userColumnsSQL.
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var isAdmin, directorySuspended sql.NullBool
+	var authSource, externalID sql.NullString
+	if err := row.Scan(&user.ID, &user.Username, &user.HashedPassword, &user.IsSuspended, &isAdmin, &authSource, &externalID, &directorySuspended, &user.CreatedAt); err != nil {
+		return nil, err
+	}
+	user.IsAdmin = isAdmin.Bool
+	user.AuthSource = authSource.String
+	if user.AuthSource == "" {
+		user.AuthSource = LocalAuthSource
+	}
+	user.ExternalID = externalID.String
+	user.DirectorySuspended = directorySuspended.Bool
+	return user, nil
+}
+
 // GetUserByUsername retrieves a user by their username.
 func GetUserByUsername(username string) (*User, error) {
-	user := &User{}
-	err := db.QueryRow(
-		"SELECT id, username, hashed_password, is_suspended, created_at FROM users WHERE username = ?",
-		username,
-	).Scan(&user.ID, &user.Username, &user.HashedPassword, &user.IsSuspended, &user.CreatedAt)
+	user, err := scanUser(db.QueryRow("SELECT "+userColumnsSQL+" FROM users WHERE username = ?", username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	return user, nil
+}
+
+// GetActiveUsers returns every user who isn't suspended.
+func GetActiveUsers() ([]*User, error) {
+	return queryUsers("SELECT " + userColumnsSQL + " FROM users WHERE is_suspended = FALSE ORDER BY id")
+}
 
+// ListUsers returns every user, suspended or not.
+func ListUsers() ([]*User, error) {
+	return queryUsers("SELECT " + userColumnsSQL + " FROM users ORDER BY id")
+}
+
+func queryUsers(query string, args ...interface{}) ([]*User, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	var result []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		result = append(result, user)
+	}
+	return result, rows.Err()
+}
+
+// GetUserByID retrieves a user by their ID.
+func GetUserByID(userID int) (*User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumnsSQL+" FROM users WHERE id = ?", userID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -175,6 +588,38 @@ func GetUserByUsername(username string) (*User, error) {
 	return user, nil
 }
 
+// SetAdmin grants or removes a user's admin role.
+func SetAdmin(username string, admin bool) error {
+	result, err := db.Exec("UPDATE users SET is_admin = ? WHERE username = ?", admin, username)
+	if err != nil {
+		return fmt.Errorf("failed to update admin role: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("user '%s' not found", username)
+	}
+	return nil
+}
+
+// CountNetworksByUser returns how many networks each user has configured.
+func CountNetworksByUser() (map[int]int, error) {
+	rows, err := db.Query("SELECT user_id, COUNT(*) FROM irc_networks GROUP BY user_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count networks: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var userID, count int
+		if err := rows.Scan(&userID, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan network count: %w", err)
+		}
+		counts[userID] = count
+	}
+	return counts, rows.Err()
+}
+
 // CloseDB closes the database connection. Should be called on application shutdown.
 func CloseDB() {
 	if db != nil {
@@ -198,15 +643,29 @@ func AddUserNetwork(userID int, netConfig *session.UserNetwork) (int, error) {
 		return 0, fmt.Errorf("failed to marshal initial channels: %w", err)
 	}
 
-	res, err := db.Exec(
-		`INSERT INTO irc_networks (user_id, network_name, hostname, port, use_ssl, server_password, auto_reconnect, modules, perform_commands, initial_channels, nickname, alt_nickname, ident, realname, quit_message)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	secret, err := encryptNetworkSecrets(netConfig)
+	if err != nil {
+		return 0, err
+	}
+
+	// The network and its servers are saved together, so a failure leaves
+	// no network without servers behind.
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO irc_networks (user_id, network_name, hostname, port, use_ssl, server_password, auto_reconnect, modules, perform_commands, initial_channels, nickname, alt_nickname, ident, realname, quit_message,
+		sasl_mechanism, sasl_username, sasl_password, tls_verify_mode, tls_pinned_fingerprint, proxy_url, bind_address, address_family, nickserv_password, proxy_password)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		userID,
 		netConfig.NetworkName,
 		netConfig.Hostname,
 		netConfig.Port,
 		netConfig.UseSSL,
-		netConfig.ServerPassword,
+		secret.serverPassword,
 		netConfig.AutoReconnect,
 		string(modulesJSON),
 		string(performCommandsJSON),
@@ -216,6 +675,16 @@ func AddUserNetwork(userID int, netConfig *session.UserNetwork) (int, error) {
 		netConfig.Ident,
 		netConfig.Realname,
 		netConfig.QuitMessage,
+		netConfig.SASLMechanism,
+		netConfig.SASLUsername,
+		secret.saslPassword,
+		netConfig.TLSVerifyMode,
+		netConfig.TLSPinnedFingerprint,
+		netConfig.ProxyURL,
+		netConfig.BindAddress,
+		netConfig.AddressFamily,
+		secret.nickServPassword,
+		secret.proxyPassword,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("failed to add user network: %w", err)
@@ -224,101 +693,38 @@ func AddUserNetwork(userID int, netConfig *session.UserNetwork) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("failed to get last insert ID: %w", err)
 	}
+	if err := setNetworkServers(tx, int(id), netConfig.Servers); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to add user network: %w", err)
+	}
 	return int(id), nil
 }
 
-// GetUserNetworks retrieves all IRC network configurations for a given user.
-func GetUserNetworks(userID int) ([]*session.UserNetwork, error) {
-	rows, err := db.Query("SELECT id, network_name, hostname, port, use_ssl, server_password, auto_reconnect, modules, perform_commands, initial_channels, nickname, alt_nickname, ident, realname, quit_message FROM irc_networks WHERE user_id = ?", userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user networks: %w", err)
-	}
-	defer rows.Close()
+// networkColumnsSQL lists the irc_networks columns read by scanUserNetwork, in order.
+const networkColumnsSQL = `id, network_name, hostname, port, use_ssl, server_password, auto_reconnect, modules, perform_commands, initial_channels, nickname, alt_nickname, ident, realname, quit_message,
+	sasl_mechanism, sasl_username, sasl_password, client_cert, client_key, tls_verify_mode, tls_pinned_fingerprint,
+	proxy_url, bind_address, address_family, last_server_index, nickserv_password, proxy_password`
 
-	var networks []*session.UserNetwork
-	for rows.Next() {
-		var netConfig session.UserNetwork
-		var modulesJSON, performCommandsJSON, initialChannelsJSON sql.NullString
-		var serverPassword sql.NullString
-		var altNickname, ident, realname, quitMessage sql.NullString
-
-		err := rows.Scan(
-			&netConfig.ID,
-			&netConfig.NetworkName,
-			&netConfig.Hostname,
-			&netConfig.Port,
-			&netConfig.UseSSL,
-			&serverPassword,
-			&netConfig.AutoReconnect,
-			&modulesJSON,
-			&performCommandsJSON,
-			&initialChannelsJSON,
-			&netConfig.Nickname,
-			&altNickname,
-			&ident,
-			&realname,
-			&quitMessage,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan user network row: %w", err)
-		}
-
-		if serverPassword.Valid {
-			netConfig.ServerPassword = serverPassword.String
-		}
-		if altNickname.Valid {
-			netConfig.AltNickname = altNickname.String
-		}
-		if ident.Valid {
-			netConfig.Ident = ident.String
-		}
-		if realname.Valid {
-			netConfig.Realname = realname.String
-		}
-		if quitMessage.Valid {
-			netConfig.QuitMessage = quitMessage.String
-		}
-
-		if modulesJSON.Valid && modulesJSON.String != "" {
-			if err := json.Unmarshal([]byte(modulesJSON.String), &netConfig.Modules); err != nil {
-				log.Printf("Warning: Failed to unmarshal modules for network %d: %v", netConfig.ID, err)
-			}
-		} else {
-			netConfig.Modules = []string{}
-		}
-		if performCommandsJSON.Valid && performCommandsJSON.String != "" {
-			if err := json.Unmarshal([]byte(performCommandsJSON.String), &netConfig.PerformCommands); err != nil {
-				log.Printf("Warning: Failed to unmarshal perform commands for network %d: %v", netConfig.ID, err)
-			}
-		} else {
-			netConfig.PerformCommands = []string{}
-		}
-		if initialChannelsJSON.Valid && initialChannelsJSON.String != "" {
-			if err := json.Unmarshal([]byte(initialChannelsJSON.String), &netConfig.InitialChannels); err != nil {
-				log.Printf("Warning: Failed to unmarshal initial channels for network %d: %v", netConfig.ID, err)
-			}
-		} else {
-			netConfig.InitialChannels = []string{}
-		}
-
-		netConfig.UserID = userID // Set UserID
-		networks = append(networks, &netConfig)
-	}
-	return networks, nil
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-// GetSingleUserNetwork retrieves a single IRC network configuration for a given user and network ID.
-func GetSingleUserNetwork(userID, networkID int) (*session.UserNetwork, error) {
+// scanUserNetwork reads one irc_networks row selected with networkColumnsSQL.
+func scanUserNetwork(row rowScanner) (*session.UserNetwork, error) {
 	var netConfig session.UserNetwork
 	var modulesJSON, performCommandsJSON, initialChannelsJSON sql.NullString
 	var serverPassword sql.NullString
 	var altNickname, ident, realname, quitMessage sql.NullString
+	var saslMechanism, saslUsername, saslPassword, nickServPassword, proxyPassword sql.NullString
+	var clientCert, clientKey sql.NullString
+	var tlsVerifyMode, tlsPinnedFingerprint sql.NullString
+	var proxyURL, bindAddress, addressFamily sql.NullString
+	var lastServerIndex sql.NullInt64
 
-	err := db.QueryRow(
-		`SELECT id, network_name, hostname, port, use_ssl, server_password, auto_reconnect, modules, perform_commands, initial_channels, nickname, alt_nickname, ident, realname, quit_message
-		 FROM irc_networks WHERE user_id = ? AND id = ?`,
-		userID, networkID,
-	).Scan(
+	err := row.Scan(
 		&netConfig.ID,
 		&netConfig.NetworkName,
 		&netConfig.Hostname,
@@ -334,29 +740,56 @@ func GetSingleUserNetwork(userID, networkID int) (*session.UserNetwork, error) {
 		&ident,
 		&realname,
 		&quitMessage,
+		&saslMechanism,
+		&saslUsername,
+		&saslPassword,
+		&clientCert,
+		&clientKey,
+		&tlsVerifyMode,
+		&tlsPinnedFingerprint,
+		&proxyURL,
+		&bindAddress,
+		&addressFamily,
+		&lastServerIndex,
+		&nickServPassword,
+		&proxyPassword,
 	)
-
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("network config with ID %d not found for user %d", networkID, userID)
-		}
-		return nil, fmt.Errorf("database query error: %w", err)
+		return nil, err
 	}
 
-	if serverPassword.Valid {
-		netConfig.ServerPassword = serverPassword.String
+	netConfig.AltNickname = altNickname.String
+	netConfig.Ident = ident.String
+	netConfig.Realname = realname.String
+	netConfig.QuitMessage = quitMessage.String
+	netConfig.SASLMechanism = saslMechanism.String
+	netConfig.SASLUsername = saslUsername.String
+	netConfig.TLSVerifyMode = tlsVerifyMode.String
+	netConfig.TLSPinnedFingerprint = tlsPinnedFingerprint.String
+	netConfig.ProxyURL = proxyURL.String
+	netConfig.BindAddress = bindAddress.String
+	netConfig.AddressFamily = addressFamily.String
+	netConfig.ServerIndex = int(lastServerIndex.Int64)
+	if netConfig.ServerPassword, err = secrets.Decrypt(serverPassword.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt server password for network %d: %w", netConfig.ID, err)
 	}
-	if altNickname.Valid {
-		netConfig.AltNickname = altNickname.String
+	if netConfig.SASLPassword, err = secrets.Decrypt(saslPassword.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt SASL password for network %d: %w", netConfig.ID, err)
 	}
-	if ident.Valid {
-		netConfig.Ident = ident.String
+	if netConfig.NickServPassword, err = secrets.Decrypt(nickServPassword.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt NickServ password for network %d: %w", netConfig.ID, err)
 	}
-	if realname.Valid {
-		netConfig.Realname = realname.String
+	if netConfig.ProxyPassword, err = secrets.Decrypt(proxyPassword.String); err != nil {
+		return nil, fmt.Errorf("failed to decrypt proxy password for network %d: %w", netConfig.ID, err)
 	}
-	if quitMessage.Valid {
-		netConfig.QuitMessage = quitMessage.String
+	if clientCert.String != "" {
+		key, err := secrets.Decrypt(clientKey.String)
+		if err != nil {
+			log.Printf("Warning: Failed to decrypt client key for network %d: %v", netConfig.ID, err)
+		} else {
+			netConfig.ClientCert = clientCert.String
+			netConfig.ClientKey = key
+		}
 	}
 
 	if modulesJSON.Valid && modulesJSON.String != "" {
@@ -384,13 +817,61 @@ func GetSingleUserNetwork(userID, networkID int) (*session.UserNetwork, error) {
 		netConfig.InitialChannels = []string{}
 	}
 
+	return &netConfig, nil
+}
+
+// GetUserNetworks retrieves all IRC network configurations for a given user.
+func GetUserNetworks(userID int) ([]*session.UserNetwork, error) {
+	rows, err := db.Query("SELECT "+networkColumnsSQL+" FROM irc_networks WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user networks: %w", err)
+	}
+	defer rows.Close()
+
+	var networks []*session.UserNetwork
+	for rows.Next() {
+		netConfig, err := scanUserNetwork(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user network row: %w", err)
+		}
+
+		netConfig.UserID = userID // Set UserID
+		networks = append(networks, netConfig)
+	}
+	rows.Close()
+
+	for _, netConfig := range networks {
+		if netConfig.Servers, err = GetNetworkServers(netConfig.ID); err != nil {
+			return nil, err
+		}
+	}
+	return networks, nil
+}
+
+// GetSingleUserNetwork retrieves a single IRC network configuration for a given user and network ID.
+func GetSingleUserNetwork(userID, networkID int) (*session.UserNetwork, error) {
+	netConfig, err := scanUserNetwork(db.QueryRow(
+		"SELECT "+networkColumnsSQL+" FROM irc_networks WHERE user_id = ? AND id = ?",
+		userID, networkID,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("network config with ID %d not found for user %d", networkID, userID)
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+
+	if netConfig.Servers, err = GetNetworkServers(netConfig.ID); err != nil {
+		return nil, err
+	}
+
 	netConfig.UserID = userID // Set UserID
 	// Note: is_connected and Channels (live state) are not stored in DB,
 	// so they will be default zero values. This is fine as the client
 	// will fetch live state separately via WebSocket.
 	netConfig.Channels = make(map[string]*session.ChannelState) // Ensure map is initialized
 
-	return &netConfig, nil
+	return netConfig, nil
 }
 
 // UpdateUserNetwork updates an existing IRC network configuration.
@@ -407,17 +888,33 @@ func UpdateUserNetwork(userID int, netConfig *session.UserNetwork) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal initial channels: %w", err)
 	}
+	secret, err := encryptNetworkSecrets(netConfig)
+	if err != nil {
+		return err
+	}
+	oldServers, err := GetNetworkServers(netConfig.ID)
+	if err != nil {
+		return err
+	}
 
-	res, err := db.Exec(
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
 		`UPDATE irc_networks SET network_name = ?, hostname = ?, port = ?, use_ssl = ?, server_password = ?,
 		auto_reconnect = ?, modules = ?, perform_commands = ?, initial_channels = ?, nickname = ?,
-		alt_nickname = ?, ident = ?, realname = ?, quit_message = ?
+		alt_nickname = ?, ident = ?, realname = ?, quit_message = ?,
+		sasl_mechanism = ?, sasl_username = ?, sasl_password = ?, tls_verify_mode = ?, tls_pinned_fingerprint = ?,
+		proxy_url = ?, bind_address = ?, address_family = ?, nickserv_password = ?, proxy_password = ?
 		WHERE id = ? AND user_id = ?`,
 		netConfig.NetworkName,
 		netConfig.Hostname,
 		netConfig.Port,
 		netConfig.UseSSL,
-		netConfig.ServerPassword,
+		secret.serverPassword,
 		netConfig.AutoReconnect,
 		string(modulesJSON),
 		string(performCommandsJSON),
@@ -427,6 +924,16 @@ func UpdateUserNetwork(userID int, netConfig *session.UserNetwork) error {
 		netConfig.Ident,
 		netConfig.Realname,
 		netConfig.QuitMessage,
+		netConfig.SASLMechanism,
+		netConfig.SASLUsername,
+		secret.saslPassword,
+		netConfig.TLSVerifyMode,
+		netConfig.TLSPinnedFingerprint,
+		netConfig.ProxyURL,
+		netConfig.BindAddress,
+		netConfig.AddressFamily,
+		secret.nickServPassword,
+		secret.proxyPassword,
 		netConfig.ID,
 		userID,
 	)
@@ -437,6 +944,104 @@ func UpdateUserNetwork(userID int, netConfig *session.UserNetwork) error {
 	if rowsAffected == 0 {
 		return fmt.Errorf("network config with ID %d not found for user %d", netConfig.ID, userID)
 	}
+
+	if !sameServers(oldServers, netConfig.Servers) {
+		if err := setNetworkServers(tx, netConfig.ID, netConfig.Servers); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update user network: %w", err)
+	}
+	if !sameAddresses(oldServers, netConfig.Servers) {
+		// Positions changed meaning, so start again from the first server.
+		netConfig.ServerIndex = 0
+		if err := SetNetworkServerIndex(netConfig.ID, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sameServers(a, b []session.NetworkServer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameAddresses reports whether two server lists reach the same servers in
+// the same order, whatever their passwords and pins.
+func sameAddresses(a, b []session.NetworkServer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i].Hostname, b[i].Hostname) || a[i].Port != b[i].Port || a[i].UseSSL != b[i].UseSSL {
+			return false
+		}
+	}
+	return true
+}
+
+// setNetworkServers replaces the server list of a network as part of the
+// transaction saving the network.
+func setNetworkServers(tx *sql.Tx, networkID int, servers []session.NetworkServer) error {
+	if _, err := tx.Exec("DELETE FROM irc_network_servers WHERE network_id = ?", networkID); err != nil {
+		return fmt.Errorf("failed to clear network servers: %w", err)
+	}
+	for position, server := range servers {
+		password, err := secrets.Encrypt(server.Password)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO irc_network_servers (network_id, position, hostname, port, use_ssl, password, tls_pinned_fingerprint) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			networkID, position, server.Hostname, server.Port, server.UseSSL, password, server.PinnedFingerprint,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save network server: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetNetworkServers returns the servers of a network in order. It is empty for
+// networks saved before server lists existed.
+func GetNetworkServers(networkID int) ([]session.NetworkServer, error) {
+	rows, err := db.Query("SELECT hostname, port, use_ssl, password, tls_pinned_fingerprint FROM irc_network_servers WHERE network_id = ? ORDER BY position", networkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network servers: %w", err)
+	}
+	defer rows.Close()
+
+	var servers []session.NetworkServer
+	for rows.Next() {
+		var server session.NetworkServer
+		var password, pinnedFingerprint sql.NullString
+		if err := rows.Scan(&server.Hostname, &server.Port, &server.UseSSL, &password, &pinnedFingerprint); err != nil {
+			return nil, fmt.Errorf("failed to scan network server row: %w", err)
+		}
+		server.PinnedFingerprint = pinnedFingerprint.String
+		if server.Password, err = secrets.Decrypt(password.String); err != nil {
+			return nil, fmt.Errorf("failed to decrypt password of a server of network %d: %w", networkID, err)
+		}
+		servers = append(servers, server)
+	}
+	return servers, rows.Err()
+}
+
+// SetNetworkServerIndex records the position of the server that last worked.
+func SetNetworkServerIndex(networkID, index int) error {
+	_, err := db.Exec("UPDATE irc_networks SET last_server_index = ? WHERE id = ?", index, networkID)
+	if err != nil {
+		return fmt.Errorf("failed to save last server: %w", err)
+	}
 	return nil
 }
 
@@ -450,5 +1055,109 @@ func DeleteUserNetwork(userID, networkID int) error {
 	if rowsAffected == 0 {
 		return fmt.Errorf("network config with ID %d not found for user %d", networkID, userID)
 	}
+	// Foreign keys are not enforced on every connection, so clean up explicitly.
+	if _, err := db.Exec("DELETE FROM irc_network_channels WHERE network_id = ?", networkID); err != nil {
+		log.Printf("Warning: Failed to delete saved channels for network %d: %v", networkID, err)
+	}
+	if _, err := db.Exec("DELETE FROM irc_network_servers WHERE network_id = ?", networkID); err != nil {
+		log.Printf("Warning: Failed to delete servers for network %d: %v", networkID, err)
+	}
+	if _, err := db.Exec("DELETE FROM webhooks WHERE network_id = ?", networkID); err != nil {
+		log.Printf("Warning: Failed to delete webhooks for network %d: %v", networkID, err)
+	}
+	return nil
+}
+
+// SetNetworkClientCert stores a client certificate and its private key for a
+// network. The key is encrypted with the master key. Empty values remove them.
+func SetNetworkClientCert(userID, networkID int, certPEM, keyPEM string) error {
+	encryptedKey, err := secrets.Encrypt(keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt client key: %w", err)
+	}
+	res, err := db.Exec(
+		"UPDATE irc_networks SET client_cert = ?, client_key = ? WHERE id = ? AND user_id = ?",
+		certPEM, encryptedKey, networkID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save client certificate: %w", err)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("network config with ID %d not found for user %d", networkID, userID)
+	}
+	return nil
+}
+
+// SetNetworkServerPinnedFingerprint stores the certificate fingerprint the
+// server at position of a network is pinned to. The first server's pin is
+// also kept on the network, which is the only pin of networks without a
+// server list.
+func SetNetworkServerPinnedFingerprint(networkID, position int, fingerprint string) error {
+	_, err := db.Exec(
+		"UPDATE irc_network_servers SET tls_pinned_fingerprint = ? WHERE network_id = ? AND position = ?",
+		fingerprint, networkID, position,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save pinned fingerprint: %w", err)
+	}
+	if position == 0 {
+		if _, err := db.Exec("UPDATE irc_networks SET tls_pinned_fingerprint = ? WHERE id = ?", fingerprint, networkID); err != nil {
+			return fmt.Errorf("failed to save pinned fingerprint: %w", err)
+		}
+	}
+	return nil
+}
+
+// SaveNetworkChannel records that the user is joined to a channel on a network.
+// An empty key keeps any key that was saved before.
+func SaveNetworkChannel(networkID int, channel, key string) error {
+	_, err := db.Exec(
+		`INSERT INTO irc_network_channels (network_id, channel, name, channel_key) VALUES (?, ?, ?, ?)
+		ON CONFLICT(network_id, channel) DO UPDATE SET
+			name = excluded.name,
+			channel_key = CASE WHEN excluded.channel_key != '' THEN excluded.channel_key ELSE irc_network_channels.channel_key END`,
+		networkID,
+		strings.ToLower(channel),
+		channel,
+		key,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save channel %s for network %d: %w", channel, networkID, err)
+	}
+	return nil
+}
+
+// RemoveNetworkChannel forgets a channel the user has left on a network.
+func RemoveNetworkChannel(networkID int, channel string) error {
+	_, err := db.Exec("DELETE FROM irc_network_channels WHERE network_id = ? AND channel = ?", networkID, strings.ToLower(channel))
+	if err != nil {
+		return fmt.Errorf("failed to remove channel %s for network %d: %w", channel, networkID, err)
+	}
 	return nil
+}
+
+// GetNetworkChannels returns the saved channels for a network, as "#channel" or
+// "#channel key" entries in the same format as InitialChannels.
+func GetNetworkChannels(networkID int) ([]string, error) {
+	rows, err := db.Query("SELECT name, channel_key FROM irc_network_channels WHERE network_id = ? ORDER BY joined_at", networkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channels for network %d: %w", networkID, err)
+	}
+	defer rows.Close()
+
+	var channels []string
+	for rows.Next() {
+		var name string
+		var key sql.NullString
+		if err := rows.Scan(&name, &key); err != nil {
+			return nil, fmt.Errorf("failed to scan channel row: %w", err)
+		}
+		if key.Valid && key.String != "" {
+			channels = append(channels, name+" "+key.String)
+		} else {
+			channels = append(channels, name)
+		}
+	}
+	return channels, rows.Err()
 }
\ No newline at end of file
@@ -0,0 +1,80 @@
+package users
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"iris-gateway/session"
+)
+
+func TestDeleteUserRemovesEverything(t *testing.T) {
+	setupDirectory(t, nil)
+	for _, name := range []string{"frank", "grace"} {
+		if err := CreateUser(name, testPassword); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		user, _ := GetUserByUsername(name)
+		networkID, err := AddUserNetwork(user.ID, &session.UserNetwork{
+			NetworkName: "Libera", Hostname: "irc.libera.chat", Port: 6697, Nickname: name,
+			Servers: []session.NetworkServer{{Hostname: "irc.libera.chat", Port: 6697, UseSSL: true}},
+		})
+		if err != nil {
+			t.Fatalf("AddUserNetwork: %v", err)
+		}
+		if err := SaveNetworkChannel(networkID, "#go", ""); err != nil {
+			t.Fatalf("SaveNetworkChannel: %v", err)
+		}
+		if _, err := CreateWebhook(&Webhook{UserID: user.ID, Name: "ci", NetworkID: networkID, Channel: "#go", Format: "text", RateLimit: 10}); err != nil {
+			t.Fatalf("CreateWebhook: %v", err)
+		}
+		if _, _, err := CreateAPIToken(user.ID, "bot", []string{ScopeNetworksManage}, nil); err != nil {
+			t.Fatalf("CreateAPIToken: %v", err)
+		}
+		if err := ReplaceRecoveryCodes(user.ID, []string{"code"}); err != nil {
+			t.Fatalf("ReplaceRecoveryCodes: %v", err)
+		}
+		if _, _, err := CreateSession(Session{UserID: user.ID}, time.Hour); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+		if _, err := db.Exec("INSERT INTO invite_uses (invite_id, user_id, username, ip, used_at) VALUES (1, ?, ?, '127.0.0.1', ?)", user.ID, name, time.Now().UTC()); err != nil {
+			t.Fatalf("insert invite use: %v", err)
+		}
+	}
+
+	if err := DeleteUser("frank"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	// grace's rows are all still there; none of frank's are
+	for _, table := range []string{"users", "irc_networks", "irc_network_servers", "irc_network_channels", "webhooks", "api_tokens", "recovery_codes", "sessions"} {
+		var count int
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&count); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		if count != 1 {
+			t.Errorf("%s has %d rows after deleting one of two users, want 1", table, count)
+		}
+	}
+
+	// Both invite uses are kept for auditing, frank's no longer linked to an account
+	uses, err := ListInviteUses()
+	if err != nil {
+		t.Fatalf("ListInviteUses: %v", err)
+	}
+	if len(uses) != 2 {
+		t.Fatalf("%d invite uses after deleting a user, want 2", len(uses))
+	}
+	for _, use := range uses {
+		if use.Username == "frank" && use.UserID != 0 {
+			t.Errorf("frank's invite use still links to user %d", use.UserID)
+		}
+		if use.Username == "grace" && use.UserID == 0 {
+			t.Errorf("grace's invite use lost its user")
+		}
+	}
+
+	if err := DeleteUser("frank"); err == nil {
+		t.Errorf("deleting a deleted user succeeded")
+	}
+}
@@ -0,0 +1,181 @@
+package users
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"iris-gateway/secrets"
+)
+
+// ErrWebhookNotFound is returned for an unknown webhook.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook lets an outside service post to one channel of a user's network.
+type Webhook struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Username   string     `json:"-"`
+	Name       string     `json:"name"`
+	NetworkID  int        `json:"network_id"`
+	Channel    string     `json:"channel"`
+	Format     string     `json:"format"`     // How payloads are turned into lines, see the webhooks package
+	Notice     bool       `json:"notice"`     // Post as NOTICE instead of PRIVMSG
+	RateLimit  int        `json:"rate_limit"` // Posts per minute
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Secret     string     `json:"-"` // Decrypted
+}
+
+const webhookColumnsSQL = `w.id, w.user_id, u.username, w.name, w.network_id, w.channel, w.format, w.notice, w.rate_limit, w.created_at, w.last_used_at, w.secret`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	hook := &Webhook{}
+	var lastUsedAt sql.NullTime
+	var secret string
+	if err := row.Scan(&hook.ID, &hook.UserID, &hook.Username, &hook.Name, &hook.NetworkID, &hook.Channel, &hook.Format, &hook.Notice, &hook.RateLimit, &hook.CreatedAt, &lastUsedAt, &secret); err != nil {
+		return nil, err
+	}
+	if lastUsedAt.Valid {
+		hook.LastUsedAt = &lastUsedAt.Time
+	}
+	var err error
+	if hook.Secret, err = secrets.Decrypt(secret); err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret of webhook %d: %w", hook.ID, err)
+	}
+	return hook, nil
+}
+
+func newWebhookSecret() (string, string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	secret := hex.EncodeToString(raw)
+	// Kept decryptable rather than hashed, to check HMAC signatures
+	encrypted, err := secrets.Encrypt(secret)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, encrypted, nil
+}
+
+// CreateWebhook creates a webhook posting to a channel of one of the user's
+// networks. Its secret is in the returned Webhook.
+func CreateWebhook(hook *Webhook) (*Webhook, error) {
+	secret, encrypted, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.Exec(
+		"INSERT INTO webhooks (user_id, name, network_id, channel, format, notice, rate_limit, secret, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		hook.UserID, hook.Name, hook.NetworkID, hook.Channel, hook.Format, hook.Notice, hook.RateLimit, encrypted, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook ID: %w", err)
+	}
+	created, err := GetWebhook(int(id))
+	if err != nil {
+		return nil, err
+	}
+	if created.Secret != secret {
+		return nil, fmt.Errorf("webhook secret was not stored")
+	}
+	return created, nil
+}
+
+// GetWebhook returns a webhook by ID, if its user isn't suspended.
+func GetWebhook(id int) (*Webhook, error) {
+	hook, err := scanWebhook(db.QueryRow(`
+		SELECT `+webhookColumnsSQL+`
+		FROM webhooks w JOIN users u ON u.id = w.user_id
+		WHERE w.id = ? AND u.is_suspended = FALSE`,
+		id,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, fmt.Errorf("database query error: %w", err)
+	}
+	return hook, nil
+}
+
+// ListWebhooks returns a user's webhooks, newest first.
+func ListWebhooks(userID int) ([]*Webhook, error) {
+	rows, err := db.Query(`
+		SELECT `+webhookColumnsSQL+`
+		FROM webhooks w JOIN users u ON u.id = w.user_id
+		WHERE w.user_id = ? ORDER BY w.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var hooks []*Webhook
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// CountWebhooks returns how many webhooks a user has.
+func CountWebhooks(userID int) (int, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE user_id = ?", userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count webhooks: %w", err)
+	}
+	return count, nil
+}
+
+// RotateWebhookSecret gives one of a user's webhooks a new secret and
+// returns it. The old secret stops working.
+func RotateWebhookSecret(userID, hookID int) (string, error) {
+	secret, encrypted, err := newWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	result, err := db.Exec("UPDATE webhooks SET secret = ? WHERE id = ? AND user_id = ?", encrypted, hookID, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to update webhook: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return "", ErrWebhookNotFound
+	}
+	return secret, nil
+}
+
+// TouchWebhook records that a webhook was called.
+func TouchWebhook(hookID int) error {
+	if _, err := db.Exec("UPDATE webhooks SET last_used_at = ? WHERE id = ?", time.Now().UTC(), hookID); err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	return nil
+}
+
+// DeleteWebhook deletes one of a user's webhooks.
+func DeleteWebhook(userID, hookID int) error {
+	result, err := db.Exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", hookID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
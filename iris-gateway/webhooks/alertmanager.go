@@ -0,0 +1,49 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type alertmanagerPayload struct {
+	Alerts []struct {
+		Status      string            `json:"status"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"alerts"`
+}
+
+// formatAlertmanager posts one line per alert in a Prometheus Alertmanager
+// notification, firing ones first.
+func formatAlertmanager(body []byte) ([]string, error) {
+	var p alertmanagerPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	var firing, resolved []string
+	for _, alert := range p.Alerts {
+		line := "[" + strings.ToUpper(alert.Status)
+		if severity := alert.Labels["severity"]; severity != "" && alert.Status == "firing" {
+			line += ":" + severity
+		}
+		line += "] " + alert.Labels["alertname"]
+		if instance := alert.Labels["instance"]; instance != "" {
+			line += " on " + instance
+		}
+		summary := alert.Annotations["summary"]
+		if summary == "" {
+			summary = alert.Annotations["description"]
+		}
+		if summary != "" {
+			line += ": " + firstLine(summary)
+		}
+		if alert.Status == "resolved" {
+			resolved = append(resolved, line)
+		} else {
+			firing = append(firing, line)
+		}
+	}
+	return append(firing, resolved...), nil
+}
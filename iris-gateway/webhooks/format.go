@@ -0,0 +1,260 @@
+// Package webhooks turns the payloads that CI, monitoring and git hosting
+// services post to incoming webhooks into lines of IRC text.
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Formats a webhook can use. FormatAuto picks one from the request.
+const (
+	FormatAuto         = "auto"
+	FormatText         = "text"
+	FormatJSON         = "json"
+	FormatGitHub       = "github"
+	FormatGitLab       = "gitlab"
+	FormatAlertmanager = "alertmanager"
+	FormatSlack        = "slack"
+)
+
+// Formats lists every format, for validation and for clients.
+var Formats = []string{FormatAuto, FormatText, FormatJSON, FormatGitHub, FormatGitLab, FormatAlertmanager, FormatSlack}
+
+// Longest line posted, in bytes, leaving room in the 512 byte IRC line for
+// the command, target and the server's prefix.
+const maxLineLength = 400
+
+// ErrInvalidPayload wraps the reason a payload couldn't be read.
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// ValidFormat reports whether format is one of Formats.
+func ValidFormat(format string) bool {
+	for _, known := range Formats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Format turns a payload into at most maxLines lines, the last of which says
+// how many were left out. It returns no lines for events that aren't worth
+// posting, such as GitHub's ping.
+func Format(format string, header http.Header, body []byte, maxLines int) ([]string, error) {
+	if format == FormatAuto {
+		format = detectFormat(header, body)
+	}
+
+	var lines []string
+	var err error
+	switch format {
+	case FormatText:
+		lines = strings.Split(string(body), "\n")
+	case FormatJSON:
+		lines, err = formatJSON(body)
+	case FormatGitHub:
+		lines, err = formatGitHub(header.Get("X-GitHub-Event"), body)
+	case FormatGitLab:
+		lines, err = formatGitLab(header.Get("X-Gitlab-Event"), body)
+	case FormatAlertmanager:
+		lines, err = formatAlertmanager(body)
+	case FormatSlack:
+		lines, err = formatSlack(body)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return limitLines(lines, maxLines), nil
+}
+
+// detectFormat guesses the format of a payload from the headers its sender
+// sets and the shape of its JSON.
+func detectFormat(header http.Header, body []byte) string {
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		return FormatGitHub
+	case header.Get("X-Gitlab-Event") != "":
+		return FormatGitLab
+	}
+
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(body, &probe) != nil {
+		return FormatText
+	}
+	if _, ok := probe["alerts"]; ok {
+		if _, ok := probe["receiver"]; ok {
+			return FormatAlertmanager
+		}
+	}
+	if _, ok := probe["attachments"]; ok {
+		return FormatSlack
+	}
+	if _, ok := probe["blocks"]; ok {
+		return FormatSlack
+	}
+	return FormatJSON
+}
+
+// formatJSON posts the text, message or content field of a JSON object, and
+// any other JSON as it is.
+func formatJSON(body []byte) ([]string, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err == nil {
+		for _, field := range []string{"text", "message", "content", "body"} {
+			if text, ok := object[field].(string); ok && strings.TrimSpace(text) != "" {
+				return strings.Split(text, "\n"), nil
+			}
+		}
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return []string{compact.String()}, nil
+}
+
+// formatSlack posts the text of a Slack incoming webhook message and of its
+// attachments, so tools that only speak Slack can post here.
+func formatSlack(body []byte) ([]string, error) {
+	var payload struct {
+		Text        string `json:"text"`
+		Attachments []struct {
+			Fallback  string `json:"fallback"`
+			Pretext   string `json:"pretext"`
+			Title     string `json:"title"`
+			TitleLink string `json:"title_link"`
+			Text      string `json:"text"`
+		} `json:"attachments"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	var lines []string
+	if payload.Text != "" {
+		lines = append(lines, strings.Split(slackText(payload.Text), "\n")...)
+	}
+	for _, attachment := range payload.Attachments {
+		switch {
+		case attachment.Fallback != "":
+			lines = append(lines, strings.Split(slackText(attachment.Fallback), "\n")...)
+		default:
+			for _, text := range []string{attachment.Pretext, joinNonEmpty(" ", attachment.Title, attachment.TitleLink), attachment.Text} {
+				if text != "" {
+					lines = append(lines, strings.Split(slackText(text), "\n")...)
+				}
+			}
+		}
+	}
+	return lines, nil
+}
+
+// slackText replaces Slack's <url|label> links and mentions with plain text.
+func slackText(text string) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(text, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(text[start:], '>')
+		if end < 0 {
+			break
+		}
+		out.WriteString(text[:start])
+		link := text[start+1 : start+end]
+		if target, label, found := strings.Cut(link, "|"); found {
+			out.WriteString(label + " (" + target + ")")
+		} else {
+			out.WriteString(strings.TrimLeft(link, "@#!"))
+		}
+		text = text[start+end+1:]
+	}
+	out.WriteString(text)
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(out.String())
+}
+
+// limitLines cleans up lines for IRC, drops empty ones and keeps at most
+// maxLines.
+func limitLines(lines []string, maxLines int) []string {
+	var cleaned []string
+	for _, line := range lines {
+		if line = cleanLine(line); line != "" {
+			cleaned = append(cleaned, line)
+		}
+	}
+	if maxLines > 0 && len(cleaned) > maxLines {
+		omitted := len(cleaned) - maxLines + 1
+		cleaned = append(cleaned[:maxLines-1], fmt.Sprintf("… and %d more lines", omitted))
+	}
+	return cleaned
+}
+
+// cleanLine removes control characters, which could end the IRC line early,
+// and shortens the line to maxLineLength without splitting a character.
+func cleanLine(line string) string {
+	line = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case r == utf8.RuneError, unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, line)
+	line = strings.TrimRightFunc(line, unicode.IsSpace)
+	if strings.TrimSpace(line) == "" {
+		return ""
+	}
+	if len(line) <= maxLineLength {
+		return line
+	}
+	cut := maxLineLength - len("…")
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + "…"
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	var kept []string
+	for _, part := range parts {
+		if part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, sep)
+}
+
+// firstLine returns the first line of a commit message or similar.
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(line)
+}
+
+// shortRef turns refs/heads/main into main and refs/tags/v1 into v1.
+func shortRef(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
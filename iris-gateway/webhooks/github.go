@@ -0,0 +1,151 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Commits listed for a push; the rest are only counted.
+const maxPushCommits = 3
+
+type githubPayload struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	RefType    string `json:"ref_type"`
+	Created    bool   `json:"created"`
+	Deleted    bool   `json:"deleted"`
+	Forced     bool   `json:"forced"`
+	Compare    string `json:"compare"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	PullRequest *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+	} `json:"pull_request"`
+	Issue *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+	Comment *struct {
+		HTMLURL string `json:"html_url"`
+	} `json:"comment"`
+	Release *struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+	} `json:"release"`
+	WorkflowRun *struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_run"`
+}
+
+// formatGitHub formats the GitHub events people usually want in a channel.
+// Intermediate steps such as labelling a pull request or a workflow starting
+// aren't posted.
+func formatGitHub(event string, body []byte) ([]string, error) {
+	var p githubPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	repo := "[" + p.Repository.FullName + "]"
+
+	switch event {
+	case "ping":
+		return nil, nil
+	case "push":
+		branch := shortRef(p.Ref)
+		if p.Deleted {
+			return []string{fmt.Sprintf("%s %s deleted %s", repo, p.Sender.Login, branch)}, nil
+		}
+		verb := "pushed"
+		if p.Forced {
+			verb = "force-pushed"
+		}
+		if len(p.Commits) == 0 {
+			return []string{fmt.Sprintf("%s %s %s %s: %s", repo, p.Sender.Login, verb, branch, p.Compare)}, nil
+		}
+		lines := []string{fmt.Sprintf("%s %s %s %s to %s: %s", repo, p.Sender.Login, verb, plural(len(p.Commits), "commit"), branch, p.Compare)}
+		for i, commit := range p.Commits {
+			if i == maxPushCommits {
+				lines = append(lines, fmt.Sprintf("  … and %d more", len(p.Commits)-maxPushCommits))
+				break
+			}
+			lines = append(lines, fmt.Sprintf("  %.7s %s (%s)", commit.ID, firstLine(commit.Message), commit.Author.Name))
+		}
+		return lines, nil
+	case "create", "delete":
+		return []string{fmt.Sprintf("%s %s %sd %s %s", repo, p.Sender.Login, event, p.RefType, p.Ref)}, nil
+	case "pull_request":
+		if p.PullRequest == nil {
+			break
+		}
+		action := p.Action
+		switch action {
+		case "closed":
+			if p.PullRequest.Merged {
+				action = "merged"
+			}
+		case "opened", "reopened", "ready_for_review":
+		default:
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s %s %s pull request #%d: %s %s", repo, p.Sender.Login, strings.ReplaceAll(action, "_", " "), p.PullRequest.Number, p.PullRequest.Title, p.PullRequest.HTMLURL)}, nil
+	case "issues":
+		if p.Issue == nil {
+			break
+		}
+		switch p.Action {
+		case "opened", "closed", "reopened":
+		default:
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s %s %s issue #%d: %s %s", repo, p.Sender.Login, p.Action, p.Issue.Number, p.Issue.Title, p.Issue.HTMLURL)}, nil
+	case "issue_comment":
+		if p.Issue == nil || p.Comment == nil || p.Action != "created" {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s %s commented on #%d: %s %s", repo, p.Sender.Login, p.Issue.Number, p.Issue.Title, p.Comment.HTMLURL)}, nil
+	case "release":
+		if p.Release == nil || p.Action != "published" {
+			return nil, nil
+		}
+		name := p.Release.Name
+		if name == "" {
+			name = p.Release.TagName
+		}
+		return []string{fmt.Sprintf("%s %s published release %s: %s", repo, p.Sender.Login, name, p.Release.HTMLURL)}, nil
+	case "workflow_run":
+		if p.WorkflowRun == nil || p.Action != "completed" {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s %s %s on %s: %s", repo, p.WorkflowRun.Name, p.WorkflowRun.Conclusion, p.WorkflowRun.HeadBranch, p.WorkflowRun.HTMLURL)}, nil
+	}
+
+	// Events without a format of their own are still announced
+	line := fmt.Sprintf("%s %s event", repo, event)
+	if p.Action != "" {
+		line += " (" + p.Action + ")"
+	}
+	if p.Sender.Login != "" {
+		line += " from " + p.Sender.Login
+	}
+	return []string{line}, nil
+}
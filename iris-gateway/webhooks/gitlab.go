@@ -0,0 +1,108 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type gitlabPayload struct {
+	ObjectKind   string `json:"object_kind"`
+	Ref          string `json:"ref"`
+	After        string `json:"after"`
+	UserName     string `json:"user_name"`
+	TotalCommits int    `json:"total_commits_count"`
+	User         struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	ObjectAttributes struct {
+		ID     int    `json:"id"`
+		IID    int    `json:"iid"`
+		Title  string `json:"title"`
+		URL    string `json:"url"`
+		Action string `json:"action"`
+		Status string `json:"status"`
+		Ref    string `json:"ref"`
+		Tag    string `json:"tag"`
+	} `json:"object_attributes"`
+}
+
+// Past tense of merge request and issue actions worth posting.
+var gitlabActions = map[string]string{
+	"open":   "opened",
+	"close":  "closed",
+	"reopen": "reopened",
+	"merge":  "merged",
+}
+
+// formatGitLab formats GitLab pushes, merge requests, issues and finished
+// pipelines.
+func formatGitLab(event string, body []byte) ([]string, error) {
+	var p gitlabPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	repo := "[" + p.Project.PathWithNamespace + "]"
+	user := p.User.Username
+	if user == "" {
+		user = p.UserName
+	}
+
+	switch event {
+	case "Push Hook", "Tag Push Hook":
+		ref := shortRef(p.Ref)
+		if strings.Trim(p.After, "0") == "" {
+			return []string{fmt.Sprintf("%s %s deleted %s", repo, user, ref)}, nil
+		}
+		if event == "Tag Push Hook" {
+			return []string{fmt.Sprintf("%s %s pushed tag %s", repo, user, ref)}, nil
+		}
+		lines := []string{fmt.Sprintf("%s %s pushed %s to %s", repo, user, plural(p.TotalCommits, "commit"), ref)}
+		// GitLab lists the newest commits last
+		commits := p.Commits
+		if len(commits) > maxPushCommits {
+			commits = commits[len(commits)-maxPushCommits:]
+		}
+		for _, commit := range commits {
+			lines = append(lines, fmt.Sprintf("  %.8s %s (%s)", commit.ID, firstLine(commit.Message), commit.Author.Name))
+		}
+		if p.TotalCommits > len(commits) {
+			lines = append(lines, fmt.Sprintf("  … and %d more", p.TotalCommits-len(commits)))
+		}
+		return lines, nil
+	case "Merge Request Hook", "Issue Hook":
+		action, ok := gitlabActions[p.ObjectAttributes.Action]
+		if !ok {
+			return nil, nil
+		}
+		kind, number := "issue #", p.ObjectAttributes.IID
+		if event == "Merge Request Hook" {
+			kind = "merge request !"
+		}
+		return []string{fmt.Sprintf("%s %s %s %s%d: %s %s", repo, user, action, kind, number, p.ObjectAttributes.Title, p.ObjectAttributes.URL)}, nil
+	case "Pipeline Hook":
+		switch p.ObjectAttributes.Status {
+		case "success", "failed", "canceled":
+		default:
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s Pipeline #%d %s on %s: %s/-/pipelines/%d", repo, p.ObjectAttributes.ID, p.ObjectAttributes.Status, p.ObjectAttributes.Ref, p.Project.WebURL, p.ObjectAttributes.ID)}, nil
+	}
+
+	line := fmt.Sprintf("%s %s", repo, event)
+	if user != "" {
+		line += " from " + user
+	}
+	return []string{line}, nil
+}